@@ -5,22 +5,100 @@ import (
 	"log"
 	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
 	"github.com/s-humphreys/prometheus-proxy/internal/config"
+	"github.com/s-humphreys/prometheus-proxy/internal/dedup"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/limits"
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/metacache"
+	"github.com/s-humphreys/prometheus-proxy/internal/policy"
 	"github.com/s-humphreys/prometheus-proxy/internal/proxy"
+	"github.com/s-humphreys/prometheus-proxy/internal/queryrange"
+	"github.com/s-humphreys/prometheus-proxy/internal/tenancy"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 	"github.com/spf13/cobra"
 )
 
 var (
-	rootCmd           *cobra.Command
-	prometheusUrl     string
-	logLevel          string
-	port              int
-	azureTenantId     string
-	azureClientId     string
-	azureClientSecret *string
+	rootCmd                *cobra.Command
+	prometheusUrl          string
+	logLevel               string
+	port                   int
+	authProviders          []string
+	authChainMode          string
+	authStaticHeaders      map[string]string
+	azureTenantId          string
+	azureClientId          string
+	azureClientSecret      *string
+	azureClientCertPath    string
+	azureClientCertPass    string
+	azureCloud             string
+	azureAuthorityHost     string
+	azureScope             string
+	azureIMDS              bool
+	azureIMDSEndpoint      string
+	awsRegion              string
+	awsProfile             string
+	awsRoleArn             string
+	gcpCredentialsFile     string
+	oauth2TokenUrl         string
+	oauth2ClientId         string
+	oauth2ClientSecret     string
+	oauth2ClientSecretFile string
+	oauth2Scopes           []string
+	oauth2Audience         string
+	oauth2EndpointParams   map[string]string
+	execCommand            string
+	execArgs               []string
+	execEnv                map[string]string
+	bearerToken            string
+	bearerTokenFile        string
+	basicAuthUsername      string
+	basicAuthPassword      string
+	basicAuthPasswordFile  string
+	upstreamTLS            tlsconfig.Config
+	serverTLS              tlsconfig.Config
+	inboundAuth            []string
+	inboundBearerTokenFile string
+	inboundHtpasswdFile    string
+	inboundMTLSNames       []string
+	inboundTokenReviewURL  string
+	inboundTokenReviewAuds []string
+	enforceLabel           string
+	enforceLabelHeader     string
+	enforceTenantsFile     string
+	queryPolicyFile        string
+	queryLimits            limits.Limits
+	querySplitter          queryrange.Splitter
+	deduplicateRequests    bool
+	maxRequestBodySizeMB   int
+	maxGetQueryLength      int
+	headerPolicy           headerpolicy.Policy
+	upstreamsFile          string
+	cacheBackend           string
+	cacheDir               string
+	resultsCacheSizeMB     int
+	resultsCacheFreshness  time.Duration
+	metadataCacheSizeMB    int
+	metadataCacheTTLFlags  map[string]string
+	metadataCacheTTLs      map[string]time.Duration
+	metadataCacheSWR       time.Duration
+
+	supportedInboundAuth   = []string{"bearer", "htpasswd", "mtls", "tokenreview"}
+	supportedCacheBackends = []string{"memory", "disk"}
+
+	// Maps auth settings to their flags, e.g. basic.username to
+	// basic-auth-username
+	authFlagReplacer = strings.NewReplacer("chain_mode", "auth-chain-mode", "basic.", "basic-auth-", ".", "-", "_", "-")
 )
 
 func main() {
@@ -32,15 +110,7 @@ func main() {
 		Run:     run,
 	}
 
-	rootCmd.PersistentFlags().StringVar(&prometheusUrl, "prometheus-url", "", "The URL of the Prometheus instance to proxy requests to")
-	rootCmd.MarkPersistentFlagRequired("prometheus-url")
-	rootCmd.PersistentFlags().StringVar(&azureTenantId, "azure-tenant-id", "", "The Azure Tenant ID to use for authentication")
-	rootCmd.MarkPersistentFlagRequired("azure-tenant-id")
-	rootCmd.PersistentFlags().StringVar(&azureClientId, "azure-client-id", "", "The Azure Client ID to use for authentication")
-	rootCmd.MarkPersistentFlagRequired("azure-client-id")
-	azureClientSecret = rootCmd.PersistentFlags().String("azure-client-secret", "", "The Azure Client Secret to use for authentication (if not provided, will use Managed Identity)")
-	rootCmd.PersistentFlags().IntVar(&port, "port", 9090, "The port to run the proxy on")
-	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "INFO", "The log level to use")
+	addFlags(rootCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err.Error())
@@ -48,28 +118,402 @@ func main() {
 	}
 }
 
+// Registers the command line flags on the provided command
+func addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&prometheusUrl, "prometheus-url", "", "The URL of the Prometheus instance to proxy requests to")
+	cmd.MarkPersistentFlagRequired("prometheus-url")
+	cmd.PersistentFlags().StringSliceVar(&authProviders, "auth-provider", []string{"azure"}, "The authentication provider(s) to use for upstream requests, several are chained according to auth-chain-mode [azure, aws, gcp, oauth2, exec, bearer, basic]")
+	cmd.PersistentFlags().StringVar(&authChainMode, "auth-chain-mode", auth.ChainMerge, "How several auth providers are combined, merging their headers or trying each in turn [merge, fallback]")
+	cmd.PersistentFlags().StringToStringVar(&authStaticHeaders, "auth-static-headers", nil, "Static headers merged with the auth provider headers, e.g. X-Scope-OrgID=tenant-1")
+	cmd.PersistentFlags().StringVar(&azureTenantId, "azure-tenant-id", "", "The Azure Tenant ID to use for authentication")
+	cmd.PersistentFlags().StringVar(&azureClientId, "azure-client-id", "", "The Azure Client ID to use for authentication")
+	azureClientSecret = cmd.PersistentFlags().String("azure-client-secret", "", "The Azure Client Secret to use for authentication (if not provided, will use Managed Identity)")
+	cmd.PersistentFlags().StringVar(&azureClientCertPath, "azure-client-certificate-path", "", "The PEM or PFX client certificate of the Azure App Registration to use for authentication, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&azureClientCertPass, "azure-client-certificate-password", "", "The password of the Azure client certificate, if encrypted")
+	cmd.PersistentFlags().StringVar(&azureCloud, "azure-cloud", "AzurePublic", "The Azure cloud to authenticate against [AzurePublic, AzureUSGovernment, AzureChina]")
+	cmd.PersistentFlags().StringVar(&azureAuthorityHost, "azure-authority-host", "", "Overrides the Azure authority host of the selected cloud")
+	cmd.PersistentFlags().StringVar(&azureScope, "azure-scope", "", "Overrides the token scope of the selected cloud")
+	cmd.PersistentFlags().BoolVar(&azureIMDS, "azure-imds", false, "Uses the VM or VMSS managed identity from the Azure Instance Metadata Service (azure-client-id selects a user-assigned identity)")
+	cmd.PersistentFlags().StringVar(&azureIMDSEndpoint, "azure-imds-endpoint", "", "Overrides the Azure Instance Metadata Service token endpoint")
+	cmd.PersistentFlags().StringVar(&awsRegion, "aws-region", "", "The AWS region of the Amazon Managed Service for Prometheus workspace (defaults to AWS_REGION)")
+	cmd.PersistentFlags().StringVar(&awsProfile, "aws-profile", "", "The profile to read from the AWS shared credentials file (defaults to AWS_PROFILE)")
+	cmd.PersistentFlags().StringVar(&awsRoleArn, "aws-role-arn", "", "The AWS role to assume with web identity (defaults to AWS_ROLE_ARN)")
+	cmd.PersistentFlags().StringVar(&gcpCredentialsFile, "gcp-credentials-file", "", "The GCP service account key file to use for authentication (defaults to GOOGLE_APPLICATION_CREDENTIALS, then the metadata server)")
+	cmd.PersistentFlags().StringVar(&oauth2TokenUrl, "oauth2-token-url", "", "The OAuth2 token endpoint to request client credentials tokens from")
+	cmd.PersistentFlags().StringVar(&oauth2ClientId, "oauth2-client-id", "", "The OAuth2 client ID to use for authentication")
+	cmd.PersistentFlags().StringVar(&oauth2ClientSecret, "oauth2-client-secret", "", "The OAuth2 client secret to use for authentication")
+	cmd.PersistentFlags().StringVar(&oauth2ClientSecretFile, "oauth2-client-secret-file", "", "A file containing the OAuth2 client secret, re-read on every token request")
+	cmd.PersistentFlags().StringSliceVar(&oauth2Scopes, "oauth2-scopes", nil, "The OAuth2 scopes to request")
+	cmd.PersistentFlags().StringVar(&oauth2Audience, "oauth2-audience", "", "The OAuth2 audience to request")
+	cmd.PersistentFlags().StringToStringVar(&oauth2EndpointParams, "oauth2-endpoint-params", nil, "Additional form parameters to send to the OAuth2 token endpoint")
+	cmd.PersistentFlags().StringVar(&execCommand, "exec-command", "", "The credential plugin command to run, which prints a JSON token and/or headers with an optional expiry")
+	cmd.PersistentFlags().StringSliceVar(&execArgs, "exec-args", nil, "The arguments to pass to the credential plugin command")
+	cmd.PersistentFlags().StringToStringVar(&execEnv, "exec-env", nil, "Additional environment variables to pass to the credential plugin command")
+	cmd.PersistentFlags().StringVar(&bearerToken, "bearer-token", "", "The static bearer token to use for authentication")
+	cmd.PersistentFlags().StringVar(&bearerTokenFile, "bearer-token-file", "", "A file containing the bearer token, re-read when it changes")
+	cmd.PersistentFlags().StringVar(&basicAuthUsername, "basic-auth-username", "", "The basic auth username to use for authentication")
+	cmd.PersistentFlags().StringVar(&basicAuthPassword, "basic-auth-password", "", "The basic auth password to use for authentication")
+	cmd.PersistentFlags().StringVar(&basicAuthPasswordFile, "basic-auth-password-file", "", "A file containing the basic auth password, re-read when it changes")
+	cmd.PersistentFlags().StringVar(&upstreamTLS.CertFile, "upstream-tls-cert-file", "", "The client certificate to present to the upstream Prometheus, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&upstreamTLS.KeyFile, "upstream-tls-key-file", "", "The private key of the upstream client certificate, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&upstreamTLS.CAFile, "upstream-tls-ca-file", "", "The CA bundle used to verify the upstream Prometheus certificate, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&upstreamTLS.ServerName, "upstream-tls-server-name", "", "The server name used to verify the upstream Prometheus certificate")
+	cmd.PersistentFlags().StringVar(&upstreamTLS.MinVersion, "upstream-tls-min-version", "", "The minimum TLS version for upstream connections [TLS10, TLS11, TLS12, TLS13] (default TLS12)")
+	cmd.PersistentFlags().BoolVar(&upstreamTLS.InsecureSkipVerify, "upstream-tls-insecure-skip-verify", false, "Disables verification of the upstream Prometheus certificate (development only)")
+	cmd.PersistentFlags().StringVar(&serverTLS.CertFile, "tls-cert-file", "", "The certificate to serve the proxy over TLS with, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&serverTLS.KeyFile, "tls-key-file", "", "The private key of the serving certificate, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&serverTLS.CAFile, "tls-client-ca-file", "", "The CA bundle used to verify caller client certificates, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&serverTLS.MinVersion, "tls-min-version", "", "The minimum TLS version accepted from callers [TLS10, TLS11, TLS12, TLS13] (default TLS12)")
+	cmd.PersistentFlags().StringSliceVar(&inboundAuth, "inbound-auth", nil, "The methods callers of the proxy may authenticate with, all callers are accepted if unset [bearer, htpasswd, mtls, tokenreview]")
+	cmd.PersistentFlags().StringVar(&inboundBearerTokenFile, "inbound-bearer-token-file", "", "A Kubernetes static token file of accepted caller bearer tokens, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&inboundHtpasswdFile, "inbound-htpasswd-file", "", "An htpasswd file of accepted caller basic auth credentials, reloaded when it changes")
+	cmd.PersistentFlags().StringSliceVar(&inboundMTLSNames, "inbound-mtls-allowed-names", nil, "The accepted caller client certificate common names, any certificate signed by tls-client-ca-file is accepted if unset")
+	cmd.PersistentFlags().StringVar(&inboundTokenReviewURL, "inbound-tokenreview-api-server", "", "The Kubernetes API server used to review caller tokens (defaults to the in-cluster API server)")
+	cmd.PersistentFlags().StringSliceVar(&inboundTokenReviewAuds, "inbound-tokenreview-audiences", nil, "The audiences caller tokens must be valid for (defaults to the API server audience)")
+	cmd.PersistentFlags().StringVar(&enforceLabel, "enforce-label", "", "A label, such as namespace, restricted to the caller's values in every query and series match")
+	cmd.PersistentFlags().StringVar(&enforceLabelHeader, "enforce-label-header", "", "A trusted request header carrying the caller's comma separated values of enforce-label")
+	cmd.PersistentFlags().StringVar(&enforceTenantsFile, "enforce-label-tenants-file", "", "A YAML file mapping authenticated callers and their groups to values of enforce-label, reloaded when it changes")
+	cmd.PersistentFlags().StringVar(&queryPolicyFile, "query-policy-file", "", "A YAML file of rules allowing or denying queries, reloaded when it changes")
+	cmd.PersistentFlags().DurationVar(&queryLimits.MaxRange, "max-query-range", 0, "The longest time range of a range query, unlimited if 0")
+	cmd.PersistentFlags().IntVar(&queryLimits.MaxPoints, "max-query-points", 0, "The most points per series a range query may return, (end-start)/step+1, unlimited if 0")
+	cmd.PersistentFlags().DurationVar(&queryLimits.MinStep, "min-query-step", 0, "The smallest step of a range query, unlimited if 0")
+	cmd.PersistentFlags().DurationVar(&queryLimits.MaxLookback, "max-query-lookback", 0, "The longest range selector or subquery of a query, unlimited if 0")
+	cmd.PersistentFlags().BoolVar(&queryLimits.Clamp, "clamp-query-limits", false, "Clamp range queries exceeding the range, points or step limits rather than rejecting them")
+	cmd.PersistentFlags().DurationVar(&querySplitter.Interval, "split-query-interval", 0, "Split range queries into sub-ranges of this length aligned to the epoch, e.g. 24h, executed concurrently and merged, disabled if 0")
+	cmd.PersistentFlags().IntVar(&querySplitter.MaxParallel, "split-query-max-parallel", 4, "The most sub-ranges of a split range query executed at once")
+	cmd.PersistentFlags().StringSliceVar(&headerPolicy.Allow, "forward-request-headers", nil, "Caller headers forwarded upstream in addition to the default allowlist, a trailing * matches by prefix, e.g. X-Scope-OrgID,X-Custom-*")
+	cmd.PersistentFlags().StringSliceVar(&headerPolicy.Deny, "drop-request-headers", nil, "Caller headers never forwarded upstream, overriding the allowlists, a trailing * matches by prefix")
+	cmd.PersistentFlags().BoolVar(&deduplicateRequests, "deduplicate-requests", false, "Share one upstream request between identical requests from the same caller in flight at once, buffering each response in memory")
+	cmd.PersistentFlags().StringVar(&cacheBackend, "cache-backend", "memory", "Where the results and metadata caches are stored, disk persists them in cache-dir across restarts [memory, disk]")
+	cmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "The directory of the disk cache backend, e.g. on a persistent volume")
+	cmd.PersistentFlags().IntVar(&resultsCacheSizeMB, "results-cache-size-mb", 0, "The size in MiB of the range query results cache, disabled if 0")
+	cmd.PersistentFlags().DurationVar(&resultsCacheFreshness, "results-cache-max-freshness", 10*time.Minute, "Range query results more recent than this are never cached, as samples may still be arriving")
+	cmd.PersistentFlags().IntVar(&metadataCacheSizeMB, "metadata-cache-size-mb", 0, "The size in MiB of the labels, series and metadata response cache, disabled if 0")
+	cmd.PersistentFlags().StringToStringVar(&metadataCacheTTLFlags, "metadata-cache-ttls", nil, "How long responses are fresh per route, overriding labels=5m,label_values=5m,series=1m,metadata=15m, a route is not cached if 0")
+	cmd.PersistentFlags().DurationVar(&metadataCacheSWR, "metadata-cache-stale-while-revalidate", 5*time.Minute, "How long after expiring a metadata response is served while it is refreshed in the background")
+	cmd.PersistentFlags().IntVar(&maxRequestBodySizeMB, "max-request-body-size-mb", 10, "The largest request body in MiB accepted from callers, larger requests are rejected with a 413, unlimited if 0")
+	cmd.PersistentFlags().IntVar(&maxGetQueryLength, "max-get-query-length", 0, "Forward GET requests whose encoded query string is longer than this as form-encoded POST requests, for endpoints accepting POST, disabled if 0")
+	cmd.PersistentFlags().StringVar(&upstreamsFile, "upstreams-file", "", "A YAML file of named upstreams with their own credentials, selected by path prefix, header or caller, read once at startup")
+	cmd.PersistentFlags().IntVar(&port, "port", 9090, "The port to run the proxy on")
+	cmd.PersistentFlags().StringVar(&logLevel, "log-level", "INFO", "The log level to use")
+}
+
 func validate(_ *cobra.Command, _ []string) error {
 	if _, exists := logger.LogLevelMap[logLevel]; !exists {
 		return fmt.Errorf("invalid log level %q, allowed values are: %v", logLevel, maps.Keys(logger.LogLevelMap))
 	}
+
+	if err := upstreamTLS.Validate(); err != nil {
+		return err
+	}
+	if err := validateInbound(); err != nil {
+		return err
+	}
+	if err := validateTenancy(); err != nil {
+		return err
+	}
+	if err := validateQueryLimits(); err != nil {
+		return err
+	}
+	if err := validateMetadataCache(); err != nil {
+		return err
+	}
+	if err := validateCacheBackend(); err != nil {
+		return err
+	}
+
+	if len(authProviders) == 0 {
+		return fmt.Errorf(`required flag(s) "auth-provider" not set`)
+	}
+	return newAuthConfig().Validate(authFlag)
+}
+
+// Validates the listener TLS and inbound authentication flags
+func validateInbound() error {
+	if err := serverTLS.Validate(); err != nil {
+		return err
+	}
+	if serverTLS.IsSet() && serverTLS.CertFile == "" {
+		return fmt.Errorf(`required flag(s) "tls-cert-file", "tls-key-file" not set to serve tls`)
+	}
+
+	for _, method := range inboundAuth {
+		switch method {
+		case "bearer":
+			if inboundBearerTokenFile == "" {
+				return fmt.Errorf(`required flag(s) "inbound-bearer-token-file" not set for inbound auth %q`, method)
+			}
+		case "htpasswd":
+			if inboundHtpasswdFile == "" {
+				return fmt.Errorf(`required flag(s) "inbound-htpasswd-file" not set for inbound auth %q`, method)
+			}
+		case "mtls":
+			if serverTLS.CAFile == "" {
+				return fmt.Errorf(`required flag(s) "tls-client-ca-file" not set for inbound auth %q`, method)
+			}
+		case "tokenreview":
+		default:
+			return fmt.Errorf("invalid inbound auth %q, allowed values are: %v", method, supportedInboundAuth)
+		}
+	}
 	return nil
 }
 
-func run(_ *cobra.Command, _ []string) {
-	var secret *string
+// Validates the label enforcement flags
+func validateTenancy() error {
+	if enforceLabel == "" {
+		if enforceLabelHeader != "" || enforceTenantsFile != "" {
+			return fmt.Errorf(`required flag(s) "enforce-label" not set`)
+		}
+		return nil
+	}
+
+	switch {
+	case enforceLabelHeader != "" && enforceTenantsFile != "":
+		return fmt.Errorf(`flags "enforce-label-header" and "enforce-label-tenants-file" cannot be used together`)
+	case enforceLabelHeader == "" && enforceTenantsFile == "":
+		return fmt.Errorf(`one of flag(s) "enforce-label-header", "enforce-label-tenants-file" must be set for "enforce-label"`)
+	case enforceTenantsFile != "" && len(inboundAuth) == 0:
+		return fmt.Errorf(`required flag(s) "inbound-auth" not set for "enforce-label-tenants-file"`)
+	}
+	return nil
+}
+
+// Validates the query limit, request size, splitting and caching flags
+func validateQueryLimits() error {
+	if queryLimits.MaxRange < 0 || queryLimits.MinStep < 0 || queryLimits.MaxLookback < 0 {
+		return fmt.Errorf("query limits must not be negative")
+	}
+	if queryLimits.MaxPoints < 0 || queryLimits.MaxPoints == 1 {
+		return fmt.Errorf("invalid max query points %d, must be 0 or at least 2", queryLimits.MaxPoints)
+	}
+	if resultsCacheSizeMB < 0 || resultsCacheFreshness < 0 {
+		return fmt.Errorf("results cache size and max freshness must not be negative")
+	}
+	if maxRequestBodySizeMB < 0 {
+		return fmt.Errorf("max request body size must not be negative")
+	}
+	if maxGetQueryLength < 0 {
+		return fmt.Errorf("max get query length must not be negative")
+	}
+	if querySplitter.Interval < 0 {
+		return fmt.Errorf("split query interval must not be negative")
+	}
+	if querySplitter.MaxParallel < 1 {
+		return fmt.Errorf("invalid split query max parallel %d, must be at least 1", querySplitter.MaxParallel)
+	}
+	return nil
+}
+
+// Validates the metadata cache flags, parsing the per-route TTLs
+func validateMetadataCache() error {
+	if metadataCacheSizeMB < 0 || metadataCacheSWR < 0 {
+		return fmt.Errorf("metadata cache size and stale while revalidate must not be negative")
+	}
+
+	metadataCacheTTLs = maps.Clone(metacache.DefaultTTLs)
+	for route, value := range metadataCacheTTLFlags {
+		if _, ok := metacache.DefaultTTLs[route]; !ok {
+			return fmt.Errorf("invalid metadata cache route %q, allowed values are: %v", route, slices.Sorted(maps.Keys(metacache.DefaultTTLs)))
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid metadata cache ttl %q for route %q", value, route)
+		}
+		metadataCacheTTLs[route] = ttl
+	}
+	return nil
+}
+
+// Validates the cache backend flags
+func validateCacheBackend() error {
+	if !slices.Contains(supportedCacheBackends, cacheBackend) {
+		return fmt.Errorf("invalid cache backend %q, allowed values are: %v", cacheBackend, supportedCacheBackends)
+	}
+	if cacheBackend == "disk" && cacheDir == "" {
+		return fmt.Errorf(`required flag(s) "cache-dir" not set for cache backend "disk"`)
+	}
+	return nil
+}
+
+// Returns the flag of an auth setting, e.g. "azure-tenant-id" for
+// azure.tenant_id
+func authFlag(setting string) string {
+	return authFlagReplacer.Replace(setting)
+}
+
+// Creates the auth config of the upstream from the flags
+func newAuthConfig() *auth.Config {
+	c := &auth.Config{
+		Providers:     authProviders,
+		ChainMode:     authChainMode,
+		StaticHeaders: authStaticHeaders,
+	}
+
+	c.Azure.TenantId = azureTenantId
+	c.Azure.ClientId = azureClientId
 	if rootCmd.Flags().Changed("azure-client-secret") {
-		secret = azureClientSecret
+		c.Azure.ClientSecret = azureClientSecret
 	}
+	c.Azure.ClientCertificatePath = azureClientCertPath
+	c.Azure.ClientCertificatePassword = azureClientCertPass
+	c.Azure.Cloud = azureCloud
+	c.Azure.AuthorityHost = azureAuthorityHost
+	c.Azure.Scope = azureScope
+	c.Azure.IMDS = azureIMDS
+	c.Azure.IMDSEndpoint = azureIMDSEndpoint
+
+	c.AWS.Region = awsRegion
+	c.AWS.Profile = awsProfile
+	c.AWS.RoleArn = awsRoleArn
+
+	c.GCP.CredentialsFile = gcpCredentialsFile
+
+	c.OAuth2.TokenURL = oauth2TokenUrl
+	c.OAuth2.ClientId = oauth2ClientId
+	c.OAuth2.ClientSecret = oauth2ClientSecret
+	c.OAuth2.ClientSecretFile = oauth2ClientSecretFile
+	c.OAuth2.Scopes = oauth2Scopes
+	c.OAuth2.Audience = oauth2Audience
+	c.OAuth2.EndpointParams = oauth2EndpointParams
+
+	c.Exec.Command = execCommand
+	c.Exec.Args = execArgs
+	c.Exec.Env = execEnv
+
+	c.Bearer.Token = bearerToken
+	c.Bearer.TokenFile = bearerTokenFile
+
+	c.Basic.Username = basicAuthUsername
+	c.Basic.Password = basicAuthPassword
+	c.Basic.PasswordFile = basicAuthPasswordFile
+	return c
+}
 
+// Creates the authentication client for the selected providers, chaining them
+// if several are selected or static headers are set
+func newAuthClient() auth.Client {
+	return auth.NewClient(newAuthConfig())
+}
+
+// Creates the authenticators for the selected inbound auth methods
+func newInboundAuth() inbound.Chain {
+	var chain inbound.Chain
+	for _, method := range inboundAuth {
+		switch method {
+		case "bearer":
+			chain = append(chain, &inbound.BearerAuthenticator{TokenFile: inboundBearerTokenFile})
+		case "htpasswd":
+			chain = append(chain, &inbound.HtpasswdAuthenticator{File: inboundHtpasswdFile})
+		case "mtls":
+			chain = append(chain, &inbound.ClientCertAuthenticator{AllowedNames: inboundMTLSNames})
+		case "tokenreview":
+			chain = append(chain, &inbound.TokenReviewAuthenticator{
+				APIServerURL: inboundTokenReviewURL,
+				Audiences:    inboundTokenReviewAuds,
+			})
+		}
+	}
+	return chain
+}
+
+// Creates the label enforcer, or nil if queries are unrestricted
+func newTenancy() *tenancy.Enforcer {
+	if enforceLabel == "" {
+		return nil
+	}
+	return &tenancy.Enforcer{
+		Label:       enforceLabel,
+		Header:      enforceLabelHeader,
+		TenantsFile: enforceTenantsFile,
+	}
+}
+
+// Creates the query policy engine, or nil if all queries are allowed
+func newPolicy() *policy.Engine {
+	if queryPolicyFile == "" {
+		return nil
+	}
+	return &policy.Engine{File: queryPolicyFile}
+}
+
+// Creates the range query splitter, or nil if splitting is disabled
+func newSplitter() *queryrange.Splitter {
+	if querySplitter.Interval == 0 {
+		return nil
+	}
+	return &querySplitter
+}
+
+// Creates the in-flight request deduplicator, or nil if disabled
+func newDeduplicator() *dedup.Deduplicator {
+	if !deduplicateRequests {
+		return nil
+	}
+	return &dedup.Deduplicator{}
+}
+
+// Creates the router of named upstreams, or nil if every request is forwarded
+// to prometheus-url
+func newUpstreams() *upstream.Router {
+	if upstreamsFile == "" {
+		return nil
+	}
+	return &upstream.Router{File: upstreamsFile, TLS: &upstreamTLS}
+}
+
+// Creates a cache of the selected backend, each disk cache is stored in its
+// own subdirectory of cache-dir
+func newCache(name string, sizeMB int) cache.Cache {
+	if cacheBackend == "disk" {
+		return cache.NewDisk(filepath.Join(cacheDir, name), int64(sizeMB)<<20)
+	}
+	return cache.NewMemory(int64(sizeMB) << 20)
+}
+
+// Creates the range query results cache, or nil if caching is disabled
+func newResultsCache() *queryrange.ResultsCache {
+	if resultsCacheSizeMB == 0 {
+		return nil
+	}
+	return &queryrange.ResultsCache{
+		Cache:        newCache("results", resultsCacheSizeMB),
+		MaxFreshness: resultsCacheFreshness,
+	}
+}
+
+// Creates the metadata endpoint cache, or nil if caching is disabled
+func newMetadataCache() *metacache.MetadataCache {
+	if metadataCacheSizeMB == 0 {
+		return nil
+	}
+	return &metacache.MetadataCache{
+		Cache:                newCache("metadata", metadataCacheSizeMB),
+		TTLs:                 metadataCacheTTLs,
+		StaleWhileRevalidate: metadataCacheSWR,
+	}
+}
+
+func run(_ *cobra.Command, _ []string) {
 	conf := &config.Config{
-		PrometheusUrl: prometheusUrl,
-		LogLevel:      logLevel,
-		Port:          port,
-		Client: &auth.AzureClient{
-			TenantId:     azureTenantId,
-			ClientId:     azureClientId,
-			ClientSecret: secret,
-		},
+		PrometheusUrl:       prometheusUrl,
+		LogLevel:            logLevel,
+		Port:                port,
+		Client:              newAuthClient(),
+		UpstreamTLS:         &upstreamTLS,
+		Inbound:             newInboundAuth(),
+		Policy:              newPolicy(),
+		Limits:              &queryLimits,
+		Splitter:            newSplitter(),
+		ResultsCache:        newResultsCache(),
+		MetadataCache:       newMetadataCache(),
+		Deduplicator:        newDeduplicator(),
+		Headers:             &headerPolicy,
+		MaxRequestBodyBytes: int64(maxRequestBodySizeMB) << 20,
+		MaxGetQueryLength:   maxGetQueryLength,
+		Upstreams:           newUpstreams(),
+		Tenancy:             newTenancy(),
+		ServerTLS:           &serverTLS,
 	}
 
 	proxy.Run(conf)
@@ -3,7 +3,20 @@ package main
 import (
 	"bytes"
 	"testing"
+	"time"
 
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/dedup"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/limits"
+	"github.com/s-humphreys/prometheus-proxy/internal/metacache"
+	"github.com/s-humphreys/prometheus-proxy/internal/policy"
+	"github.com/s-humphreys/prometheus-proxy/internal/queryrange"
+	"github.com/s-humphreys/prometheus-proxy/internal/tenancy"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,12 +30,9 @@ func TestRootCmdFlags(t *testing.T) {
 	run = func(_ *cobra.Command, _ []string) {}
 
 	resetCmd := func() {
-		prometheusUrl = ""
-		logLevel = "INFO"
-		port = 9090
-		azureTenantId = ""
-		azureClientId = ""
 		azureClientSecret = nil
+		upstreamTLS = tlsconfig.Config{}
+		serverTLS = tlsconfig.Config{}
 
 		rootCmd = &cobra.Command{
 			Use:     "run",
@@ -31,16 +41,7 @@ func TestRootCmdFlags(t *testing.T) {
 			PreRunE: validate,
 			Run:     run,
 		}
-
-		rootCmd.PersistentFlags().StringVar(&prometheusUrl, "prometheus-url", "", "The URL of the Prometheus instance to proxy requests to")
-		rootCmd.MarkPersistentFlagRequired("prometheus-url")
-		rootCmd.PersistentFlags().StringVar(&azureTenantId, "azure-tenant-id", "", "The Azure Tenant ID to use for authentication")
-		rootCmd.MarkPersistentFlagRequired("azure-tenant-id")
-		rootCmd.PersistentFlags().StringVar(&azureClientId, "azure-client-id", "", "The Azure Client ID to use for authentication")
-		rootCmd.MarkPersistentFlagRequired("azure-client-id")
-		azureClientSecret = rootCmd.PersistentFlags().String("azure-client-secret", "", "The Azure Client Secret to use for authentication (if not provided, will use Managed Identity)")
-		rootCmd.PersistentFlags().IntVar(&port, "port", 9090, "The port to run the proxy on")
-		rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "INFO", "The log level to use [DEBUG, INFO]")
+		addFlags(rootCmd)
 	}
 
 	t.Run("SuccessWithAllFlags", func(t *testing.T) {
@@ -117,4 +118,762 @@ func TestRootCmdFlags(t *testing.T) {
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), `invalid log level "INVALID"`)
 	})
+
+	t.Run("SuccessWithAwsProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://aps-workspaces.eu-west-1.amazonaws.com/workspaces/ws-123",
+			"--auth-provider", "aws",
+			"--aws-region", "eu-west-1",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"aws"}, authProviders)
+		assert.Equal(t, "eu-west-1", awsRegion)
+		assert.IsType(t, &auth.AWSClient{}, newAuthClient())
+	})
+
+	t.Run("SuccessWithGcpProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://monitoring.googleapis.com/v1/projects/project/location/global/prometheus",
+			"--auth-provider", "gcp",
+			"--gcp-credentials-file", "/var/secrets/google/key.json",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, "/var/secrets/google/key.json", gcpCredentialsFile)
+		assert.IsType(t, &auth.GCPClient{}, newAuthClient())
+	})
+
+	t.Run("SuccessWithOAuth2Provider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://mimir.example.com/prometheus",
+			"--auth-provider", "oauth2",
+			"--oauth2-token-url", "https://keycloak.example.com/realms/metrics/protocol/openid-connect/token",
+			"--oauth2-client-id", "proxy",
+			"--oauth2-client-secret-file", "/var/secrets/oauth2/secret",
+			"--oauth2-scopes", "metrics:read,openid",
+			"--oauth2-endpoint-params", "resource=mimir",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"metrics:read", "openid"}, oauth2Scopes)
+		assert.Equal(t, map[string]string{"resource": "mimir"}, oauth2EndpointParams)
+		assert.IsType(t, &auth.OAuth2Client{}, newAuthClient())
+	})
+
+	t.Run("FailureOAuth2MissingSecret", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://mimir.example.com/prometheus",
+			"--auth-provider", "oauth2",
+			"--oauth2-token-url", "https://idp.example.com/token",
+			"--oauth2-client-id", "proxy",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"oauth2-client-secret" or "oauth2-client-secret-file"`)
+	})
+
+	t.Run("SuccessWithExecProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "exec",
+			"--exec-command", "/usr/local/bin/vault-broker",
+			"--exec-args", "token,--role=prometheus",
+			"--exec-env", "VAULT_ADDR=https://vault:8200",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		client, ok := newAuthClient().(*auth.ExecClient)
+		assert.True(t, ok)
+		assert.Equal(t, "/usr/local/bin/vault-broker", client.Command)
+		assert.Equal(t, []string{"token", "--role=prometheus"}, client.Args)
+		assert.Equal(t, map[string]string{"VAULT_ADDR": "https://vault:8200"}, client.Env)
+	})
+
+	t.Run("FailureExecMissingCommand", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "exec",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"exec-command"`)
+	})
+
+	t.Run("SuccessWithAuthChain", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "azure,bearer",
+			"--auth-chain-mode", "fallback",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--bearer-token", "fallback-token",
+			"--auth-static-headers", "X-Scope-OrgID=tenant-1",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		outer, ok := newAuthClient().(*auth.ChainClient)
+		assert.True(t, ok)
+		assert.Equal(t, auth.ChainMerge, outer.Mode)
+		assert.Len(t, outer.Clients, 2)
+		assert.Equal(t, &auth.HeadersClient{Headers: map[string]string{"X-Scope-OrgID": "tenant-1"}}, outer.Clients[1])
+
+		inner, ok := outer.Clients[0].(*auth.ChainClient)
+		assert.True(t, ok)
+		assert.Equal(t, auth.ChainFallback, inner.Mode)
+		assert.IsType(t, &auth.AzureClient{}, inner.Clients[0])
+		assert.IsType(t, &auth.BearerClient{}, inner.Clients[1])
+	})
+
+	t.Run("FailureAuthChainInvalidProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "bearer,kerberos",
+			"--bearer-token", "token",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid auth provider "kerberos"`)
+	})
+
+	t.Run("FailureAuthChainInvalidMode", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "bearer",
+			"--bearer-token", "token",
+			"--auth-chain-mode", "round-robin",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid auth chain mode "round-robin"`)
+	})
+
+	t.Run("FailureAuthChainFallbackWithAWS", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://mimir:8080/prometheus",
+			"--auth-provider", "bearer,aws",
+			"--bearer-token", "token",
+			"--auth-chain-mode", "fallback",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `auth provider "aws" signs requests`)
+	})
+
+	t.Run("SuccessWithInboundAuth", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--tls-cert-file", "/var/tls/tls.crt",
+			"--tls-key-file", "/var/tls/tls.key",
+			"--tls-client-ca-file", "/var/tls/ca.crt",
+			"--inbound-auth", "mtls,bearer,htpasswd,tokenreview",
+			"--inbound-mtls-allowed-names", "grafana",
+			"--inbound-bearer-token-file", "/var/secrets/tokens.csv",
+			"--inbound-htpasswd-file", "/var/secrets/.htpasswd",
+			"--inbound-tokenreview-audiences", "prometheus-proxy",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, inbound.Chain{
+			&inbound.ClientCertAuthenticator{AllowedNames: []string{"grafana"}},
+			&inbound.BearerAuthenticator{TokenFile: "/var/secrets/tokens.csv"},
+			&inbound.HtpasswdAuthenticator{File: "/var/secrets/.htpasswd"},
+			&inbound.TokenReviewAuthenticator{Audiences: []string{"prometheus-proxy"}},
+		}, newInboundAuth())
+	})
+
+	t.Run("FailureInboundMTLSWithoutClientCA", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--inbound-auth", "mtls",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"tls-client-ca-file" not set for inbound auth "mtls"`)
+	})
+
+	t.Run("FailureInvalidInboundAuth", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--inbound-auth", "oidc",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid inbound auth "oidc"`)
+	})
+
+	t.Run("FailureServerTLSWithoutCert", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--tls-client-ca-file", "/var/tls/ca.crt",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"tls-cert-file", "tls-key-file" not set`)
+	})
+
+	t.Run("SuccessWithEnforceLabel", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--inbound-auth", "tokenreview",
+			"--enforce-label", "namespace",
+			"--enforce-label-tenants-file", "/etc/prometheus-proxy/tenants.yaml",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, &tenancy.Enforcer{Label: "namespace", TenantsFile: "/etc/prometheus-proxy/tenants.yaml"}, newTenancy())
+	})
+
+	t.Run("SuccessWithQueryPolicy", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--query-policy-file", "/etc/prometheus-proxy/policy.yaml",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, &policy.Engine{File: "/etc/prometheus-proxy/policy.yaml"}, newPolicy())
+	})
+
+	t.Run("SuccessWithQueryLimits", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--max-query-range", "168h",
+			"--max-query-points", "11000",
+			"--min-query-step", "30s",
+			"--max-query-lookback", "24h",
+			"--clamp-query-limits",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, limits.Limits{
+			MaxRange:    168 * time.Hour,
+			MaxPoints:   11000,
+			MinStep:     30 * time.Second,
+			MaxLookback: 24 * time.Hour,
+			Clamp:       true,
+		}, queryLimits)
+	})
+
+	t.Run("SuccessWithQuerySplitting", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--split-query-interval", "24h",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, &queryrange.Splitter{Interval: 24 * time.Hour, MaxParallel: 4}, newSplitter())
+	})
+
+	t.Run("SuccessWithResultsCache", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--results-cache-size-mb", "256",
+			"--results-cache-max-freshness", "5m",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		resultsCache := newResultsCache()
+		assert.NotNil(t, resultsCache)
+		assert.Equal(t, 5*time.Minute, resultsCache.MaxFreshness)
+	})
+
+	t.Run("SuccessWithMetadataCache", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--metadata-cache-size-mb", "64",
+			"--metadata-cache-ttls", "series=30s,metadata=0s",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		metadataCache := newMetadataCache()
+		assert.NotNil(t, metadataCache)
+		assert.Equal(t, map[string]time.Duration{
+			metacache.RouteLabels:      5 * time.Minute,
+			metacache.RouteLabelValues: 5 * time.Minute,
+			metacache.RouteSeries:      30 * time.Second,
+			metacache.RouteMetadata:    0,
+		}, metadataCache.TTLs)
+		assert.Equal(t, 5*time.Minute, metadataCache.StaleWhileRevalidate)
+	})
+
+	t.Run("FailureInvalidMetadataCacheRoute", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--metadata-cache-size-mb", "64",
+			"--metadata-cache-ttls", "query=1m",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid metadata cache route "query"`)
+	})
+
+	t.Run("SuccessWithDiskCache", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--cache-backend", "disk",
+			"--cache-dir", t.TempDir(),
+			"--results-cache-size-mb", "1024",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.IsType(t, &cache.Disk{}, newResultsCache().Cache)
+	})
+
+	t.Run("FailureDiskCacheWithoutDir", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--cache-backend", "disk",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `required flag(s) "cache-dir" not set`)
+	})
+
+	t.Run("SuccessWithoutDeduplication", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Nil(t, newDeduplicator())
+	})
+
+	t.Run("SuccessWithDeduplication", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--deduplicate-requests",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, &dedup.Deduplicator{}, newDeduplicator())
+	})
+
+	t.Run("SuccessWithHeaderPolicy", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--forward-request-headers", "X-Scope-OrgID,X-Custom-*",
+			"--drop-request-headers", "User-Agent",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, headerpolicy.Policy{
+			Allow: []string{"X-Scope-OrgID", "X-Custom-*"},
+			Deny:  []string{"User-Agent"},
+		}, headerPolicy)
+	})
+
+	t.Run("SuccessWithUpstreamsFile", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--upstreams-file", "/etc/prometheus-proxy/upstreams.yaml",
+			"--upstream-tls-ca-file", "/etc/prometheus-proxy/ca.crt",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, &upstream.Router{
+			File: "/etc/prometheus-proxy/upstreams.yaml",
+			TLS:  &tlsconfig.Config{CAFile: "/etc/prometheus-proxy/ca.crt"},
+		}, newUpstreams())
+	})
+
+	t.Run("FailureInvalidQueryLimits", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--max-query-points", "1",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid max query points 1")
+	})
+
+	t.Run("FailureNegativeMaxRequestBodySize", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--max-request-body-size-mb", "-1",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "max request body size must not be negative")
+	})
+
+	t.Run("SuccessWithMaxGetQueryLength", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--max-get-query-length", "8192",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, 8192, maxGetQueryLength)
+	})
+
+	t.Run("FailureEnforceLabelWithoutSource", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--enforce-label", "namespace",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"enforce-label-header", "enforce-label-tenants-file" must be set`)
+	})
+
+	t.Run("FailureEnforceLabelTenantsFileWithoutInboundAuth", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--enforce-label", "namespace",
+			"--enforce-label-tenants-file", "/etc/prometheus-proxy/tenants.yaml",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"inbound-auth" not set`)
+	})
+
+	t.Run("FailureEnforceLabelHeaderWithoutLabel", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--enforce-label-header", "X-Namespaces",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"enforce-label" not set`)
+	})
+
+	t.Run("SuccessWithBearerProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://victoriametrics:8428",
+			"--auth-provider", "bearer",
+			"--bearer-token-file", "/var/secrets/token",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, "/var/secrets/token", bearerTokenFile)
+		assert.IsType(t, &auth.BearerClient{}, newAuthClient())
+	})
+
+	t.Run("FailureBasicMissingPassword", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://prometheus:9090",
+			"--auth-provider", "basic",
+			"--basic-auth-username", "user",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"basic-auth-password" or "basic-auth-password-file"`)
+	})
+
+	t.Run("SuccessWithUpstreamTLS", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://thanos-query:10902",
+			"--auth-provider", "bearer",
+			"--bearer-token", "token",
+			"--upstream-tls-cert-file", "/tls/tls.crt",
+			"--upstream-tls-key-file", "/tls/tls.key",
+			"--upstream-tls-ca-file", "/tls/ca.crt",
+			"--upstream-tls-min-version", "TLS13",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		assert.Equal(t, tlsconfig.Config{
+			CertFile:   "/tls/tls.crt",
+			KeyFile:    "/tls/tls.key",
+			CAFile:     "/tls/ca.crt",
+			MinVersion: "TLS13",
+		}, upstreamTLS)
+	})
+
+	t.Run("FailureUpstreamTLSCertWithoutKey", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "https://thanos-query:10902",
+			"--auth-provider", "bearer",
+			"--bearer-token", "token",
+			"--upstream-tls-cert-file", "/tls/tls.crt",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "tls cert file and key file must be set together")
+	})
+
+	t.Run("SuccessWithAzureCertificate", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--azure-client-certificate-path", "/var/secrets/azure/cert.pem",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		client, ok := newAuthClient().(*auth.AzureClient)
+		assert.True(t, ok)
+		assert.Nil(t, client.ClientSecret)
+		assert.Equal(t, "/var/secrets/azure/cert.pem", client.ClientCertificatePath)
+	})
+
+	t.Run("FailureAzureSecretAndCertificate", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--azure-client-secret", "secret123",
+			"--azure-client-certificate-path", "/var/secrets/azure/cert.pem",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `only one of "azure-client-secret" or "azure-client-certificate-path"`)
+	})
+
+	t.Run("SuccessWithAzureIMDS", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-imds",
+			"--azure-cloud", "AzureUSGovernment",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		client, ok := newAuthClient().(*auth.AzureClient)
+		assert.True(t, ok)
+		assert.True(t, client.IMDS)
+		assert.Equal(t, "AzureUSGovernment", client.Cloud)
+		assert.Empty(t, client.TenantId)
+	})
+
+	t.Run("SuccessWithAzureCloudOverrides", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--azure-cloud", "AzureChina",
+			"--azure-authority-host", "https://login.example.com/",
+			"--azure-scope", "api://custom/.default",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.NoError(t, err)
+		client, ok := newAuthClient().(*auth.AzureClient)
+		assert.True(t, ok)
+		assert.Equal(t, "AzureChina", client.Cloud)
+		assert.Equal(t, "https://login.example.com/", client.AuthorityHost)
+		assert.Equal(t, "api://custom/.default", client.Scope)
+	})
+
+	t.Run("FailureInvalidAzureCloud", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-tenant-id", "tenant123",
+			"--azure-client-id", "client123",
+			"--azure-cloud", "AzureGermany",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid azure cloud "AzureGermany"`)
+	})
+
+	t.Run("FailureAzureIMDSWithSecret", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-imds",
+			"--azure-client-secret", "secret123",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"azure-imds" cannot be combined`)
+	})
+
+	t.Run("FailureAzureMissingTenant", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--azure-client-id", "client123",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `"azure-tenant-id"`)
+	})
+
+	t.Run("FailureInvalidAuthProvider", func(t *testing.T) {
+		resetCmd()
+		rootCmd.SetArgs([]string{
+			"--prometheus-url", "http://localhost:9090",
+			"--auth-provider", "invalid",
+		})
+
+		err := rootCmd.Execute()
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid auth provider "invalid"`)
+	})
 }
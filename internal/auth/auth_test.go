@@ -2,9 +2,21 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -213,6 +225,279 @@ func TestNewWorkloadIdentityCred_ErrorHandling(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// Creates a self-signed RSA certificate and key in a single PEM bundle, as
+// accepted by Azure App Registrations
+func newAzureCertificatePEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "prometheus-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...,
+	)
+}
+
+func TestAzureClientInitClient_Certificate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testutil.WriteFile(t, dir, "cert.pem", newAzureCertificatePEM(t))
+
+	client := &AzureClient{
+		TenantId:              "test-tenant",
+		ClientId:              "test-client",
+		ClientCertificatePath: path,
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	first := client.confidentialClient()
+	require.NotNil(t, first)
+	assert.Nil(t, client.workloadIdentityCred)
+
+	// Unchanged certificates do not re-create the client
+	require.NoError(t, client.reloadCertificate())
+	assert.Same(t, first, client.confidentialClient())
+
+	// Rotated certificates re-create the client
+	testutil.WriteFile(t, dir, "cert.pem", newAzureCertificatePEM(t))
+	require.NoError(t, client.reloadCertificate())
+	second := client.confidentialClient()
+	assert.NotSame(t, first, second)
+
+	// Invalid certificates are rejected and the last known client is kept
+	testutil.WriteFile(t, dir, "cert.pem", []byte("invalid"))
+	assert.Error(t, client.reloadCertificate())
+	assert.Same(t, second, client.confidentialClient())
+}
+
+func TestAzureClientInitClient_InvalidCertificate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+	}{
+		{
+			name: "missing file",
+			path: func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing.pem") },
+		},
+		{
+			name: "invalid certificate",
+			path: func(t *testing.T) string { return testutil.WriteFile(t, t.TempDir(), "cert.pem", []byte("invalid")) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			client := &AzureClient{
+				TenantId:              "test-tenant",
+				ClientId:              "test-client",
+				ClientCertificatePath: tt.path(t),
+			}
+			assert.Error(t, client.InitClient(testutil.CreateTestLogger(t)))
+		})
+	}
+}
+
+func TestAzureClientApplyCloudDefaults(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name              string
+		client            *AzureClient
+		expectedAuthority string
+		expectedScope     string
+		expectedErr       bool
+	}{
+		{
+			name:              "public cloud by default",
+			client:            &AzureClient{},
+			expectedAuthority: "https://login.microsoftonline.com/",
+			expectedScope:     "https://prometheus.monitor.azure.com/.default",
+		},
+		{
+			name:              "us government cloud",
+			client:            &AzureClient{Cloud: "AzureUSGovernment"},
+			expectedAuthority: "https://login.microsoftonline.us/",
+			expectedScope:     "https://prometheus.monitor.azure.us/.default",
+		},
+		{
+			name:              "china cloud",
+			client:            &AzureClient{Cloud: "AzureChina"},
+			expectedAuthority: "https://login.chinacloudapi.cn/",
+			expectedScope:     "https://prometheus.monitor.azure.cn/.default",
+		},
+		{
+			name:              "overrides take precedence",
+			client:            &AzureClient{Cloud: "AzureChina", AuthorityHost: "https://login.example.com", Scope: "api://custom/.default"},
+			expectedAuthority: "https://login.example.com/",
+			expectedScope:     "api://custom/.default",
+		},
+		{
+			name:        "unknown cloud",
+			client:      &AzureClient{Cloud: "AzureGermany"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.client.applyCloudDefaults()
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedAuthority, tt.client.AuthorityHost)
+			assert.Equal(t, []string{tt.expectedScope}, tt.client.scopes())
+		})
+	}
+}
+
+func TestAzureClient_IMDS(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "2018-02-01", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "https://prometheus.monitor.azure.us", r.URL.Query().Get("resource"))
+		assert.Equal(t, "user-assigned-id", r.URL.Query().Get("client_id"))
+
+		// IMDS returns expires_in as a string
+		w.Write([]byte(`{"access_token":"imds-token","expires_in":"3599","token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	client := &AzureClient{
+		ClientId:     "user-assigned-id",
+		Cloud:        "AzureUSGovernment",
+		IMDS:         true,
+		IMDSEndpoint: server.URL,
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	for range 2 {
+		headers, err := client.GetHeaders(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer imds-token"}}, headers)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestAzureClient_IMDSError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := &AzureClient{IMDS: true, IMDSEndpoint: server.URL}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := client.AcquireToken(context.Background())
+	assert.ErrorContains(t, err, "instance metadata service returned status 400")
+}
+
+func TestAzureClient_IMDSExpiry(t *testing.T) {
+	t.Parallel()
+	issued := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		body     string
+		expected time.Time
+		err      string
+	}{
+		{name: "expires_in", body: `{"expires_in":"3599"}`, expected: issued.Add(3599 * time.Second)},
+		{name: "expires_on", body: `{"expires_in":"","expires_on":"1700003600"}`, expected: time.Unix(1700003600, 0)},
+		{name: "malformed expires_in", body: `{"expires_in":"1.5"}`, err: `invalid token expiry, expires_in "1.5"`},
+		{name: "string expires_in", body: `{"expires_in":"soon"}`, err: `invalid token expiry, expires_in "soon"`},
+		{name: "number expires_in", body: `{"expires_in":3600}`, expected: issued.Add(time.Hour)},
+		{name: "missing expiry", body: `{}`, err: "invalid token expiry"},
+		{name: "expired", body: `{"expires_in":"0","expires_on":"1600000000"}`, err: "invalid token expiry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var token imdsTokenResponse
+			require.NoError(t, json.Unmarshal([]byte(tt.body), &token))
+			expires, err := token.expiry(issued)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, expires)
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"imds-token","expires_in":""}`))
+	}))
+	defer server.Close()
+
+	client := &AzureClient{IMDS: true, IMDSEndpoint: server.URL}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := client.AcquireToken(context.Background())
+	assert.ErrorContains(t, err, "invalid token expiry")
+}
+
+func TestAzureClient_CustomAuthority(t *testing.T) {
+	t.Parallel()
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/test-tenant/v2.0/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"authorization_endpoint": server.URL + "/test-tenant/oauth2/v2.0/authorize",
+				"token_endpoint":         server.URL + "/test-tenant/oauth2/v2.0/token",
+				"issuer":                 server.URL + "/test-tenant/v2.0",
+			})
+		case "/test-tenant/oauth2/v2.0/token":
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			assert.Contains(t, r.PostForm.Get("scope"), "https://prometheus.monitor.azure.cn/.default")
+			assert.Equal(t, "test-secret", r.PostForm.Get("client_secret"))
+			w.Write([]byte(`{"access_token":"authority-token","token_type":"Bearer","expires_in":3600}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	secret := "test-secret"
+	client := &AzureClient{
+		TenantId:      "test-tenant",
+		ClientId:      "test-client",
+		ClientSecret:  &secret,
+		Cloud:         "AzureChina",
+		AuthorityHost: server.URL,
+		httpClient:    server.Client(),
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "authority-token", token)
+}
+
 // Test that GetHeaders returns proper format when token is available
 func TestClientHeader_Format(t *testing.T) {
 	t.Parallel()
@@ -0,0 +1,463 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errAwsClientNotInitialised = errors.New("aws client not initialized")
+	errAwsNoCredentials        = errors.New("no aws credentials found in environment, web identity token file or shared credentials file")
+	errAwsUnsetRegion          = errors.New("aws region is unset")
+	errAwsTokenUnsupported     = errors.New("aws client signs requests and does not issue bearer tokens")
+
+	awsDefaultService       = "aps"
+	awsDefaultProfile       = "default"
+	awsSigningAlgorithm     = "AWS4-HMAC-SHA256"
+	awsTimeFormat           = "20060102T150405Z"
+	awsDateFormat           = "20060102"
+	awsCredentialsRefreshIn = 5 * time.Minute
+)
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Zero for static credentials which never expire
+	Expires time.Time
+}
+
+type AWSClient struct {
+	Region               string
+	Service              string
+	Profile              string
+	CredentialsFile      string
+	RoleArn              string
+	RoleSessionName      string
+	WebIdentityTokenFile string
+	// Overrides the regional STS endpoint used for web identity federation
+	STSEndpoint string
+	Logger      *logger.Logger
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+	webIdentity bool
+	httpClient  *http.Client
+}
+
+// Initialises the AWS client, resolving credentials from the environment,
+// a web identity token file (IRSA) or the shared credentials file, in that order
+func (ac *AWSClient) InitClient(logger *logger.Logger) error {
+	ac.Logger = logger
+	ac.applyEnvDefaults()
+	logger.Info("using aws client for authentication", "region", ac.Region, "service", ac.Service)
+
+	if ac.Region == "" {
+		return errAwsUnsetRegion
+	}
+
+	if creds := awsCredentialsFromEnv(); creds != nil {
+		logger.Debug("using aws credentials from environment")
+		ac.credentials = creds
+		return nil
+	}
+
+	if ac.WebIdentityTokenFile != "" && ac.RoleArn != "" {
+		logger.Debug("using aws web identity credentials", "role_arn", ac.RoleArn, "token_file", ac.WebIdentityTokenFile)
+		ac.webIdentity = true
+		if ac.httpClient == nil {
+			ac.httpClient = &http.Client{Timeout: 30 * time.Second}
+		}
+		return nil
+	}
+
+	creds, err := awsCredentialsFromFile(ac.CredentialsFile, ac.Profile)
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		return errAwsNoCredentials
+	}
+	logger.Debug("using aws credentials from shared credentials file", "path", ac.CredentialsFile, "profile", ac.Profile)
+	ac.credentials = creds
+
+	return nil
+}
+
+// SigV4 does not use bearer tokens, requests are signed via SignRequest instead
+func (ac *AWSClient) AcquireToken(_ context.Context) (string, error) {
+	return "", errAwsTokenUnsupported
+}
+
+// Returns no static headers, all authentication happens in SignRequest
+func (ac *AWSClient) GetHeaders(_ context.Context) ([]ClientHeader, error) {
+	return nil, nil
+}
+
+// Signs the outgoing request with AWS SigV4
+func (ac *AWSClient) SignRequest(req *http.Request) error {
+	creds, err := ac.resolveCredentials(req.Context())
+	if err != nil {
+		return err
+	}
+	return signRequestV4(req, creds, ac.Region, ac.Service, time.Now().UTC())
+}
+
+// Populates unset fields from the standard AWS environment variables
+func (ac *AWSClient) applyEnvDefaults() {
+	if ac.Service == "" {
+		ac.Service = awsDefaultService
+	}
+	if ac.Region == "" {
+		ac.Region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	}
+	if ac.Profile == "" {
+		ac.Profile = firstEnv("AWS_PROFILE")
+	}
+	if ac.Profile == "" {
+		ac.Profile = awsDefaultProfile
+	}
+	if ac.CredentialsFile == "" {
+		ac.CredentialsFile = firstEnv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if ac.CredentialsFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			ac.CredentialsFile = filepath.Join(home, ".aws", "credentials")
+		}
+	}
+	if ac.RoleArn == "" {
+		ac.RoleArn = firstEnv("AWS_ROLE_ARN")
+	}
+	if ac.RoleSessionName == "" {
+		ac.RoleSessionName = firstEnv("AWS_ROLE_SESSION_NAME")
+	}
+	if ac.RoleSessionName == "" {
+		ac.RoleSessionName = "prometheus-proxy"
+	}
+	if ac.WebIdentityTokenFile == "" {
+		ac.WebIdentityTokenFile = firstEnv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if ac.STSEndpoint == "" {
+		ac.STSEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", ac.Region)
+	}
+}
+
+// Returns the current credentials, refreshing web identity credentials
+// shortly before they expire
+func (ac *AWSClient) resolveCredentials(ctx context.Context) (*awsCredentials, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if !ac.webIdentity {
+		if ac.credentials == nil {
+			return nil, errAwsClientNotInitialised
+		}
+		return ac.credentials, nil
+	}
+
+	if ac.credentials != nil && time.Until(ac.credentials.Expires) > awsCredentialsRefreshIn {
+		return ac.credentials, nil
+	}
+
+	creds, err := assumeRoleWithWebIdentity(ctx, ac)
+	if err != nil {
+		ac.Logger.Error("failed to assume aws role with web identity", "role_arn", ac.RoleArn, "error", err)
+		return nil, err
+	}
+	ac.Logger.Debug("acquired aws web identity credentials", "role_arn", ac.RoleArn, "expires", creds.Expires)
+	ac.credentials = creds
+
+	return creds, nil
+}
+
+// Returns the first non-empty value of the provided environment variables
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Reads static credentials from the standard AWS environment variables
+func awsCredentialsFromEnv() *awsCredentials {
+	id := firstEnv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY")
+	secret := firstEnv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY")
+	if id == "" || secret == "" {
+		return nil
+	}
+	return &awsCredentials{
+		AccessKeyId:     id,
+		SecretAccessKey: secret,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Reads static credentials for a profile from an INI style shared credentials
+// file. Returns nil credentials if the file or profile does not exist
+func awsCredentialsFromFile(path, profile string) (*awsCredentials, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		section string
+		creds   awsCredentials
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyId = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyId     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// Exchanges the projected service account token for temporary credentials via STS
+func assumeRoleWithWebIdentity(ctx context.Context, client *AWSClient) (*awsCredentials, error) {
+	token, err := os.ReadFile(client.WebIdentityTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token file: %w", err)
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {client.RoleArn},
+		"RoleSessionName":  {client.RoleSessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.STSEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sts returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result assumeRoleWithWebIdentityResponse
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode sts response: %w", err)
+	}
+	if result.Credentials.AccessKeyId == "" {
+		return nil, errAwsNoCredentials
+	}
+
+	return &awsCredentials{
+		AccessKeyId:     result.Credentials.AccessKeyId,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// Signs the request in place with AWS Signature Version 4, reading the
+// body through GetBody so the request can still be sent afterwards
+func signRequestV4(req *http.Request, creds *awsCredentials, region, service string, now time.Time) error {
+	payloadHash, err := hashRequestBody(req)
+	if err != nil {
+		return err
+	}
+
+	amzDate := now.Format(awsTimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// Only sign headers which will not be rewritten in transit
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			headers[lk] = strings.Join(v, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.Join(strings.Fields(headers[k]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(path, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(awsDateFormat), region, service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(awsDateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, creds.AccessKeyId, scope, signedHeaders, signature))
+
+	return nil
+}
+
+// Returns the hex encoded SHA256 hash of the request body
+func hashRequestBody(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return "", errors.New("request body cannot be re-read for signing")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Builds the canonical query string, sorted by key then value
+func awsCanonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(values))
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// URI encodes a string per RFC 3986 as required by SigV4. Slashes are kept
+// when encoding paths
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
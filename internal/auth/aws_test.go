@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Credentials and expected signatures are taken from the AWS SigV4 test suite
+var awsTestCredentials = &awsCredentials{
+	AccessKeyId:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignRequestV4(t *testing.T) {
+	t.Parallel()
+	signTime := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		body        string
+		contentType string
+		expected    string
+	}{
+		{
+			name:     "get vanilla",
+			method:   http.MethodGet,
+			url:      "https://example.amazonaws.com/",
+			expected: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:        "post form body",
+			method:      http.MethodPost,
+			url:         "https://example.amazonaws.com/",
+			body:        "Param1=value1",
+			contentType: "application/x-www-form-urlencoded",
+			expected:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			err = signRequestV4(req, awsTestCredentials, "us-east-1", "service", signTime)
+			require.NoError(t, err)
+
+			assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+			assert.Equal(t, tt.expected, req.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestSignRequestV4_SessionToken(t *testing.T) {
+	t.Parallel()
+	req, err := http.NewRequest(http.MethodGet, "https://aps-workspaces.eu-west-1.amazonaws.com/workspaces/ws-1/api/v1/query?query=up", nil)
+	require.NoError(t, err)
+
+	creds := *awsTestCredentials
+	creds.SessionToken = "session-token"
+	err = signRequestV4(req, &creds, "eu-west-1", "aps", time.Now().UTC())
+	require.NoError(t, err)
+
+	assert.Equal(t, "session-token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token")
+	assert.Contains(t, req.Header.Get("Authorization"), "/eu-west-1/aps/aws4_request")
+}
+
+func TestAwsCanonicalQuery(t *testing.T) {
+	t.Parallel()
+	values := map[string][]string{
+		"query":   {"sum(rate(x[5m]))"},
+		"match[]": {"up", "a b"},
+		"end":     {"2"},
+	}
+
+	assert.Equal(t, "end=2&match%5B%5D=a%20b&match%5B%5D=up&query=sum%28rate%28x%5B5m%5D%29%29", awsCanonicalQuery(values))
+}
+
+func TestAwsCredentialsFromFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "credentials")
+	content := `[default]
+aws_access_key_id = default-id
+aws_secret_access_key = default-secret
+
+# comment
+[other]
+aws_access_key_id=other-id
+aws_secret_access_key=other-secret
+aws_session_token=other-token
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	tests := []struct {
+		name     string
+		path     string
+		profile  string
+		expected *awsCredentials
+	}{
+		{
+			name:     "default profile",
+			path:     path,
+			profile:  "default",
+			expected: &awsCredentials{AccessKeyId: "default-id", SecretAccessKey: "default-secret"},
+		},
+		{
+			name:     "named profile with session token",
+			path:     path,
+			profile:  "other",
+			expected: &awsCredentials{AccessKeyId: "other-id", SecretAccessKey: "other-secret", SessionToken: "other-token"},
+		},
+		{
+			name:     "missing profile",
+			path:     path,
+			profile:  "missing",
+			expected: nil,
+		},
+		{
+			name:     "missing file",
+			path:     filepath.Join(t.TempDir(), "missing"),
+			profile:  "default",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			creds, err := awsCredentialsFromFile(tt.path, tt.profile)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, creds)
+		})
+	}
+}
+
+func TestAWSClient_WebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("web-identity-token\n"), 0o600))
+
+	calls := 0
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRoleWithWebIdentity", r.PostForm.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/proxy", r.PostForm.Get("RoleArn"))
+		assert.Equal(t, "web-identity-token", r.PostForm.Get("WebIdentityToken"))
+
+		expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>` + expiration + `</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+
+	// Ensure no ambient credentials take precedence
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ACCESS_KEY", "")
+
+	client := &AWSClient{
+		Region:               "eu-west-1",
+		RoleArn:              "arn:aws:iam::123456789012:role/proxy",
+		WebIdentityTokenFile: tokenFile,
+		STSEndpoint:          sts.URL,
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, "https://aps-workspaces.eu-west-1.amazonaws.com/api/v1/query?query=up", nil)
+		require.NoError(t, err)
+		require.NoError(t, client.SignRequest(req))
+		assert.Contains(t, req.Header.Get("Authorization"), "Credential=ASIAEXAMPLE/")
+		assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	}
+
+	// Credentials are cached until shortly before they expire
+	assert.Equal(t, 1, calls)
+}
+
+func TestAWSClient_EnvCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	client := &AWSClient{Region: "us-east-1"}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	assert.Equal(t, "aps", client.Service)
+	req, err := http.NewRequest(http.MethodPost, "https://aps-workspaces.us-east-1.amazonaws.com/api/v1/query", strings.NewReader("query=up"))
+	require.NoError(t, err)
+	require.NoError(t, client.SignRequest(req))
+	assert.Contains(t, req.Header.Get("Authorization"), "Credential=env-id/")
+
+	headers, err := client.GetHeaders(req.Context())
+	assert.NoError(t, err)
+	assert.Empty(t, headers)
+
+	_, err = client.AcquireToken(req.Context())
+	assert.Equal(t, errAwsTokenUnsupported, err)
+}
+
+func TestAWSClient_InitClient_MissingRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	client := &AWSClient{}
+	err := client.InitClient(testutil.CreateTestLogger(t))
+	assert.Equal(t, errAwsUnsetRegion, err)
+}
+
+func TestAWSClient_SignRequest_NotInitialized(t *testing.T) {
+	t.Parallel()
+	client := &AWSClient{}
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, errAwsClientNotInitialised, client.SignRequest(req))
+}
+
+func TestAWSClientImplementsInterfaces(t *testing.T) {
+	t.Parallel()
+	var client Client = &AWSClient{}
+	_, ok := client.(RequestSigner)
+	assert.True(t, ok)
+}
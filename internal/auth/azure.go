@@ -2,11 +2,22 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
@@ -19,21 +30,56 @@ var (
 	azureScopes                    = []string{"https://prometheus.monitor.azure.com/.default"}
 	azureTenantPrefix              = "https://login.microsoftonline.com/"
 	azureWorkloadIdentityTokenPath = "/var/run/secrets/azure/tokens/azure-identity-token"
+	azureIMDSEndpoint              = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureIMDSApiVersion            = "2018-02-01"
+
+	// Authority hosts and Managed Prometheus scopes of the supported Azure clouds
+	AzureClouds = map[string]AzureCloud{
+		"AzurePublic":       {AuthorityHost: azureTenantPrefix, Scope: azureScopes[0]},
+		"AzureUSGovernment": {AuthorityHost: "https://login.microsoftonline.us/", Scope: "https://prometheus.monitor.azure.us/.default"},
+		"AzureChina":        {AuthorityHost: "https://login.chinacloudapi.cn/", Scope: "https://prometheus.monitor.azure.cn/.default"},
+	}
 )
 
+type AzureCloud struct {
+	AuthorityHost string
+	Scope         string
+}
+
 type AzureClient struct {
-	TenantId             string
-	ClientId             string
-	ClientSecret         *string
-	Logger               *logger.Logger
-	confClient           *confidential.Client
-	workloadIdentityCred *azidentity.WorkloadIdentityCredential
+	TenantId     string
+	ClientId     string
+	ClientSecret *string
+	// PEM or PFX certificate used instead of a client secret, reloaded when it changes
+	ClientCertificatePath     string
+	ClientCertificatePassword string
+	// One of AzureClouds, AzurePublic by default. AuthorityHost and Scope
+	// override the values of the selected cloud
+	Cloud         string
+	AuthorityHost string
+	Scope         string
+	// Use the VM/VMSS managed identity from the Instance Metadata Service
+	// instead of workload identity. ClientId selects a user-assigned identity
+	IMDS                      bool
+	IMDSEndpoint              string
+	WorkloadIdentityTokenFile string
+	Logger                    *logger.Logger
+	confClient                *confidential.Client
+	workloadIdentityCred      *azidentity.WorkloadIdentityCredential
+
+	mu         sync.Mutex
+	certFile   *filewatch.File
+	imdsToken  cachedToken
+	httpClient *http.Client
 }
 
 // Initiliases the Azure client using the provided credentials
 func (ac *AzureClient) InitClient(logger *logger.Logger) error {
-	logger.Info("using azure client for authentication", "client_id", ac.ClientId, "tenant_id", ac.TenantId)
 	ac.Logger = logger
+	if err := ac.applyCloudDefaults(); err != nil {
+		return err
+	}
+	logger.Info("using azure client for authentication", "client_id", ac.ClientId, "tenant_id", ac.TenantId, "authority_host", ac.AuthorityHost, "scope", ac.Scope)
 
 	// Use App Registration auth if client secret is provided
 	if ac.ClientSecret != nil {
@@ -45,6 +91,24 @@ func (ac *AzureClient) InitClient(logger *logger.Logger) error {
 		return nil
 	}
 
+	// Use App Registration auth if a client certificate is provided
+	if ac.ClientCertificatePath != "" {
+		ac.certFile = filewatch.New(ac.ClientCertificatePath)
+		return ac.reloadCertificate()
+	}
+
+	// Use the VM/VMSS Managed Identity from IMDS
+	if ac.IMDS {
+		if ac.IMDSEndpoint == "" {
+			ac.IMDSEndpoint = azureIMDSEndpoint
+		}
+		if ac.httpClient == nil {
+			ac.httpClient = &http.Client{Timeout: 30 * time.Second}
+		}
+		logger.Debug("using azure instance metadata service managed identity", "imds_endpoint", ac.IMDSEndpoint)
+		return nil
+	}
+
 	// Use Managed (workload) Identity auth
 	workloadIdentityCred, err := newWorkloadIdentityCred(ac)
 	if err != nil {
@@ -57,7 +121,19 @@ func (ac *AzureClient) InitClient(logger *logger.Logger) error {
 
 // Authenticates with Azure and returns an access token
 func (ac *AzureClient) AcquireToken(ctx context.Context) (string, error) {
-	if ac.confClient != nil {
+	token, _, err := ac.AcquireTokenWithExpiry(ctx)
+	return token, err
+}
+
+// Authenticates with Azure and returns an access token alongside its expiry
+func (ac *AzureClient) AcquireTokenWithExpiry(ctx context.Context) (string, time.Time, error) {
+	if ac.certFile != nil {
+		if err := ac.reloadCertificate(); err != nil {
+			ac.Logger.Warn("failed to reload azure client certificate, using last known certificate", "path", ac.ClientCertificatePath, "error", err)
+		}
+	}
+
+	if ac.confidentialClient() != nil {
 		return getConfidentialClientToken(ac, ctx)
 	}
 
@@ -65,7 +141,11 @@ func (ac *AzureClient) AcquireToken(ctx context.Context) (string, error) {
 		return getWorkloadIdentityToken(ac, ctx)
 	}
 
-	return "", errClientNotInitialised
+	if ac.IMDS && ac.httpClient != nil {
+		return getIMDSToken(ac, ctx)
+	}
+
+	return "", time.Time{}, errClientNotInitialised
 }
 
 // Returns the headers required for authenticating requests to Azure Managed Prometheus
@@ -74,10 +154,113 @@ func (ac *AzureClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ac.TokenHeaders(token), nil
+}
+
+// Returns the bearer authorization header for the token
+func (ac *AzureClient) TokenHeaders(token string) []ClientHeader {
+	return bearerHeaders(token)
+}
+
+// Resolves the authority host and scope from the selected cloud, unless
+// explicitly overridden
+func (ac *AzureClient) applyCloudDefaults() error {
+	if ac.Cloud == "" {
+		ac.Cloud = "AzurePublic"
+	}
+	c, ok := AzureClouds[ac.Cloud]
+	if !ok {
+		return fmt.Errorf("unknown azure cloud %q", ac.Cloud)
+	}
+
+	if ac.AuthorityHost == "" {
+		ac.AuthorityHost = c.AuthorityHost
+	}
+	if !strings.HasSuffix(ac.AuthorityHost, "/") {
+		ac.AuthorityHost += "/"
+	}
+	if ac.Scope == "" {
+		ac.Scope = c.Scope
+	}
+	if ac.WorkloadIdentityTokenFile == "" {
+		ac.WorkloadIdentityTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	}
+	if ac.WorkloadIdentityTokenFile == "" {
+		ac.WorkloadIdentityTokenFile = azureWorkloadIdentityTokenPath
+	}
+
+	return nil
+}
+
+// Returns the scopes to request tokens for
+func (ac *AzureClient) scopes() []string {
+	if ac.Scope == "" {
+		return azureScopes
+	}
+	return []string{ac.Scope}
+}
+
+// Returns the options for confidential clients. Instance discovery is only
+// possible against the well known Azure authority hosts
+func (ac *AzureClient) confidentialOptions() []confidential.Option {
+	var opts []confidential.Option
+	if ac.httpClient != nil {
+		opts = append(opts, confidential.WithHTTPClient(ac.httpClient))
+	}
+
+	known := false
+	for _, c := range AzureClouds {
+		known = known || c.AuthorityHost == ac.authorityHost()
+	}
+	if !known {
+		opts = append(opts, confidential.WithInstanceDiscovery(false))
+	}
+
+	return opts
+}
+
+// Returns the authority host, defaulting to the Azure public cloud
+func (ac *AzureClient) authorityHost() string {
+	if ac.AuthorityHost == "" {
+		return azureTenantPrefix
+	}
+	return ac.AuthorityHost
+}
+
+// Returns the authority URL for the tenant
+func (ac *AzureClient) authority() string {
+	return ac.authorityHost() + ac.TenantId
+}
+
+// Returns the current confidential client, which may be replaced when the
+// client certificate is rotated
+func (ac *AzureClient) confidentialClient() *confidential.Client {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.confClient
+}
+
+// Re-creates the confidential client if the client certificate file has changed
+func (ac *AzureClient) reloadCertificate() error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	data, changed, err := ac.certFile.Read()
+	if err != nil {
+		return err
+	}
+	if !changed && ac.confClient != nil {
+		return nil
+	}
+
+	confClient, err := newConfidentialCertClient(ac, data)
+	if err != nil {
+		return err
+	}
+	ac.Logger.Info("loaded azure client certificate", "path", ac.ClientCertificatePath)
+	ac.confClient = confClient
 
-	return []ClientHeader{
-		{Key: "Authorization", Value: fmt.Sprintf("Bearer %s", token)},
-	}, nil
+	return nil
 }
 
 // Validates the Azure Client ID is set and not empty
@@ -97,8 +280,32 @@ func newConfidentialClient(client *AzureClient) (*confidential.Client, error) {
 		return nil, err
 	}
 
-	tenant := azureTenantPrefix + client.TenantId
-	confClient, err := confidential.New(tenant, client.ClientId, cred)
+	confClient, err := confidential.New(client.authority(), client.ClientId, cred, client.confidentialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &confClient, nil
+}
+
+// Creates a new confidential client for Azure authentication using a PEM or
+// PFX encoded client certificate
+func newConfidentialCertClient(client *AzureClient, certData []byte) (*confidential.Client, error) {
+	client.Logger.Debug("creating new confidential certificate client", "client_id", client.ClientId, "tenant_id", client.TenantId)
+	certs, key, err := azidentity.ParseCertificates(certData, []byte(client.ClientCertificatePassword))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse azure client certificate: %w", err)
+	}
+
+	cred, err := confidential.NewCredFromCert(certs, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sending the x5c chain allows subject name/issuer authentication, so
+	// certificates can be rotated without updating the App Registration
+	opts := append(client.confidentialOptions(), confidential.WithX5C())
+	confClient, err := confidential.New(client.authority(), client.ClientId, cred, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -115,10 +322,18 @@ func newWorkloadIdentityCred(client *AzureClient) (*azidentity.WorkloadIdentityC
 		return nil, errUnsetClientId
 	}
 
+	tokenFile := client.WorkloadIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = azureWorkloadIdentityTokenPath
+	}
+
 	cred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+		ClientOptions: azcore.ClientOptions{
+			Cloud: cloud.Configuration{ActiveDirectoryAuthorityHost: client.authorityHost()},
+		},
 		ClientID:      client.ClientId,
 		TenantID:      client.TenantId,
-		TokenFilePath: azureWorkloadIdentityTokenPath,
+		TokenFilePath: tokenFile,
 	})
 	if err != nil {
 		return nil, err
@@ -128,55 +343,153 @@ func newWorkloadIdentityCred(client *AzureClient) (*azidentity.WorkloadIdentityC
 }
 
 // Uses an App Registration to source a token from Azure AD
-func getConfidentialClientToken(client *AzureClient, ctx context.Context) (string, error) {
+func getConfidentialClientToken(client *AzureClient, ctx context.Context) (string, time.Time, error) {
 	l := client.Logger.With(
 		"client_id", client.ClientId,
 		"tenant_id", client.TenantId,
 	)
 
 	l.Debug("acquiring azure token using app registration credentials")
-	result, err := client.confClient.AcquireTokenSilent(ctx, azureScopes)
-	if result.AccessToken != "" {
-		l.Debug("acquired azure token using cache/refresh")
+	confClient := client.confidentialClient()
+
+	// A forced refresh bypasses the MSAL token cache
+	var (
+		result confidential.AuthResult
+		err    error
+	)
+	if !isForceRefresh(ctx) {
+		result, err = confClient.AcquireTokenSilent(ctx, client.scopes())
+		if result.AccessToken != "" {
+			l.Debug("acquired azure token using cache/refresh")
+		}
+		if err != nil {
+			l.Warn("failed to acquire azure cache/refresh token, proceeding to acquire a new token", "error", err)
+		}
 	}
 
-	if err != nil {
-		l.Warn("failed to acquire azure cache/refresh token, proceeding to acquire a new token", "error", err)
-		result, err = client.confClient.AcquireTokenByCredential(ctx, azureScopes)
+	if isForceRefresh(ctx) || err != nil {
+		result, err = confClient.AcquireTokenByCredential(ctx, client.scopes())
 		if err != nil {
 			l.Error("failed to acquire azure token", "error", err)
-			return "", err
+			return "", time.Time{}, err
 		}
 	}
 
 	if result.AccessToken == "" {
 		l.Error("acquired empty azure token")
-		return "", errEmptyToken
+		return "", time.Time{}, errEmptyToken
 	}
 
-	l.Debug("acquired azure token successfully")
-	return result.AccessToken, nil
+	l.Debug("acquired azure token successfully", "expires", result.ExpiresOn)
+	return result.AccessToken, result.ExpiresOn, nil
 }
 
 // Uses a Managed Identity to source a token from Azure AD
-func getWorkloadIdentityToken(client *AzureClient, ctx context.Context) (string, error) {
+func getWorkloadIdentityToken(client *AzureClient, ctx context.Context) (string, time.Time, error) {
 	l := client.Logger.With(
 		"client_id", client.ClientId,
 		"tenant_id", client.TenantId,
 	)
 
 	l.Debug("acquiring azure token using workload identity credentials")
-	token, err := client.workloadIdentityCred.GetToken(ctx, policy.TokenRequestOptions{Scopes: azureScopes})
+	token, err := client.workloadIdentityCred.GetToken(ctx, policy.TokenRequestOptions{Scopes: client.scopes()})
 	if err != nil {
 		l.Error("failed to acquire azure token", "error", err)
-		return "", err
+		return "", time.Time{}, err
 	}
 
 	if token.Token == "" {
 		l.Error("acquired empty azure token")
-		return "", errEmptyToken
+		return "", time.Time{}, errEmptyToken
+	}
+
+	l.Debug("acquired azure token successfully", "expires", token.ExpiresOn)
+	return token.Token, token.ExpiresOn, nil
+}
+
+type imdsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// Seconds, which IMDS returns as strings and other endpoints as numbers
+	ExpiresIn json.RawMessage `json:"expires_in"`
+	ExpiresOn json.RawMessage `json:"expires_on"`
+}
+
+// Returns when the token expires, from expires_in or else the unix time in
+// expires_on. Tokens without a valid expiry are rejected, as they would be
+// refreshed continuously
+func (t *imdsTokenResponse) expiry(issued time.Time) (time.Time, error) {
+	if expiresIn, err := parseSeconds(t.ExpiresIn); err == nil && expiresIn > 0 {
+		return issued.Add(time.Duration(expiresIn) * time.Second), nil
+	}
+	if expiresOn, err := parseSeconds(t.ExpiresOn); err == nil && expiresOn > issued.Unix() {
+		return time.Unix(expiresOn, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid token expiry, expires_in %s and expires_on %s", t.ExpiresIn, t.ExpiresOn)
+}
+
+// Parses a whole number of seconds from a JSON number or string
+func parseSeconds(raw json.RawMessage) (int64, error) {
+	return strconv.ParseInt(strings.Trim(string(raw), `"`), 10, 64)
+}
+
+// Uses the VM/VMSS Managed Identity to source a token from the Instance Metadata Service
+func getIMDSToken(client *AzureClient, ctx context.Context) (string, time.Time, error) {
+	if token, expires, ok := client.imdsToken.lookup(ctx); ok {
+		return token, expires, nil
+	}
+
+	l := client.Logger.With("client_id", client.ClientId)
+	l.Debug("acquiring azure token using instance metadata service")
+
+	u, err := url.Parse(client.IMDSEndpoint)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	q := u.Query()
+	q.Set("api-version", azureIMDSApiVersion)
+	q.Set("resource", strings.TrimSuffix(client.scopes()[0], "/.default"))
+	if validateClientId(client.ClientId) {
+		q.Set("client_id", client.ClientId)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	issued := time.Now()
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		l.Error("failed to acquire azure token", "error", err)
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("instance metadata service returned status %d", resp.StatusCode)
+		l.Error("failed to acquire azure token", "error", err)
+		return "", time.Time{}, err
+	}
+
+	var token imdsTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		l.Error("failed to decode azure token", "error", err)
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		l.Error("acquired empty azure token")
+		return "", time.Time{}, errEmptyToken
+	}
+
+	expires, err := token.expiry(issued)
+	if err != nil {
+		l.Error("failed to parse azure token expiry", "error", err)
+		return "", time.Time{}, err
 	}
+	client.imdsToken.set(token.AccessToken, expires)
 
-	l.Debug("acquired azure token successfully")
-	return token.Token, nil
+	l.Debug("acquired azure token successfully", "expires", expires)
+	return token.AccessToken, expires, nil
 }
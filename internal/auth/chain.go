@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errChainNoClients = errors.New("auth chain has no clients")
+	// Signing clients return no headers, so a fallback chain would always
+	// stop at them without knowing whether the request can be signed
+	errChainFallbackSigner = errors.New("clients which sign requests, such as aws, cannot be used in a fallback auth chain")
+
+	ChainModes = []string{ChainMerge, ChainFallback}
+)
+
+const (
+	// The headers of every client are sent
+	ChainMerge = "merge"
+	// The clients are tried in order until one succeeds
+	ChainFallback = "fallback"
+)
+
+// ChainClient combines several clients. In merge mode the headers of every
+// client are sent, with later clients overriding earlier headers of the same
+// name, e.g. an Azure bearer token plus a static X-Scope-OrgID tenant header.
+// In fallback mode the clients are tried in order until one succeeds
+type ChainClient struct {
+	Clients []Client
+	Mode    string
+	Logger  *logger.Logger
+}
+
+// Initialises every client in the chain. In fallback mode clients which fail
+// to initialise are skipped, as long as at least one succeeds
+func (cc *ChainClient) InitClient(logger *logger.Logger) error {
+	logger.Info("using auth chain for authentication", "mode", cc.Mode, "clients", len(cc.Clients))
+	cc.Logger = logger
+
+	if cc.Mode == "" {
+		cc.Mode = ChainMerge
+	}
+	if !slices.Contains(ChainModes, cc.Mode) {
+		return fmt.Errorf("invalid auth chain mode %q, allowed values are: %v", cc.Mode, ChainModes)
+	}
+	if len(cc.Clients) == 0 {
+		return errChainNoClients
+	}
+	if cc.Mode == ChainFallback && slices.ContainsFunc(cc.Clients, SignsRequests) {
+		return errChainFallbackSigner
+	}
+
+	var (
+		clients []Client
+		errs    []error
+	)
+	for i, client := range cc.Clients {
+		client = ManageTokens(client)
+		if err := client.InitClient(logger); err != nil {
+			err = fmt.Errorf("auth chain client %d: %w", i, err)
+			if cc.Mode == ChainMerge {
+				return err
+			}
+			logger.Warn("skipping auth chain client which failed to initialize", "index", i, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 0 {
+		return errors.Join(errs...)
+	}
+	cc.Clients = clients
+
+	return nil
+}
+
+// Returns the token of the first client in merge mode, or of the first client
+// to succeed in fallback mode
+func (cc *ChainClient) AcquireToken(ctx context.Context) (string, error) {
+	if cc.Mode == ChainMerge {
+		if len(cc.Clients) == 0 {
+			return "", errChainNoClients
+		}
+		return cc.Clients[0].AcquireToken(ctx)
+	}
+
+	var errs []error
+	for i, client := range cc.Clients {
+		token, err := client.AcquireToken(ctx)
+		if err == nil {
+			return token, nil
+		}
+		cc.Logger.Warn("auth chain client failed, trying next client", "index", i, "error", err)
+		errs = append(errs, fmt.Errorf("auth chain client %d: %w", i, err))
+	}
+	if len(errs) == 0 {
+		return "", errChainNoClients
+	}
+	return "", errors.Join(errs...)
+}
+
+// Returns the merged headers of every client in merge mode, or the headers of
+// the first client to succeed in fallback mode
+func (cc *ChainClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	if cc.Mode == ChainFallback {
+		return cc.fallbackHeaders(ctx)
+	}
+
+	var merged []ClientHeader
+	for i, client := range cc.Clients {
+		headers, err := client.GetHeaders(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("auth chain client %d: %w", i, err)
+		}
+		for _, header := range headers {
+			merged = slices.DeleteFunc(merged, func(h ClientHeader) bool {
+				return http.CanonicalHeaderKey(h.Key) == http.CanonicalHeaderKey(header.Key)
+			})
+			merged = append(merged, header)
+		}
+	}
+	return merged, nil
+}
+
+// Signs the request with every client which implements RequestSigner. Fallback
+// chains never contain signing clients
+func (cc *ChainClient) SignRequest(req *http.Request) error {
+	for _, client := range cc.Clients {
+		if signer, ok := client.(RequestSigner); ok {
+			if err := signer.SignRequest(req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether the client, or any client of a chain, signs requests
+func SignsRequests(client Client) bool {
+	if chain, ok := client.(*ChainClient); ok {
+		return slices.ContainsFunc(chain.Clients, SignsRequests)
+	}
+	_, ok := client.(RequestSigner)
+	return ok
+}
+
+// Returns the headers of the first client to succeed
+func (cc *ChainClient) fallbackHeaders(ctx context.Context) ([]ClientHeader, error) {
+	var errs []error
+	for i, client := range cc.Clients {
+		headers, err := client.GetHeaders(ctx)
+		if err == nil {
+			return headers, nil
+		}
+		cc.Logger.Warn("auth chain client failed, trying next client", "index", i, "error", err)
+		errs = append(errs, fmt.Errorf("auth chain client %d: %w", i, err))
+	}
+	if len(errs) == 0 {
+		return nil, errChainNoClients
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a fixed set of headers, or fails
+type fakeHeaderClient struct {
+	headers []ClientHeader
+	initErr error
+	err     error
+}
+
+func (f *fakeHeaderClient) InitClient(_ *logger.Logger) error { return f.initErr }
+
+func (f *fakeHeaderClient) AcquireToken(_ context.Context) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.headers[0].Value, nil
+}
+
+func (f *fakeHeaderClient) GetHeaders(_ context.Context) ([]ClientHeader, error) {
+	return f.headers, f.err
+}
+
+// Signs requests in addition to returning headers, like the AWS client
+type fakeSignerClient struct {
+	fakeHeaderClient
+	signed bool
+}
+
+func (f *fakeSignerClient) SignRequest(_ *http.Request) error {
+	f.signed = true
+	return nil
+}
+
+func TestChainClient_Merge(t *testing.T) {
+	t.Parallel()
+	chain := &ChainClient{
+		Clients: []Client{
+			&fakeHeaderClient{headers: []ClientHeader{
+				{Key: "Authorization", Value: "Bearer azure-token"},
+				{Key: "X-Scope-OrgID", Value: "default"},
+			}},
+			&HeadersClient{Headers: map[string]string{"x-scope-orgid": "tenant-1"}},
+		},
+	}
+	require.NoError(t, chain.InitClient(testutil.CreateTestLogger(t)))
+	assert.Equal(t, ChainMerge, chain.Mode)
+
+	headers, err := chain.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{
+		{Key: "Authorization", Value: "Bearer azure-token"},
+		{Key: "x-scope-orgid", Value: "tenant-1"},
+	}, headers)
+
+	token, err := chain.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer azure-token", token)
+}
+
+func TestChainClient_MergeFailure(t *testing.T) {
+	t.Parallel()
+	chain := &ChainClient{
+		Mode: ChainMerge,
+		Clients: []Client{
+			&HeadersClient{Headers: map[string]string{"X-Scope-OrgID": "tenant-1"}},
+			&fakeHeaderClient{err: errors.New("token endpoint unavailable")},
+		},
+	}
+	require.NoError(t, chain.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := chain.GetHeaders(context.Background())
+	assert.ErrorContains(t, err, "auth chain client 1: token endpoint unavailable")
+}
+
+func TestChainClient_Fallback(t *testing.T) {
+	t.Parallel()
+	primary := &fakeHeaderClient{err: errors.New("azure ad unavailable")}
+	secondary := &fakeHeaderClient{headers: []ClientHeader{{Key: "Authorization", Value: "Basic fallback"}}}
+	chain := &ChainClient{
+		Mode: ChainFallback,
+		Clients: []Client{
+			&fakeHeaderClient{initErr: errors.New("misconfigured")},
+			primary,
+			secondary,
+		},
+	}
+	require.NoError(t, chain.InitClient(testutil.CreateTestLogger(t)))
+	assert.Len(t, chain.Clients, 2)
+
+	headers, err := chain.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Basic fallback"}}, headers)
+
+	token, err := chain.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Basic fallback", token)
+
+	secondary.err = errors.New("idp unavailable")
+	_, err = chain.GetHeaders(context.Background())
+	assert.ErrorContains(t, err, "auth chain client 0: azure ad unavailable")
+	assert.ErrorContains(t, err, "auth chain client 1: idp unavailable")
+}
+
+func TestChainClient_SignRequest(t *testing.T) {
+	t.Parallel()
+	signer := &fakeSignerClient{fakeHeaderClient: fakeHeaderClient{headers: []ClientHeader{{Key: "X-Tenant", Value: "a"}}}}
+	chain := &ChainClient{Clients: []Client{signer}}
+	require.NoError(t, chain.InitClient(testutil.CreateTestLogger(t)))
+
+	req, err := http.NewRequest(http.MethodGet, "http://prometheus/api/v1/query", nil)
+	require.NoError(t, err)
+	require.NoError(t, chain.SignRequest(req))
+	assert.True(t, signer.signed)
+}
+
+func TestSignsRequests(t *testing.T) {
+	t.Parallel()
+	assert.True(t, SignsRequests(&AWSClient{}))
+	assert.True(t, SignsRequests(&ChainClient{Clients: []Client{&BearerClient{}, &ChainClient{Clients: []Client{&AWSClient{}}}}}))
+	assert.False(t, SignsRequests(&BearerClient{}))
+	assert.False(t, SignsRequests(&ChainClient{Clients: []Client{&BearerClient{}, &HeadersClient{}}}))
+}
+
+func TestChainClient_InitClient_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		chain    *ChainClient
+		expected string
+	}{
+		{
+			name:     "no clients",
+			chain:    &ChainClient{},
+			expected: errChainNoClients.Error(),
+		},
+		{
+			name:     "invalid mode",
+			chain:    &ChainClient{Mode: "round-robin", Clients: []Client{&fakeHeaderClient{}}},
+			expected: `invalid auth chain mode "round-robin"`,
+		},
+		{
+			name:     "merge client fails to initialize",
+			chain:    &ChainClient{Clients: []Client{&HeadersClient{}}},
+			expected: "auth chain client 0: " + errHeadersUnset.Error(),
+		},
+		{
+			name:     "fallback with signing client",
+			chain:    &ChainClient{Mode: ChainFallback, Clients: []Client{&fakeSignerClient{}, &BearerClient{Token: "token"}}},
+			expected: errChainFallbackSigner.Error(),
+		},
+		{
+			name:     "fallback with nested signing client",
+			chain:    &ChainClient{Mode: ChainFallback, Clients: []Client{&ChainClient{Clients: []Client{&AWSClient{}}}}},
+			expected: errChainFallbackSigner.Error(),
+		},
+		{
+			name:     "every fallback client fails to initialize",
+			chain:    &ChainClient{Mode: ChainFallback, Clients: []Client{&BearerClient{}, &HeadersClient{}}},
+			expected: "auth chain client 1: " + errHeadersUnset.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.chain.InitClient(testutil.CreateTestLogger(t))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestChainClient_ManagesExpiringTokens(t *testing.T) {
+	t.Parallel()
+	chain := &ChainClient{Clients: []Client{&fakeTokenSource{lifetime: 0}}}
+	require.NoError(t, chain.InitClient(testutil.CreateTestLogger(t)))
+
+	manager, ok := chain.Clients[0].(*TokenManager)
+	require.True(t, ok)
+	manager.Close()
+}
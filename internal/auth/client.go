@@ -3,6 +3,9 @@ package auth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
 )
@@ -19,3 +22,25 @@ type Client interface {
 	AcquireToken(ctx context.Context) (string, error)
 	GetHeaders(ctx context.Context) ([]ClientHeader, error)
 }
+
+// RequestSigner is implemented by clients which need to see the complete
+// outgoing request (method, URL and body) to authenticate it, e.g. AWS SigV4.
+// Signing happens after the headers from GetHeaders have been applied
+type RequestSigner interface {
+	SignRequest(req *http.Request) error
+}
+
+// ExpiringTokenSource is implemented by clients whose tokens expire, allowing
+// a TokenManager to refresh them ahead of time
+type ExpiringTokenSource interface {
+	AcquireTokenWithExpiry(ctx context.Context) (string, time.Time, error)
+	// Returns the headers authenticating a request with the token
+	TokenHeaders(token string) []ClientHeader
+}
+
+// Returns the bearer authorization header for the token
+func bearerHeaders(token string) []ClientHeader {
+	return []ClientHeader{
+		{Key: "Authorization", Value: fmt.Sprintf("Bearer %s", token)},
+	}
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// The providers a Config may select
+var Providers = []string{"azure", "aws", "gcp", "oauth2", "exec", "bearer", "basic"}
+
+// Config selects the authentication providers of an upstream and their
+// settings, from the command line flags or an upstreams file
+type Config struct {
+	// The providers to use, chained according to ChainMode if several
+	Providers     []string          `yaml:"providers"`
+	ChainMode     string            `yaml:"chain_mode"`
+	StaticHeaders map[string]string `yaml:"static_headers"`
+
+	Azure struct {
+		TenantId                  string  `yaml:"tenant_id"`
+		ClientId                  string  `yaml:"client_id"`
+		ClientSecret              *string `yaml:"client_secret"`
+		ClientCertificatePath     string  `yaml:"client_certificate_path"`
+		ClientCertificatePassword string  `yaml:"client_certificate_password"`
+		Cloud                     string  `yaml:"cloud"`
+		AuthorityHost             string  `yaml:"authority_host"`
+		Scope                     string  `yaml:"scope"`
+		IMDS                      bool    `yaml:"imds"`
+		IMDSEndpoint              string  `yaml:"imds_endpoint"`
+	} `yaml:"azure"`
+	AWS struct {
+		Region  string `yaml:"region"`
+		Profile string `yaml:"profile"`
+		RoleArn string `yaml:"role_arn"`
+	} `yaml:"aws"`
+	GCP struct {
+		CredentialsFile string `yaml:"credentials_file"`
+	} `yaml:"gcp"`
+	OAuth2 struct {
+		TokenURL         string            `yaml:"token_url"`
+		ClientId         string            `yaml:"client_id"`
+		ClientSecret     string            `yaml:"client_secret"`
+		ClientSecretFile string            `yaml:"client_secret_file"`
+		Scopes           []string          `yaml:"scopes"`
+		Audience         string            `yaml:"audience"`
+		EndpointParams   map[string]string `yaml:"endpoint_params"`
+	} `yaml:"oauth2"`
+	Exec struct {
+		Command string            `yaml:"command"`
+		Args    []string          `yaml:"args"`
+		Env     map[string]string `yaml:"env"`
+	} `yaml:"exec"`
+	Bearer struct {
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"bearer"`
+	Basic struct {
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"password_file"`
+	} `yaml:"basic"`
+}
+
+// Validates the chain mode and the settings required by every provider.
+// Errors name settings by their path in an upstreams file, e.g.
+// "azure.tenant_id", as returned by the setting function, so the command line
+// can name its flags instead
+func (c *Config) Validate(setting func(path string) string) error {
+	quoted := func(path string) string {
+		return fmt.Sprintf("%q", setting(path))
+	}
+
+	for _, provider := range c.Providers {
+		if err := c.validateProvider(provider, quoted); err != nil {
+			return err
+		}
+	}
+	if !slices.Contains(ChainModes, c.ChainMode) {
+		return fmt.Errorf("invalid auth chain mode %q, allowed values are: %v", c.ChainMode, ChainModes)
+	}
+	if c.ChainMode == ChainFallback && len(c.Providers) > 1 && slices.Contains(c.Providers, "aws") {
+		return fmt.Errorf(`auth provider "aws" signs requests and cannot be combined with %s %s`, quoted("chain_mode"), ChainFallback)
+	}
+	return nil
+}
+
+// Validates the settings required by a provider
+func (c *Config) validateProvider(provider string, quoted func(path string) string) error {
+	switch provider {
+	case "azure":
+		if _, ok := AzureClouds[c.Azure.Cloud]; c.Azure.Cloud != "" && !ok {
+			return fmt.Errorf("invalid azure cloud %q, allowed values are: %v", c.Azure.Cloud, slices.Sorted(maps.Keys(AzureClouds)))
+		}
+		if c.Azure.IMDS {
+			if c.Azure.ClientSecret != nil || c.Azure.ClientCertificatePath != "" {
+				return fmt.Errorf("%s cannot be combined with %s or %s", quoted("azure.imds"), quoted("azure.client_secret"), quoted("azure.client_certificate_path"))
+			}
+			return nil
+		}
+		if c.Azure.TenantId == "" || c.Azure.ClientId == "" {
+			return fmt.Errorf("%s and %s must be set for auth provider %q", quoted("azure.tenant_id"), quoted("azure.client_id"), provider)
+		}
+		if c.Azure.ClientSecret != nil && c.Azure.ClientCertificatePath != "" {
+			return fmt.Errorf("only one of %s or %s can be set", quoted("azure.client_secret"), quoted("azure.client_certificate_path"))
+		}
+	case "aws", "gcp":
+	case "oauth2":
+		if c.OAuth2.TokenURL == "" || c.OAuth2.ClientId == "" {
+			return fmt.Errorf("%s and %s must be set for auth provider %q", quoted("oauth2.token_url"), quoted("oauth2.client_id"), provider)
+		}
+		if c.OAuth2.ClientSecret == "" && c.OAuth2.ClientSecretFile == "" {
+			return fmt.Errorf("one of %s or %s must be set for auth provider %q", quoted("oauth2.client_secret"), quoted("oauth2.client_secret_file"), provider)
+		}
+	case "exec":
+		if c.Exec.Command == "" {
+			return fmt.Errorf("%s must be set for auth provider %q", quoted("exec.command"), provider)
+		}
+	case "bearer":
+		if c.Bearer.Token == "" && c.Bearer.TokenFile == "" {
+			return fmt.Errorf("one of %s or %s must be set for auth provider %q", quoted("bearer.token"), quoted("bearer.token_file"), provider)
+		}
+	case "basic":
+		if c.Basic.Username == "" {
+			return fmt.Errorf("%s must be set for auth provider %q", quoted("basic.username"), provider)
+		}
+		if c.Basic.Password == "" && c.Basic.PasswordFile == "" {
+			return fmt.Errorf("one of %s or %s must be set for auth provider %q", quoted("basic.password"), quoted("basic.password_file"), provider)
+		}
+	default:
+		return fmt.Errorf("invalid auth provider %q, allowed values are: %v", provider, Providers)
+	}
+	return nil
+}
+
+// Creates the authentication client of a validated config, chaining the
+// providers if several are selected or static headers are set
+func NewClient(c *Config) Client {
+	var clients []Client
+	for _, provider := range c.Providers {
+		clients = append(clients, c.providerClient(provider))
+	}
+
+	client := clients[0]
+	if len(clients) > 1 {
+		client = &ChainClient{Clients: clients, Mode: c.ChainMode}
+	}
+	if len(c.StaticHeaders) > 0 {
+		client = &ChainClient{
+			Clients: []Client{client, &HeadersClient{Headers: c.StaticHeaders}},
+			Mode:    ChainMerge,
+		}
+	}
+	return client
+}
+
+// Creates the authentication client of a provider
+func (c *Config) providerClient(provider string) Client {
+	switch provider {
+	case "aws":
+		return &AWSClient{
+			Region:  c.AWS.Region,
+			Profile: c.AWS.Profile,
+			RoleArn: c.AWS.RoleArn,
+		}
+	case "gcp":
+		return &GCPClient{
+			CredentialsFile: c.GCP.CredentialsFile,
+		}
+	case "oauth2":
+		return &OAuth2Client{
+			TokenURL:         c.OAuth2.TokenURL,
+			ClientId:         c.OAuth2.ClientId,
+			ClientSecret:     c.OAuth2.ClientSecret,
+			ClientSecretFile: c.OAuth2.ClientSecretFile,
+			Scopes:           c.OAuth2.Scopes,
+			Audience:         c.OAuth2.Audience,
+			EndpointParams:   c.OAuth2.EndpointParams,
+		}
+	case "exec":
+		return &ExecClient{
+			Command: c.Exec.Command,
+			Args:    c.Exec.Args,
+			Env:     c.Exec.Env,
+		}
+	case "bearer":
+		return &BearerClient{
+			Token:     c.Bearer.Token,
+			TokenFile: c.Bearer.TokenFile,
+		}
+	case "basic":
+		return &BasicAuthClient{
+			Username:     c.Basic.Username,
+			Password:     c.Basic.Password,
+			PasswordFile: c.Basic.PasswordFile,
+		}
+	default:
+		return &AzureClient{
+			TenantId:                  c.Azure.TenantId,
+			ClientId:                  c.Azure.ClientId,
+			ClientSecret:              c.Azure.ClientSecret,
+			ClientCertificatePath:     c.Azure.ClientCertificatePath,
+			ClientCertificatePassword: c.Azure.ClientCertificatePassword,
+			Cloud:                     c.Azure.Cloud,
+			AuthorityHost:             c.Azure.AuthorityHost,
+			Scope:                     c.Azure.Scope,
+			IMDS:                      c.Azure.IMDS,
+			IMDSEndpoint:              c.Azure.IMDSEndpoint,
+		}
+	}
+}
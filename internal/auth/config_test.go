@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	t.Parallel()
+	secret := "secret"
+	tests := []struct {
+		name     string
+		config   func(c *Config)
+		expected string
+	}{
+		{name: "azure client secret", config: func(c *Config) {
+			c.Azure.TenantId, c.Azure.ClientId, c.Azure.ClientSecret = "tenant", "client", &secret
+		}},
+		{name: "azure imds", config: func(c *Config) { c.Azure.IMDS = true }},
+		{name: "azure without client", expected: `"azure.tenant_id" and "azure.client_id" must be set for auth provider "azure"`},
+		{name: "azure invalid cloud", config: func(c *Config) { c.Azure.Cloud = "AzureGermany" }, expected: `invalid azure cloud "AzureGermany"`},
+		{name: "azure imds with secret", config: func(c *Config) { c.Azure.IMDS, c.Azure.ClientSecret = true, &secret }, expected: `"azure.imds" cannot be combined`},
+		{name: "bearer", config: func(c *Config) { c.Providers, c.Bearer.Token = []string{"bearer"}, "token" }},
+		{name: "bearer without token", config: func(c *Config) { c.Providers = []string{"bearer"} }, expected: `one of "bearer.token" or "bearer.token_file" must be set`},
+		{name: "basic without password", config: func(c *Config) { c.Providers, c.Basic.Username = []string{"basic"}, "user" }, expected: `one of "basic.password" or "basic.password_file" must be set`},
+		{name: "invalid provider", config: func(c *Config) { c.Providers = []string{"kerberos"} }, expected: `invalid auth provider "kerberos"`},
+		{name: "invalid chain mode", config: func(c *Config) { c.Providers, c.ChainMode = []string{"gcp"}, "any" }, expected: `invalid auth chain mode "any"`},
+		{name: "aws in fallback chain", config: func(c *Config) { c.Providers, c.ChainMode = []string{"gcp", "aws"}, ChainFallback }, expected: `auth provider "aws" signs requests and cannot be combined with "chain_mode" fallback`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			config := &Config{Providers: []string{"azure"}, ChainMode: ChainMerge}
+			if tt.config != nil {
+				tt.config(config)
+			}
+
+			err := config.Validate(func(path string) string { return path })
+			if tt.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expected)
+			}
+		})
+	}
+
+	// Settings are named by the function, e.g. after command line flags
+	config := &Config{Providers: []string{"exec"}, ChainMode: ChainMerge}
+	err := config.Validate(func(path string) string { return strings.ReplaceAll(path, ".", "-") })
+	assert.ErrorContains(t, err, `"exec-command" must be set`)
+}
+
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+	config := &Config{Providers: []string{"bearer"}, ChainMode: ChainMerge}
+	config.Bearer.Token = "token"
+	assert.Equal(t, &BearerClient{Token: "token"}, NewClient(config))
+
+	config.Providers = []string{"bearer", "gcp"}
+	config.ChainMode = ChainFallback
+	chain, ok := NewClient(config).(*ChainClient)
+	require.True(t, ok)
+	assert.Equal(t, ChainFallback, chain.Mode)
+	require.Len(t, chain.Clients, 2)
+	assert.IsType(t, &GCPClient{}, chain.Clients[1])
+
+	config.StaticHeaders = map[string]string{"X-Scope-OrgID": "tenant"}
+	chain, ok = NewClient(config).(*ChainClient)
+	require.True(t, ok)
+	assert.Equal(t, ChainMerge, chain.Mode)
+	assert.Equal(t, &HeadersClient{Headers: config.StaticHeaders}, chain.Clients[1])
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	errExecClientNotInitialised = errors.New("exec client not initialized")
+	errExecUnsetCommand         = errors.New("exec command is unset")
+	errExecEmptyOutput          = errors.New("exec command returned neither a token nor headers")
+
+	execDefaultTimeout = 30 * time.Second
+	// Limits how much of the command's stderr is included in errors
+	execMaxStderr = 1024
+)
+
+// The credential printed to stdout by the command. Both the kubectl
+// ExecCredential format, where the fields are nested under status, and a
+// flat object are accepted
+type execCredential struct {
+	execCredentialStatus
+	Status *execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	// Sent as a bearer token
+	Token string `json:"token"`
+	// Additional headers sent with every request
+	Headers map[string]string `json:"headers"`
+	// RFC 3339 expiry, the credential is reused indefinitely if unset
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp"`
+}
+
+// ExecClient sources credentials by running an external command, in the style
+// of kubectl exec credential plugins. The credential is cached until it expires
+type ExecClient struct {
+	Command string
+	Args    []string
+	// Additional environment variables passed to the command
+	Env     map[string]string
+	Timeout time.Duration
+	Logger  *logger.Logger
+
+	group      singleflight.Group
+	mu         sync.Mutex
+	credential *execCredentialStatus
+}
+
+// Validates the client configuration
+func (ec *ExecClient) InitClient(logger *logger.Logger) error {
+	logger.Info("using exec credential plugin for authentication", "command", ec.Command)
+	ec.Logger = logger
+
+	if ec.Command == "" {
+		return errExecUnsetCommand
+	}
+	if ec.Timeout <= 0 {
+		ec.Timeout = execDefaultTimeout
+	}
+
+	return nil
+}
+
+// Returns the bearer token from the cached credential, running the command if
+// it has expired
+func (ec *ExecClient) AcquireToken(ctx context.Context) (string, error) {
+	cred, err := ec.getCredential(ctx)
+	if err != nil {
+		return "", err
+	}
+	if cred.Token == "" {
+		return "", errEmptyToken
+	}
+	return cred.Token, nil
+}
+
+// Returns the bearer authorization header, if a token was returned, followed
+// by any additional headers sorted by name
+func (ec *ExecClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	cred, err := ec.getCredential(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []ClientHeader
+	if cred.Token != "" {
+		headers = append(headers, bearerHeaders(cred.Token)...)
+	}
+	for _, key := range slices.Sorted(maps.Keys(cred.Headers)) {
+		headers = append(headers, ClientHeader{Key: key, Value: cred.Headers[key]})
+	}
+	return headers, nil
+}
+
+// Returns the cached credential, or runs the command to source a new one.
+// Concurrent callers share a single invocation, which runs for at most the
+// timeout and is not cancelled if an individual caller gives up
+func (ec *ExecClient) getCredential(ctx context.Context) (*execCredentialStatus, error) {
+	if ec.Logger == nil {
+		return nil, errExecClientNotInitialised
+	}
+	if cred, ok := ec.cached(ctx); ok {
+		return cred, nil
+	}
+
+	ch := ec.group.DoChan("credential", func() (any, error) {
+		l := ec.Logger.With("command", ec.Command)
+		l.Debug("running exec credential command")
+
+		cred, err := runExecCommand(ec, context.WithoutCancel(ctx))
+		if err != nil {
+			l.Error("failed to acquire exec credential", "error", err)
+			return nil, err
+		}
+
+		ec.mu.Lock()
+		ec.credential = cred
+		ec.mu.Unlock()
+
+		l.Debug("acquired exec credential successfully", "expires", cred.ExpirationTimestamp)
+		return cred, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*execCredentialStatus), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the cached credential unless it is about to expire or a refresh is
+// forced
+func (ec *ExecClient) cached(ctx context.Context) (*execCredentialStatus, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.credential == nil || isForceRefresh(ctx) {
+		return nil, false
+	}
+	if ec.credential.ExpirationTimestamp != nil && !time.Now().Add(tokenExpiryMargin).Before(*ec.credential.ExpirationTimestamp) {
+		return nil, false
+	}
+	return ec.credential, true
+}
+
+// Runs the command and parses the credential it prints to stdout
+func runExecCommand(client *ExecClient, ctx context.Context) (*execCredentialStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, client.Command, client.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range client.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > execMaxStderr {
+			msg = msg[:execMaxStderr]
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("exec command failed: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("exec command failed: %w", err)
+	}
+
+	var out execCredential
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("failed to decode exec credential: %w", err)
+	}
+
+	cred := &out.execCredentialStatus
+	if out.Status != nil {
+		cred = out.Status
+	}
+	if cred.Token == "" && len(cred.Headers) == 0 {
+		return nil, errExecEmptyOutput
+	}
+
+	return cred, nil
+}
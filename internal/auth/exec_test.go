@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes an executable shell script which appends to a counter file each time
+// it runs, returning the script and counter paths
+func writeExecScript(t *testing.T, body string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "credential.sh")
+	content := "#!/bin/sh\necho x >> " + counter + "\n" + body + "\n"
+	require.NoError(t, os.WriteFile(script, []byte(content), 0o700))
+	return script, counter
+}
+
+// Returns how many times the script has run
+func execCalls(t *testing.T, counter string) int {
+	t.Helper()
+	data, err := os.ReadFile(counter)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+	return len(data) / 2
+}
+
+func TestExecClient_ExecCredential(t *testing.T) {
+	t.Parallel()
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	script, counter := writeExecScript(t, `cat <<EOF
+{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"exec-token","expirationTimestamp":"`+expiry+`"}}
+EOF`)
+
+	client := &ExecClient{Command: script}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	for range 3 {
+		headers, err := client.GetHeaders(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer exec-token"}}, headers)
+	}
+	assert.Equal(t, 1, execCalls(t, counter))
+}
+
+func TestExecClient_HeadersArgsAndEnv(t *testing.T) {
+	t.Parallel()
+	script, _ := writeExecScript(t, `printf '{"token":"%s","headers":{"X-Scope-OrgID":"%s","X-Broker":"vault"}}' "$1" "$TENANT"`)
+
+	client := &ExecClient{
+		Command: script,
+		Args:    []string{"arg-token"},
+		Env:     map[string]string{"TENANT": "team-a"},
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	headers, err := client.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{
+		{Key: "Authorization", Value: "Bearer arg-token"},
+		{Key: "X-Broker", Value: "vault"},
+		{Key: "X-Scope-OrgID", Value: "team-a"},
+	}, headers)
+}
+
+func TestExecClient_ExpiredCredentialRerunsCommand(t *testing.T) {
+	t.Parallel()
+	// Credentials expiring within the refresh margin are never reused
+	expiry := time.Now().Add(tokenExpiryMargin / 2).UTC().Format(time.RFC3339)
+	script, counter := writeExecScript(t, `echo '{"token":"short-lived","expirationTimestamp":"`+expiry+`"}'`)
+
+	client := &ExecClient{Command: script}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	for range 2 {
+		token, err := client.AcquireToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "short-lived", token)
+	}
+	assert.Equal(t, 2, execCalls(t, counter))
+}
+
+func TestExecClient_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "command fails",
+			body:     `echo "broker unavailable" >&2; exit 1`,
+			expected: "exec command failed: exit status 1: broker unavailable",
+		},
+		{
+			name:     "invalid json",
+			body:     `echo "not json"`,
+			expected: "failed to decode exec credential",
+		},
+		{
+			name:     "empty credential",
+			body:     `echo '{"status":{}}'`,
+			expected: errExecEmptyOutput.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			script, _ := writeExecScript(t, tt.body)
+			client := &ExecClient{Command: script}
+			require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+			_, err := client.GetHeaders(context.Background())
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestExecClient_Timeout(t *testing.T) {
+	t.Parallel()
+	script, _ := writeExecScript(t, `exec sleep 5`)
+
+	client := &ExecClient{Command: script, Timeout: 100 * time.Millisecond}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := client.AcquireToken(context.Background())
+	assert.ErrorContains(t, err, "exec command failed")
+}
+
+func TestExecClient_SharedInvocation(t *testing.T) {
+	t.Parallel()
+	script, counter := writeExecScript(t, `sleep 0.5
+echo '{"token":"exec-token"}'`)
+
+	client := &ExecClient{Command: script}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	// A caller giving up does not abort the invocation the others wait on
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cancelled := make(chan error)
+	go func() {
+		_, err := client.AcquireToken(ctx)
+		cancelled <- err
+	}()
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			token, err := client.AcquireToken(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "exec-token", token)
+		})
+	}
+	assert.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+	wg.Wait()
+	assert.Equal(t, 1, execCalls(t, counter))
+}
+
+func TestExecClient_InitClient_Validation(t *testing.T) {
+	t.Parallel()
+	err := (&ExecClient{}).InitClient(testutil.CreateTestLogger(t))
+	assert.Equal(t, errExecUnsetCommand, err)
+
+	_, err = (&ExecClient{}).AcquireToken(context.Background())
+	assert.Equal(t, errExecClientNotInitialised, err)
+}
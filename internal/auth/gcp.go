@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errGcpClientNotInitialised = errors.New("gcp client not initialized")
+	errGcpInvalidKeyType       = errors.New("gcp credentials file is not a service account key")
+	errGcpInvalidPrivateKey    = errors.New("gcp service account private key is not a valid RSA key")
+
+	gcpScopes          = []string{"https://www.googleapis.com/auth/monitoring.read"}
+	gcpTokenURL        = "https://oauth2.googleapis.com/token"
+	gcpMetadataURL     = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpJwtBearerGrant  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	gcpAssertionExpiry = time.Hour
+	// Used when Google does not return expires_in
+	gcpDefaultTokenLifetime = 5 * time.Minute
+)
+
+type gcpServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type GCPClient struct {
+	// Path to a service account JSON key, if unset the GOOGLE_APPLICATION_CREDENTIALS
+	// environment variable is used, falling back to the metadata server
+	CredentialsFile string
+	Scopes          []string
+	// Overrides the token endpoint used to exchange the signed JWT
+	TokenURL string
+	// Overrides the metadata server token endpoint
+	MetadataURL string
+	Logger      *logger.Logger
+
+	key        *gcpServiceAccountKey
+	privateKey *rsa.PrivateKey
+	metadata   bool
+	httpClient *http.Client
+	token      cachedToken
+}
+
+// Initialises the GCP client using a service account key if one is available,
+// otherwise the GCE/GKE metadata server
+func (gc *GCPClient) InitClient(logger *logger.Logger) error {
+	gc.Logger = logger
+	if len(gc.Scopes) == 0 {
+		gc.Scopes = gcpScopes
+	}
+	if gc.CredentialsFile == "" {
+		gc.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if gc.httpClient == nil {
+		gc.httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	if gc.CredentialsFile == "" {
+		logger.Info("using gcp metadata server for authentication")
+		if gc.MetadataURL == "" {
+			gc.MetadataURL = gcpMetadataURL
+		}
+		gc.metadata = true
+		return nil
+	}
+
+	key, privateKey, err := loadGcpServiceAccountKey(gc.CredentialsFile)
+	if err != nil {
+		return err
+	}
+	logger.Info("using gcp service account key for authentication", "client_email", key.ClientEmail)
+	gc.key = key
+	gc.privateKey = privateKey
+	if gc.TokenURL == "" {
+		gc.TokenURL = key.TokenURI
+	}
+	if gc.TokenURL == "" {
+		gc.TokenURL = gcpTokenURL
+	}
+
+	return nil
+}
+
+// Returns a cached access token, or sources a new one from Google
+func (gc *GCPClient) AcquireToken(ctx context.Context) (string, error) {
+	token, _, err := gc.AcquireTokenWithExpiry(ctx)
+	return token, err
+}
+
+// Returns a cached access token and its expiry, or sources a new one from Google
+func (gc *GCPClient) AcquireTokenWithExpiry(ctx context.Context) (string, time.Time, error) {
+	if gc.key == nil && !gc.metadata {
+		return "", time.Time{}, errGcpClientNotInitialised
+	}
+
+	if token, expires, ok := gc.token.lookup(ctx); ok {
+		return token, expires, nil
+	}
+
+	var (
+		token *tokenResponse
+		err   error
+	)
+	issued := time.Now()
+	if gc.metadata {
+		gc.Logger.Debug("acquiring gcp token from metadata server")
+		token, err = getGcpMetadataToken(gc, ctx)
+	} else {
+		gc.Logger.Debug("acquiring gcp token using service account key", "client_email", gc.key.ClientEmail)
+		token, err = getGcpServiceAccountToken(gc, ctx, issued)
+	}
+	if err != nil {
+		gc.Logger.Error("failed to acquire gcp token", "error", err)
+		return "", time.Time{}, err
+	}
+
+	expires := token.expiry(issued)
+	if token.ExpiresIn <= 0 {
+		expires = issued.Add(gcpDefaultTokenLifetime)
+	}
+	gc.token.set(token.AccessToken, expires)
+	gc.Logger.Debug("acquired gcp token successfully")
+	return token.AccessToken, expires, nil
+}
+
+// Returns the headers required for authenticating requests to Google Managed Prometheus
+func (gc *GCPClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	token, err := gc.AcquireToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gc.TokenHeaders(token), nil
+}
+
+// Returns the bearer authorization header for the token
+func (gc *GCPClient) TokenHeaders(token string) []ClientHeader {
+	return bearerHeaders(token)
+}
+
+// Reads and parses a service account JSON key file
+func loadGcpServiceAccountKey(path string) (*gcpServiceAccountKey, *rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode gcp credentials file: %w", err)
+	}
+	if key.Type != "service_account" {
+		return nil, nil, errGcpInvalidKeyType
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, nil, errGcpInvalidPrivateKey
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, errGcpInvalidPrivateKey
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errGcpInvalidPrivateKey
+	}
+
+	return &key, privateKey, nil
+}
+
+// Creates an RS256 signed JWT assertion for the service account
+func newGcpAssertion(client *GCPClient, issued time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": client.key.PrivateKeyId,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   client.key.ClientEmail,
+		"scope": strings.Join(client.Scopes, " "),
+		"aud":   client.TokenURL,
+		"iat":   issued.Unix(),
+		"exp":   issued.Add(gcpAssertionExpiry).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, client.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + enc.EncodeToString(signature), nil
+}
+
+// Exchanges a signed JWT assertion for an access token
+func getGcpServiceAccountToken(client *GCPClient, ctx context.Context, issued time.Time) (*tokenResponse, error) {
+	assertion, err := newGcpAssertion(client, issued)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {gcpJwtBearerGrant},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doTokenRequest(client.httpClient, req)
+}
+
+// Sources an access token for the attached service account from the metadata server
+func getGcpMetadataToken(client *GCPClient, ctx context.Context) (*tokenResponse, error) {
+	u, err := url.Parse(client.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("scopes", strings.Join(client.Scopes, ","))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	return doTokenRequest(client.httpClient, req)
+}
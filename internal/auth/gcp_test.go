@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes a service account key file using a freshly generated RSA key
+func writeGcpKeyFile(t *testing.T, tokenURI string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	key, err := json.Marshal(gcpServiceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "proxy@project.iam.gserviceaccount.com",
+		PrivateKeyId: "key-id",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenURI,
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(path, key, 0o600))
+	return path, privateKey
+}
+
+func TestGCPClient_ServiceAccountKey(t *testing.T) {
+	t.Parallel()
+
+	var (
+		calls     int
+		publicKey *rsa.PublicKey
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, gcpJwtBearerGrant, r.PostForm.Get("grant_type"))
+
+		// Verify the assertion is signed by the service account key
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature))
+
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		assert.Contains(t, string(claims), `"iss":"proxy@project.iam.gserviceaccount.com"`)
+		assert.Contains(t, string(claims), `"scope":"https://www.googleapis.com/auth/monitoring.read"`)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"gcp-token","token_type":"Bearer","expires_in":3599}`))
+	}))
+	defer server.Close()
+
+	path, privateKey := writeGcpKeyFile(t, server.URL)
+	publicKey = &privateKey.PublicKey
+
+	client := &GCPClient{CredentialsFile: path}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+	assert.Equal(t, server.URL, client.TokenURL)
+
+	for range 2 {
+		headers, err := client.GetHeaders(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer gcp-token"}}, headers)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestGCPClient_TokenURLOverride(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"override-token","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	path, _ := writeGcpKeyFile(t, "https://oauth2.googleapis.com/token")
+	client := &GCPClient{CredentialsFile: path, TokenURL: server.URL}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "override-token", token)
+}
+
+func TestGCPClient_MetadataServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, "https://www.googleapis.com/auth/monitoring.read", r.URL.Query().Get("scopes"))
+		w.Write([]byte(`{"access_token":"metadata-token","token_type":"Bearer","expires_in":3599}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	client := &GCPClient{MetadataURL: server.URL}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "metadata-token", token)
+}
+
+func TestGCPClient_MetadataServerWithoutExpiry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"access_token":"metadata-token","token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	client := &GCPClient{MetadataURL: server.URL}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, expires, err := client.AcquireTokenWithExpiry(context.Background())
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(gcpDefaultTokenLifetime), expires, 5*time.Second)
+
+	// The token is reused rather than sourced again for every request
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "metadata-token", token)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestGCPClient_TokenEndpointError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	path, _ := writeGcpKeyFile(t, server.URL)
+	client := &GCPClient{CredentialsFile: path}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := client.AcquireToken(context.Background())
+	assert.ErrorContains(t, err, "token endpoint returned status 400")
+}
+
+func TestLoadGcpServiceAccountKey_Invalid(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		content  string
+		expected error
+	}{
+		{
+			name:     "not a service account",
+			content:  `{"type":"authorized_user"}`,
+			expected: errGcpInvalidKeyType,
+		},
+		{
+			name:     "invalid private key",
+			content:  `{"type":"service_account","private_key":"not-a-key"}`,
+			expected: errGcpInvalidPrivateKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "key.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			_, _, err := loadGcpServiceAccountKey(path)
+			assert.Equal(t, tt.expected, err)
+		})
+	}
+}
+
+func TestGCPClientAcquireToken_NotInitialized(t *testing.T) {
+	t.Parallel()
+	client := &GCPClient{}
+
+	token, err := client.AcquireToken(context.Background())
+	assert.Empty(t, token)
+	assert.Equal(t, errGcpClientNotInitialised, err)
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	errTokenManagerUnsupported = errors.New("client does not expose token expiry")
+
+	// Defaults used when the TokenManager fields are unset
+	tokenManagerRefreshBefore  = 5 * time.Minute
+	tokenManagerRetryInterval  = 10 * time.Second
+	tokenManagerRequestTimeout = 30 * time.Second
+	// Background refreshes are never scheduled closer together than this
+	tokenManagerMinInterval = time.Second
+)
+
+// TokenManager wraps a client whose tokens expire, serving the cached token on
+// the request path and refreshing it in the background before it expires.
+// Concurrent refreshes are collapsed into a single request, and the last good
+// token keeps being served during identity provider outages until it expires
+type TokenManager struct {
+	Client Client
+	// How long before expiry the token is refreshed in the background
+	RefreshBefore time.Duration
+	// How long to wait before retrying a failed background refresh
+	RetryInterval time.Duration
+	Logger        *logger.Logger
+
+	source  ExpiringTokenSource
+	group   singleflight.Group
+	mu      sync.RWMutex
+	token   string
+	expires time.Time
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+// Creates a token manager wrapping the provided client
+func NewTokenManager(client Client) *TokenManager {
+	return &TokenManager{Client: client}
+}
+
+// Wraps clients whose tokens expire in a TokenManager, so they are refreshed
+// in the background. Other clients are returned unchanged
+func ManageTokens(client Client) Client {
+	if _, ok := client.(ExpiringTokenSource); ok {
+		return NewTokenManager(client)
+	}
+	return client
+}
+
+// Initialises the wrapped client, prefetches the first token and starts the
+// background refresh loop
+func (tm *TokenManager) InitClient(logger *logger.Logger) error {
+	tm.Logger = logger
+	if tm.RefreshBefore <= 0 {
+		tm.RefreshBefore = tokenManagerRefreshBefore
+	}
+	if tm.RetryInterval <= 0 {
+		tm.RetryInterval = tokenManagerRetryInterval
+	}
+
+	source, ok := tm.Client.(ExpiringTokenSource)
+	if !ok {
+		return fmt.Errorf("%w: %T", errTokenManagerUnsupported, tm.Client)
+	}
+	tm.source = source
+
+	if err := tm.Client.InitClient(logger); err != nil {
+		return err
+	}
+
+	// A failed prefetch is retried by the background loop, and on the first request
+	if _, err := tm.refresh(context.Background()); err != nil {
+		logger.Warn("failed to prefetch token", "error", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	tm.stop = stop
+	tm.done = make(chan struct{})
+	go tm.run(ctx)
+
+	return nil
+}
+
+// Stops the background refresh loop
+func (tm *TokenManager) Close() {
+	if tm.stop == nil {
+		return
+	}
+	tm.stop()
+	<-tm.done
+}
+
+// Returns the cached token while it is valid, otherwise refreshes it
+func (tm *TokenManager) AcquireToken(ctx context.Context) (string, error) {
+	if token, ok := tm.current(); ok {
+		return token, nil
+	}
+	return tm.refresh(ctx)
+}
+
+// Returns the headers of the wrapped client for the cached token
+func (tm *TokenManager) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	token, err := tm.AcquireToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tm.source.TokenHeaders(token), nil
+}
+
+// Returns the cached token if it has not yet expired
+func (tm *TokenManager) current() (string, bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	if tm.token == "" || !time.Now().Before(tm.expires) {
+		return "", false
+	}
+	return tm.token, true
+}
+
+// Sources a new token from the wrapped client. Concurrent callers share a
+// single request, which is not cancelled if an individual caller gives up
+func (tm *TokenManager) refresh(ctx context.Context) (string, error) {
+	ch := tm.group.DoChan("token", func() (any, error) {
+		ctx, cancel := context.WithTimeout(withForceRefresh(context.WithoutCancel(ctx)), tokenManagerRequestTimeout)
+		defer cancel()
+
+		token, expires, err := tm.source.AcquireTokenWithExpiry(ctx)
+		if err != nil {
+			return "", err
+		}
+		if token == "" {
+			return "", errEmptyToken
+		}
+
+		tm.mu.Lock()
+		tm.token = token
+		tm.expires = expires
+		tm.mu.Unlock()
+
+		tm.Logger.Debug("refreshed token", "expires", expires)
+		return token, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Returns how long to wait before the next background refresh. Tokens are
+// refreshed RefreshBefore their expiry, or halfway through their remaining
+// lifetime if that is later
+func (tm *TokenManager) nextRefresh() time.Duration {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	if tm.token == "" {
+		return tm.RetryInterval
+	}
+	remaining := time.Until(tm.expires)
+	return max(remaining-tm.RefreshBefore, remaining/2, tokenManagerMinInterval)
+}
+
+// Refreshes the token in the background until stopped
+func (tm *TokenManager) run(ctx context.Context) {
+	defer close(tm.done)
+
+	wait := tm.nextRefresh()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := tm.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, ok := tm.current(); ok {
+				tm.Logger.Warn("failed to refresh token in background, serving last good token", "error", err)
+			} else {
+				tm.Logger.Error("failed to refresh token in background, no valid token available", "error", err)
+			}
+			// An expired token would otherwise be retried every second
+			wait = tm.RetryInterval
+			continue
+		}
+		wait = tm.nextRefresh()
+	}
+}
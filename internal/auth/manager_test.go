@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Issues numbered tokens with a fixed lifetime, optionally failing or blocking
+type fakeTokenSource struct {
+	lifetime time.Duration
+	block    chan struct{}
+	// The header carrying the token, Authorization with a bearer token if unset
+	header string
+
+	calls   atomic.Int32
+	failing atomic.Bool
+	forced  atomic.Bool
+}
+
+func (f *fakeTokenSource) InitClient(_ *logger.Logger) error { return nil }
+
+func (f *fakeTokenSource) AcquireToken(ctx context.Context) (string, error) {
+	token, _, err := f.AcquireTokenWithExpiry(ctx)
+	return token, err
+}
+
+func (f *fakeTokenSource) GetHeaders(_ context.Context) ([]ClientHeader, error) { return nil, nil }
+
+func (f *fakeTokenSource) TokenHeaders(token string) []ClientHeader {
+	if f.header == "" {
+		return bearerHeaders(token)
+	}
+	return []ClientHeader{{Key: f.header, Value: token}}
+}
+
+func (f *fakeTokenSource) AcquireTokenWithExpiry(ctx context.Context) (string, time.Time, error) {
+	n := f.calls.Add(1)
+	f.forced.Store(isForceRefresh(ctx))
+	if f.block != nil {
+		<-f.block
+	}
+	if f.failing.Load() {
+		return "", time.Time{}, errors.New("identity provider unavailable")
+	}
+	return fmt.Sprintf("token-%d", n), time.Now().Add(f.lifetime), nil
+}
+
+func TestTokenManager_PrefetchAndCache(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{lifetime: time.Hour}
+	tm := NewTokenManager(source)
+	require.NoError(t, tm.InitClient(testutil.CreateTestLogger(t)))
+	t.Cleanup(tm.Close)
+
+	assert.Equal(t, int32(1), source.calls.Load())
+	assert.True(t, source.forced.Load())
+
+	for range 3 {
+		headers, err := tm.GetHeaders(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer token-1"}}, headers)
+	}
+	assert.Equal(t, int32(1), source.calls.Load())
+}
+
+func TestTokenManager_ClientHeaders(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{lifetime: time.Hour, header: "X-Api-Key"}
+	tm := NewTokenManager(source)
+	require.NoError(t, tm.InitClient(testutil.CreateTestLogger(t)))
+	t.Cleanup(tm.Close)
+
+	headers, err := tm.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{{Key: "X-Api-Key", Value: "token-1"}}, headers)
+}
+
+func TestTokenManager_ConcurrentRefreshCollapsed(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{lifetime: time.Hour, block: make(chan struct{})}
+	tm := &TokenManager{source: source, Logger: testutil.CreateTestLogger(t)}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Go(func() {
+			token, err := tm.AcquireToken(context.Background())
+			assert.NoError(t, err)
+			tokens[i] = token
+		})
+	}
+
+	assert.Eventually(t, func() bool { return source.calls.Load() == 1 }, time.Second, 10*time.Millisecond)
+	close(source.block)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), source.calls.Load())
+	for _, token := range tokens {
+		assert.Equal(t, "token-1", token)
+	}
+}
+
+func TestTokenManager_CallerCancellation(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{lifetime: time.Hour, block: make(chan struct{})}
+	tm := &TokenManager{source: source, Logger: testutil.CreateTestLogger(t)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := tm.AcquireToken(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The shared refresh still completes for other callers
+	close(source.block)
+	token, err := tm.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+}
+
+func TestTokenManager_ServesLastGoodTokenDuringOutage(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{}
+	source.failing.Store(true)
+	tm := &TokenManager{
+		source:  source,
+		Logger:  testutil.CreateTestLogger(t),
+		token:   "last-good",
+		expires: time.Now().Add(time.Hour),
+	}
+
+	_, err := tm.refresh(context.Background())
+	assert.Error(t, err)
+
+	token, err := tm.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "last-good", token)
+
+	// Once the token has actually expired the outage is surfaced
+	tm.expires = time.Now().Add(-time.Second)
+	_, err = tm.AcquireToken(context.Background())
+	assert.ErrorContains(t, err, "identity provider unavailable")
+}
+
+func TestTokenManager_BackgroundRefresh(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{lifetime: 2 * time.Second}
+	tm := NewTokenManager(source)
+	tm.RefreshBefore = 1900 * time.Millisecond
+	require.NoError(t, tm.InitClient(testutil.CreateTestLogger(t)))
+	t.Cleanup(tm.Close)
+
+	token, err := tm.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	assert.Eventually(t, func() bool {
+		token, err := tm.AcquireToken(context.Background())
+		return err == nil && token == "token-2"
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestTokenManager_RetriesFailedRefreshAfterInterval(t *testing.T) {
+	t.Parallel()
+	source := &fakeTokenSource{}
+	source.failing.Store(true)
+	tm := &TokenManager{
+		source:        source,
+		Logger:        testutil.CreateTestLogger(t),
+		RetryInterval: time.Hour,
+		token:         "expired",
+		expires:       time.Now().Add(-time.Minute),
+		done:          make(chan struct{}),
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	tm.stop = stop
+	go tm.run(ctx)
+	t.Cleanup(tm.Close)
+
+	assert.Eventually(t, func() bool { return source.calls.Load() == 1 }, 2*time.Second, 50*time.Millisecond)
+	assert.Never(t, func() bool { return source.calls.Load() > 1 }, 2500*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestTokenManager_NextRefresh(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		token    string
+		expires  time.Duration
+		expected time.Duration
+	}{
+		{name: "no token", expected: time.Minute},
+		{name: "long lived token", token: "t", expires: time.Hour, expected: 55 * time.Minute},
+		{name: "short lived token", token: "t", expires: 4 * time.Minute, expected: 2 * time.Minute},
+		{name: "expired token", token: "t", expires: -time.Minute, expected: tokenManagerMinInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tm := &TokenManager{
+				RefreshBefore: 5 * time.Minute,
+				RetryInterval: time.Minute,
+				token:         tt.token,
+				expires:       time.Now().Add(tt.expires),
+			}
+			assert.InDelta(t, tt.expected, tm.nextRefresh(), float64(time.Second))
+		})
+	}
+}
+
+func TestTokenManager_UnsupportedClient(t *testing.T) {
+	t.Parallel()
+	tm := NewTokenManager(&BearerClient{Token: "static"})
+
+	err := tm.InitClient(testutil.CreateTestLogger(t))
+	assert.ErrorIs(t, err, errTokenManagerUnsupported)
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errOAuth2ClientNotInitialised = errors.New("oauth2 client not initialized")
+	errOAuth2UnsetTokenURL        = errors.New("oauth2 token url is unset")
+	errOAuth2UnsetClientId        = errors.New("oauth2 client id is unset")
+	errOAuth2UnsetClientSecret    = errors.New("oauth2 client secret or client secret file must be set")
+
+	// Used when the token endpoint does not return expires_in
+	oauth2DefaultTokenLifetime = 5 * time.Minute
+)
+
+// OAuth2Client implements the OAuth2 client credentials grant against any
+// RFC 6749 compliant token endpoint, e.g. Keycloak, Okta or Grafana Cloud
+type OAuth2Client struct {
+	TokenURL     string
+	ClientId     string
+	ClientSecret string
+	// Read on every token request so the secret can be rotated on disk
+	ClientSecretFile string
+	Scopes           []string
+	Audience         string
+	// Additional form parameters sent to the token endpoint
+	EndpointParams map[string]string
+	Logger         *logger.Logger
+
+	httpClient *http.Client
+	token      cachedToken
+}
+
+// Validates the client configuration
+func (oc *OAuth2Client) InitClient(logger *logger.Logger) error {
+	logger.Info("using oauth2 client credentials for authentication", "token_url", oc.TokenURL, "client_id", oc.ClientId)
+	oc.Logger = logger
+
+	if oc.TokenURL == "" {
+		return errOAuth2UnsetTokenURL
+	}
+	if oc.ClientId == "" {
+		return errOAuth2UnsetClientId
+	}
+	if oc.ClientSecret == "" && oc.ClientSecretFile == "" {
+		return errOAuth2UnsetClientSecret
+	}
+	if oc.httpClient == nil {
+		oc.httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return nil
+}
+
+// Returns a cached access token, or requests a new one from the token endpoint
+func (oc *OAuth2Client) AcquireToken(ctx context.Context) (string, error) {
+	token, _, err := oc.AcquireTokenWithExpiry(ctx)
+	return token, err
+}
+
+// Returns a cached access token and its expiry, or requests a new one from the token endpoint
+func (oc *OAuth2Client) AcquireTokenWithExpiry(ctx context.Context) (string, time.Time, error) {
+	if oc.httpClient == nil {
+		return "", time.Time{}, errOAuth2ClientNotInitialised
+	}
+
+	if token, expires, ok := oc.token.lookup(ctx); ok {
+		return token, expires, nil
+	}
+
+	l := oc.Logger.With("token_url", oc.TokenURL, "client_id", oc.ClientId)
+	l.Debug("acquiring oauth2 token using client credentials")
+
+	issued := time.Now()
+	token, err := getClientCredentialsToken(oc, ctx)
+	if err != nil {
+		l.Error("failed to acquire oauth2 token", "error", err)
+		return "", time.Time{}, err
+	}
+
+	expires := token.expiry(issued)
+	if token.ExpiresIn <= 0 {
+		expires = issued.Add(oauth2DefaultTokenLifetime)
+	}
+	oc.token.set(token.AccessToken, expires)
+
+	l.Debug("acquired oauth2 token successfully", "expires", expires)
+	return token.AccessToken, expires, nil
+}
+
+// Returns the headers required for authenticating requests with the access token
+func (oc *OAuth2Client) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	token, err := oc.AcquireToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return oc.TokenHeaders(token), nil
+}
+
+// Returns the bearer authorization header for the token
+func (oc *OAuth2Client) TokenHeaders(token string) []ClientHeader {
+	return bearerHeaders(token)
+}
+
+// Returns the client secret, preferring the secret file if set
+func (oc *OAuth2Client) clientSecret() (string, error) {
+	if oc.ClientSecretFile == "" {
+		return oc.ClientSecret, nil
+	}
+
+	secret, err := os.ReadFile(oc.ClientSecretFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read oauth2 client secret file: %w", err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// Requests an access token using the client credentials grant
+func getClientCredentialsToken(client *OAuth2Client, ctx context.Context) (*tokenResponse, error) {
+	secret, err := client.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	for k, v := range client.EndpointParams {
+		form.Set(k, v)
+	}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", client.ClientId)
+	form.Set("client_secret", secret)
+	if len(client.Scopes) > 0 {
+		form.Set("scope", strings.Join(client.Scopes, " "))
+	}
+	if client.Audience != "" {
+		form.Set("audience", client.Audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	return doTokenRequest(client.httpClient, req)
+}
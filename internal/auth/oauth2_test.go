@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuth2Client_ClientCredentials(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client", r.PostForm.Get("client_id"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, "metrics:read openid", r.PostForm.Get("scope"))
+		assert.Equal(t, "https://mimir.example.com", r.PostForm.Get("audience"))
+		assert.Equal(t, "org-1", r.PostForm.Get("resource"))
+
+		w.Write([]byte(`{"access_token":"oauth2-token","token_type":"Bearer","expires_in":300}`))
+	}))
+	defer server.Close()
+
+	client := &OAuth2Client{
+		TokenURL:       server.URL,
+		ClientId:       "client",
+		ClientSecret:   "secret",
+		Scopes:         []string{"metrics:read", "openid"},
+		Audience:       "https://mimir.example.com",
+		EndpointParams: map[string]string{"resource": "org-1"},
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	for range 3 {
+		headers, err := client.GetHeaders(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer oauth2-token"}}, headers)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestOAuth2Client_ClientSecretFile(t *testing.T) {
+	t.Parallel()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("first-secret\n"), 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		// Tokens expiring within the refresh margin are never reused, so every
+		// call reaches the token endpoint
+		w.Write([]byte(`{"access_token":"` + r.PostForm.Get("client_secret") + `","expires_in":1}`))
+	}))
+	defer server.Close()
+
+	client := &OAuth2Client{
+		TokenURL:         server.URL,
+		ClientId:         "client",
+		ClientSecretFile: secretFile,
+	}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "first-secret", token)
+
+	require.NoError(t, os.WriteFile(secretFile, []byte("rotated-secret"), 0o600))
+	token, err = client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "rotated-secret", token)
+}
+
+func TestOAuth2Client_InitClient_Validation(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		client   *OAuth2Client
+		expected error
+	}{
+		{
+			name:     "missing token url",
+			client:   &OAuth2Client{ClientId: "client", ClientSecret: "secret"},
+			expected: errOAuth2UnsetTokenURL,
+		},
+		{
+			name:     "missing client id",
+			client:   &OAuth2Client{TokenURL: "http://idp/token", ClientSecret: "secret"},
+			expected: errOAuth2UnsetClientId,
+		},
+		{
+			name:     "missing client secret",
+			client:   &OAuth2Client{TokenURL: "http://idp/token", ClientId: "client"},
+			expected: errOAuth2UnsetClientSecret,
+		},
+		{
+			name:     "valid with secret file",
+			client:   &OAuth2Client{TokenURL: "http://idp/token", ClientId: "client", ClientSecretFile: "/secret"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.client.InitClient(testutil.CreateTestLogger(t))
+			assert.Equal(t, tt.expected, err)
+		})
+	}
+}
+
+func TestOAuth2ClientAcquireToken_NotInitialized(t *testing.T) {
+	t.Parallel()
+	client := &OAuth2Client{}
+
+	token, err := client.AcquireToken(context.Background())
+	assert.Empty(t, token)
+	assert.Equal(t, errOAuth2ClientNotInitialised, err)
+}
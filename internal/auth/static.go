@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errBearerUnsetToken       = errors.New("bearer token or bearer token file must be set")
+	errBasicAuthUnsetUsername = errors.New("basic auth username is unset")
+	errBasicAuthUnsetPassword = errors.New("basic auth password or password file must be set")
+	errHeadersUnset           = errors.New("static headers are unset")
+)
+
+// BearerClient authenticates requests with a static bearer token, optionally
+// read from a file which is re-read whenever it changes
+type BearerClient struct {
+	Token     string
+	TokenFile string
+	Logger    *logger.Logger
+
+	file *filewatch.File
+}
+
+// Validates the client configuration and performs the initial read of the token file
+func (bc *BearerClient) InitClient(logger *logger.Logger) error {
+	logger.Info("using static bearer token for authentication", "token_file", bc.TokenFile)
+	bc.Logger = logger
+
+	if bc.TokenFile == "" {
+		if bc.Token == "" {
+			return errBearerUnsetToken
+		}
+		return nil
+	}
+
+	bc.file = filewatch.New(bc.TokenFile)
+	_, err := readSecretFile(bc.file, logger)
+	return err
+}
+
+// Returns the configured token, re-reading the token file if it has changed
+func (bc *BearerClient) AcquireToken(_ context.Context) (string, error) {
+	token := bc.Token
+	if bc.file != nil {
+		var err error
+		token, err = readSecretFile(bc.file, bc.Logger)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if token == "" {
+		return "", errEmptyToken
+	}
+	return token, nil
+}
+
+// Returns the bearer authorization header
+func (bc *BearerClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	token, err := bc.AcquireToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bearerHeaders(token), nil
+}
+
+// BasicAuthClient authenticates requests with HTTP basic auth, optionally
+// reading the password from a file which is re-read whenever it changes
+type BasicAuthClient struct {
+	Username     string
+	Password     string
+	PasswordFile string
+	Logger       *logger.Logger
+
+	file *filewatch.File
+}
+
+// Validates the client configuration and performs the initial read of the password file
+func (bc *BasicAuthClient) InitClient(logger *logger.Logger) error {
+	logger.Info("using basic auth for authentication", "username", bc.Username, "password_file", bc.PasswordFile)
+	bc.Logger = logger
+
+	if bc.Username == "" {
+		return errBasicAuthUnsetUsername
+	}
+
+	if bc.PasswordFile == "" {
+		if bc.Password == "" {
+			return errBasicAuthUnsetPassword
+		}
+		return nil
+	}
+
+	bc.file = filewatch.New(bc.PasswordFile)
+	_, err := readSecretFile(bc.file, logger)
+	return err
+}
+
+// Returns the base64 encoded basic auth credentials
+func (bc *BasicAuthClient) AcquireToken(_ context.Context) (string, error) {
+	password := bc.Password
+	if bc.file != nil {
+		var err error
+		password, err = readSecretFile(bc.file, bc.Logger)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if bc.Username == "" || password == "" {
+		return "", errEmptyToken
+	}
+	return base64.StdEncoding.EncodeToString([]byte(bc.Username + ":" + password)), nil
+}
+
+// Returns the basic authorization header
+func (bc *BasicAuthClient) GetHeaders(ctx context.Context) ([]ClientHeader, error) {
+	credentials, err := bc.AcquireToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ClientHeader{
+		{Key: "Authorization", Value: fmt.Sprintf("Basic %s", credentials)},
+	}, nil
+}
+
+// HeadersClient sends a fixed set of headers, e.g. an X-Scope-OrgID tenant
+// header, and is typically combined with other clients in a ChainClient
+type HeadersClient struct {
+	Headers map[string]string
+	Logger  *logger.Logger
+}
+
+// Validates that at least one header is set
+func (hc *HeadersClient) InitClient(logger *logger.Logger) error {
+	logger.Info("using static headers for authentication", "headers", slices.Sorted(maps.Keys(hc.Headers)))
+	hc.Logger = logger
+
+	if len(hc.Headers) == 0 {
+		return errHeadersUnset
+	}
+	return nil
+}
+
+// Static headers carry no token
+func (hc *HeadersClient) AcquireToken(_ context.Context) (string, error) {
+	return "", errEmptyToken
+}
+
+// Returns the configured headers sorted by name
+func (hc *HeadersClient) GetHeaders(_ context.Context) ([]ClientHeader, error) {
+	headers := make([]ClientHeader, 0, len(hc.Headers))
+	for _, key := range slices.Sorted(maps.Keys(hc.Headers)) {
+		headers = append(headers, ClientHeader{Key: key, Value: hc.Headers[key]})
+	}
+	return headers, nil
+}
+
+// Reads a secret from a watched file, trimming surrounding whitespace. If the
+// file becomes unreadable the last known secret continues to be used
+func readSecretFile(file *filewatch.File, logger *logger.Logger) (string, error) {
+	data, changed, err := file.Read()
+	if err != nil {
+		if data == nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		logger.Warn("failed to re-read secret file, using last known secret", "path", file.Path, "error", err)
+	}
+	if changed {
+		logger.Info("loaded secret file", "path", file.Path)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
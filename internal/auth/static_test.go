@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Rewrites a file, bumping the modification time so the change is always detected
+func rewriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	future := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, future, future))
+}
+
+func TestBearerClient_StaticToken(t *testing.T) {
+	t.Parallel()
+	client := &BearerClient{Token: "static-token"}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	headers, err := client.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Bearer static-token"}}, headers)
+}
+
+func TestBearerClient_TokenFileReload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first-token\n"), 0o600))
+
+	client := &BearerClient{TokenFile: path}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "first-token", token)
+
+	rewriteFile(t, path, "second-token")
+	token, err = client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "second-token", token)
+
+	// The last known token is used if the file disappears
+	require.NoError(t, os.Remove(path))
+	token, err = client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "second-token", token)
+}
+
+func TestBearerClient_InitClient_Errors(t *testing.T) {
+	t.Parallel()
+
+	err := (&BearerClient{}).InitClient(testutil.CreateTestLogger(t))
+	assert.Equal(t, errBearerUnsetToken, err)
+
+	err = (&BearerClient{TokenFile: filepath.Join(t.TempDir(), "missing")}).InitClient(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to read secret file")
+}
+
+func TestBearerClient_EmptyTokenFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+
+	client := &BearerClient{TokenFile: path}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	_, err := client.GetHeaders(context.Background())
+	assert.Equal(t, errEmptyToken, err)
+}
+
+func TestBasicAuthClient(t *testing.T) {
+	t.Parallel()
+	client := &BasicAuthClient{Username: "user", Password: "pass"}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	headers, err := client.GetHeaders(context.Background())
+	require.NoError(t, err)
+	// base64("user:pass")
+	assert.Equal(t, []ClientHeader{{Key: "Authorization", Value: "Basic dXNlcjpwYXNz"}}, headers)
+}
+
+func TestBasicAuthClient_PasswordFileReload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("pass"), 0o600))
+
+	client := &BasicAuthClient{Username: "user", PasswordFile: path}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	token, err := client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "dXNlcjpwYXNz", token)
+
+	rewriteFile(t, path, "rotated")
+	token, err = client.AcquireToken(context.Background())
+	require.NoError(t, err)
+	// base64("user:rotated")
+	assert.Equal(t, "dXNlcjpyb3RhdGVk", token)
+}
+
+func TestBasicAuthClient_InitClient_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		client   *BasicAuthClient
+		expected error
+	}{
+		{
+			name:     "missing username",
+			client:   &BasicAuthClient{Password: "pass"},
+			expected: errBasicAuthUnsetUsername,
+		},
+		{
+			name:     "missing password",
+			client:   &BasicAuthClient{Username: "user"},
+			expected: errBasicAuthUnsetPassword,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.client.InitClient(testutil.CreateTestLogger(t))
+			assert.Equal(t, tt.expected, err)
+		})
+	}
+}
+
+func TestHeadersClient(t *testing.T) {
+	t.Parallel()
+	client := &HeadersClient{Headers: map[string]string{"X-Scope-OrgID": "tenant-1", "X-Env": "prod"}}
+	require.NoError(t, client.InitClient(testutil.CreateTestLogger(t)))
+
+	headers, err := client.GetHeaders(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClientHeader{
+		{Key: "X-Env", Value: "prod"},
+		{Key: "X-Scope-OrgID", Value: "tenant-1"},
+	}, headers)
+
+	_, err = client.AcquireToken(context.Background())
+	assert.Equal(t, errEmptyToken, err)
+
+	err = (&HeadersClient{}).InitClient(testutil.CreateTestLogger(t))
+	assert.Equal(t, errHeadersUnset, err)
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are refreshed this long before they expire, to avoid sending a
+// token which expires in transit
+var tokenExpiryMargin = time.Minute
+
+// Holds an access token alongside its expiry so it can be reused until
+// shortly before it expires
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Returns the cached token if it is still valid
+func (c *cachedToken) get() (string, bool) {
+	token, _, ok := c.lookup(context.Background())
+	return token, ok
+}
+
+// Returns the cached token and its expiry if it is still valid, unless the
+// context requests a forced refresh
+func (c *cachedToken) lookup(ctx context.Context) (string, time.Time, bool) {
+	if isForceRefresh(ctx) {
+		return "", time.Time{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || time.Now().Add(tokenExpiryMargin).After(c.expires) {
+		return "", time.Time{}, false
+	}
+	return c.token, c.expires, true
+}
+
+// Stores a token which expires at the provided time
+func (c *cachedToken) set(token string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	c.expires = expires
+}
+
+type forceRefreshKey struct{}
+
+// Returns a context instructing clients to bypass their token cache and
+// source a new token
+func withForceRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceRefreshKey{}, true)
+}
+
+// Reports whether the context requests a forced token refresh
+func isForceRefresh(ctx context.Context) bool {
+	force, _ := ctx.Value(forceRefreshKey{}).(bool)
+	return force
+}
+
+// Standard OAuth2 token endpoint response (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Returns the time the token expires, measured from when it was issued
+func (t *tokenResponse) expiry(issued time.Time) time.Time {
+	return issued.Add(time.Duration(t.ExpiresIn) * time.Second)
+}
+
+// Sends a request to an OAuth2 token endpoint and decodes the response
+func doTokenRequest(httpClient *http.Client, req *http.Request) (*tokenResponse, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errEmptyToken
+	}
+
+	return &token, nil
+}
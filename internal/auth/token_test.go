@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedToken(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		token    string
+		expires  time.Time
+		expected bool
+	}{
+		{
+			name:     "valid token",
+			token:    "token",
+			expires:  time.Now().Add(time.Hour),
+			expected: true,
+		},
+		{
+			name:     "expired token",
+			token:    "token",
+			expires:  time.Now().Add(-time.Minute),
+			expected: false,
+		},
+		{
+			name:     "token within expiry margin",
+			token:    "token",
+			expires:  time.Now().Add(tokenExpiryMargin / 2),
+			expected: false,
+		},
+		{
+			name:     "empty token",
+			token:    "",
+			expires:  time.Now().Add(time.Hour),
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var c cachedToken
+			c.set(tt.token, tt.expires)
+
+			token, ok := c.get()
+			assert.Equal(t, tt.expected, ok)
+			if tt.expected {
+				assert.Equal(t, tt.token, token)
+			}
+		})
+	}
+}
+
+func TestDoTokenRequest(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		expected    *tokenResponse
+		expectedErr string
+	}{
+		{
+			name:     "valid response",
+			status:   http.StatusOK,
+			body:     `{"access_token":"abc","token_type":"Bearer","expires_in":300}`,
+			expected: &tokenResponse{AccessToken: "abc", TokenType: "Bearer", ExpiresIn: 300},
+		},
+		{
+			name:        "error status",
+			status:      http.StatusUnauthorized,
+			body:        `{"error":"invalid_client"}`,
+			expectedErr: "token endpoint returned status 401",
+		},
+		{
+			name:        "empty token",
+			status:      http.StatusOK,
+			body:        `{"access_token":""}`,
+			expectedErr: errEmptyToken.Error(),
+		},
+		{
+			name:        "invalid json",
+			status:      http.StatusOK,
+			body:        `not-json`,
+			expectedErr: "failed to decode token response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+			require.NoError(t, err)
+
+			token, err := doTokenRequest(server.Client(), req)
+			if tt.expectedErr != "" {
+				assert.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, token)
+		})
+	}
+}
+
+func TestCachedTokenForceRefresh(t *testing.T) {
+	t.Parallel()
+	var c cachedToken
+	expires := time.Now().Add(time.Hour)
+	c.set("token", expires)
+
+	token, cachedExpires, ok := c.lookup(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, expires, cachedExpires)
+
+	_, _, ok = c.lookup(withForceRefresh(context.Background()))
+	assert.False(t, ok)
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+// Cache stores values by key, evicting them when full or once expired.
+// Implementations are safe for concurrent use
+type Cache interface {
+	// Returns the value stored for the key, if it is present and unexpired
+	Get(key string) ([]byte, bool)
+	// Stores the value for the key, expiring it after ttl, or never if 0
+	Set(key string, value []byte, ttl time.Duration)
+	// Returns the hit and miss counts and current size of the cache
+	Stats() Stats
+}
+
+// Initialiser is implemented by caches which load persisted entries before use
+type Initialiser interface {
+	Init(logger *logger.Logger) error
+}
+
+// Stats describes the use of a cache since it was created
+type Stats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
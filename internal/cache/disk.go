@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+// The size of the expiry header preceding the value in each file
+const diskHeaderSize = 8
+
+const diskTempPrefix = ".tmp-"
+
+// Disk is a cache persisted as one file per entry in a directory, so entries
+// survive restarts when the directory is on a volume. It is bounded by the
+// total size of its files, evicting the least recently used entries when
+// full. Entries loaded from disk are ordered by when they were written
+type Disk struct {
+	dir      string
+	maxBytes int64
+	now      func() time.Time
+	logger   *logger.Logger
+
+	mu      sync.Mutex
+	size    int64
+	hits    int64
+	misses  int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type diskEntry struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+// Creates a cache in the directory holding at most maxBytes of files. Init
+// must be called before use
+func NewDisk(dir string, maxBytes int64) *Disk {
+	return &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Creates the cache directory and loads the entries persisted in it,
+// removing expired, corrupt and partially written files
+func (d *Disk) Init(logger *logger.Logger) error {
+	d.logger = logger
+	if err := os.MkdirAll(d.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	type loaded struct {
+		entry   *diskEntry
+		modTime time.Time
+	}
+	var files []loaded
+	err := filepath.WalkDir(d.dir, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil || dirEntry.IsDir() {
+			return err
+		}
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, diskTempPrefix) {
+			os.Remove(path)
+			return nil
+		}
+		if len(name) != 2*sha256.Size || path != d.path(name) {
+			return nil
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		expires, err := readExpiry(path)
+		if err != nil || (!expires.IsZero() && !d.now().Before(expires)) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, loaded{
+			entry:   &diskEntry{name: name, size: info.Size(), expires: expires},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load cache directory: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	slices.SortFunc(files, func(a, b loaded) int { return a.modTime.Compare(b.modTime) })
+	for _, file := range files {
+		d.entries[file.entry.name] = d.order.PushFront(file.entry)
+		d.size += file.entry.size
+	}
+	for d.size > d.maxBytes {
+		d.remove(d.order.Back())
+	}
+
+	logger.Info("loaded disk cache", "dir", d.dir, "entries", d.order.Len(), "bytes", d.size)
+	return nil
+}
+
+// Returns the value stored for the key, marking it as recently used
+func (d *Disk) Get(key string) ([]byte, bool) {
+	name := diskFileName(key)
+
+	d.mu.Lock()
+	element, ok := d.entries[name]
+	if !ok {
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	entry := element.Value.(*diskEntry)
+	if !entry.expires.IsZero() && !d.now().Before(entry.expires) {
+		d.remove(element)
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	d.order.MoveToFront(element)
+	d.mu.Unlock()
+
+	// Files are replaced atomically, so are read without holding the lock
+	data, err := os.ReadFile(d.path(name))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil || len(data) < diskHeaderSize {
+		if d.entries[name] == element {
+			d.remove(element)
+		}
+		d.misses++
+		return nil, false
+	}
+	d.hits++
+	return data[diskHeaderSize:], true
+}
+
+// Stores the value for the key, evicting the least recently used entries to
+// make room. Values larger than the cache are not stored, and write failures
+// are logged and otherwise ignored
+func (d *Disk) Set(key string, value []byte, ttl time.Duration) {
+	entry := &diskEntry{name: diskFileName(key), size: int64(diskHeaderSize + len(value))}
+	if ttl > 0 {
+		entry.expires = d.now().Add(ttl)
+	}
+	if entry.size > d.maxBytes {
+		return
+	}
+
+	temp, err := d.writeTemp(entry, value)
+	if err != nil {
+		d.logger.Warn("failed to write disk cache entry", "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The file is replaced by the rename, so is not removed
+	if element, ok := d.entries[entry.name]; ok {
+		d.order.Remove(element)
+		delete(d.entries, entry.name)
+		d.size -= element.Value.(*diskEntry).size
+	}
+	for d.size+entry.size > d.maxBytes {
+		d.remove(d.order.Back())
+	}
+
+	if err := os.Rename(temp, d.path(entry.name)); err != nil {
+		os.Remove(temp)
+		d.logger.Warn("failed to write disk cache entry", "error", err)
+		return
+	}
+	d.entries[entry.name] = d.order.PushFront(entry)
+	d.size += entry.size
+}
+
+// Returns the hit and miss counts, the number of entries and their total
+// size in bytes
+func (d *Disk) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{Hits: d.hits, Misses: d.misses, Entries: d.order.Len(), Bytes: d.size}
+}
+
+// Writes the entry to a temporary file beside its final path, returning the
+// temporary path
+func (d *Disk) writeTemp(entry *diskEntry, value []byte) (string, error) {
+	dir := filepath.Dir(d.path(entry.name))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, diskTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+
+	var header [diskHeaderSize]byte
+	if !entry.expires.IsZero() {
+		binary.BigEndian.PutUint64(header[:], uint64(entry.expires.UnixNano()))
+	}
+	_, err = file.Write(append(header[:], value...))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Returns the path of an entry's file, spread across subdirectories by the
+// first byte of its name
+func (d *Disk) path(name string) string {
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+func (d *Disk) remove(element *list.Element) {
+	entry := d.order.Remove(element).(*diskEntry)
+	delete(d.entries, entry.name)
+	d.size -= entry.size
+	os.Remove(d.path(entry.name))
+}
+
+// Returns the file name of a key, which may contain any characters
+func diskFileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Reads the expiry header of an entry's file
+func readExpiry(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	var header [diskHeaderSize]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		return time.Time{}, err
+	}
+	nanos := binary.BigEndian.Uint64(header[:])
+	if nanos == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, int64(nanos)), nil
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDisk(t *testing.T, dir string, maxBytes int64) *Disk {
+	t.Helper()
+	d := NewDisk(dir, maxBytes)
+	require.NoError(t, d.Init(testutil.CreateTestLogger(t)))
+	return d
+}
+
+func TestDisk(t *testing.T) {
+	t.Parallel()
+	d := newTestDisk(t, t.TempDir(), 34)
+
+	d.Set("a", []byte("123456789"), 0)
+	d.Set("b", []byte("123456789"), 0)
+	value, ok := d.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("123456789"), value)
+
+	// b is the least recently used entry, so is evicted first
+	d.Set("c", []byte("123456789"), 0)
+	_, ok = d.Get("b")
+	assert.False(t, ok)
+	_, ok = d.Get("a")
+	assert.True(t, ok)
+	_, ok = d.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, Stats{Hits: 3, Misses: 1, Entries: 2, Bytes: 34}, d.Stats())
+
+	// Replacing a value updates the size
+	d.Set("a", []byte("1"), 0)
+	value, _ = d.Get("a")
+	assert.Equal(t, []byte("1"), value)
+	assert.Equal(t, int64(26), d.Stats().Bytes)
+
+	// Values larger than the cache are not stored
+	d.Set("d", make([]byte, 34), 0)
+	_, ok = d.Get("d")
+	assert.False(t, ok)
+}
+
+func TestDisk_TTL(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	d := newTestDisk(t, t.TempDir(), 100)
+	d.now = func() time.Time { return now }
+
+	d.Set("a", []byte("1"), time.Minute)
+	d.Set("b", []byte("2"), 0)
+
+	now = now.Add(time.Minute)
+	_, ok := d.Get("a")
+	assert.False(t, ok)
+	_, ok = d.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, 1, d.Stats().Entries)
+}
+
+func TestDisk_Persistence(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	d := newTestDisk(t, dir, 100)
+	d.Set("a", []byte("1"), time.Hour)
+	d.Set("b", []byte("2"), 0)
+	d.Set("expiring", []byte("3"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	// Partial writes and unknown files are ignored or removed
+	testutil.WriteFile(t, dir, ".tmp-123", []byte("partial"))
+	testutil.WriteFile(t, dir, "README", []byte("not an entry"))
+	corrupt := diskFileName("corrupt")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, corrupt[:2]), 0o700))
+	testutil.WriteFile(t, filepath.Join(dir, corrupt[:2]), corrupt, []byte("1"))
+
+	reloaded := newTestDisk(t, dir, 100)
+	assert.Equal(t, Stats{Entries: 2, Bytes: 18}, reloaded.Stats())
+	value, ok := reloaded.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	value, ok = reloaded.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("2"), value)
+
+	assert.NoFileExists(t, filepath.Join(dir, ".tmp-123"))
+	assert.NoFileExists(t, filepath.Join(dir, corrupt[:2], corrupt))
+	assert.FileExists(t, filepath.Join(dir, "README"))
+
+	// The oldest entries are evicted when the cache has shrunk
+	shrunk := newTestDisk(t, dir, 10)
+	assert.Equal(t, 1, shrunk.Stats().Entries)
+}
+
+func TestDisk_InitError(t *testing.T) {
+	t.Parallel()
+	file := testutil.WriteFile(t, t.TempDir(), "file", nil)
+
+	err := NewDisk(filepath.Join(file, "cache"), 100).Init(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to create cache directory")
+}
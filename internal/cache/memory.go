@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory cache bounded by the total size of its keys and
+// values, evicting the least recently used entries when full
+type Memory struct {
+	maxBytes int64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	size    int64
+	hits    int64
+	misses  int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// Creates an in-memory cache holding at most maxBytes of keys and values
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Returns the value stored for the key, marking it as recently used
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		m.misses++
+		return nil, false
+	}
+	entry := element.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && !m.now().Before(entry.expires) {
+		m.remove(element)
+		m.misses++
+		return nil, false
+	}
+	m.order.MoveToFront(element)
+	m.hits++
+	return entry.value, true
+}
+
+// Stores the value for the key, evicting the least recently used entries to
+// make room. Values larger than the cache are not stored
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+
+	entry := &memoryEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = m.now().Add(ttl)
+	}
+	if entry.size() > m.maxBytes {
+		return
+	}
+
+	for m.size+entry.size() > m.maxBytes {
+		m.remove(m.order.Back())
+	}
+	m.entries[key] = m.order.PushFront(entry)
+	m.size += entry.size()
+}
+
+// Returns the hit and miss counts, the number of entries and their total
+// size in bytes
+func (m *Memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{Hits: m.hits, Misses: m.misses, Entries: m.order.Len(), Bytes: m.size}
+}
+
+func (m *Memory) remove(element *list.Element) {
+	entry := m.order.Remove(element).(*memoryEntry)
+	delete(m.entries, entry.key)
+	m.size -= entry.size()
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+	m := NewMemory(25)
+
+	m.Set("a", []byte("123456789"), 0)
+	m.Set("b", []byte("123456789"), 0)
+	value, ok := m.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("123456789"), value)
+
+	// b is the least recently used entry, so is evicted first
+	m.Set("c", []byte("123456789"), 0)
+	_, ok = m.Get("b")
+	assert.False(t, ok)
+	_, ok = m.Get("a")
+	assert.True(t, ok)
+	_, ok = m.Get("c")
+	assert.True(t, ok)
+
+	assert.Equal(t, Stats{Hits: 3, Misses: 1, Entries: 2, Bytes: 20}, m.Stats())
+
+	// Replacing a value updates the size
+	m.Set("a", []byte("1"), 0)
+	assert.Equal(t, int64(12), m.Stats().Bytes)
+
+	// Values larger than the cache are not stored
+	m.Set("d", make([]byte, 25), 0)
+	_, ok = m.Get("d")
+	assert.False(t, ok)
+}
+
+func TestMemory_TTL(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	m := NewMemory(100)
+	m.now = func() time.Time { return now }
+
+	m.Set("a", []byte("1"), time.Minute)
+	m.Set("b", []byte("2"), 0)
+
+	now = now.Add(time.Minute)
+	_, ok := m.Get("a")
+	assert.False(t, ok)
+	_, ok = m.Get("b")
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, m.Stats().Entries)
+}
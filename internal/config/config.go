@@ -1,7 +1,19 @@
 package config
 
 import (
+	"net/http"
+
 	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/dedup"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/limits"
+	"github.com/s-humphreys/prometheus-proxy/internal/metacache"
+	"github.com/s-humphreys/prometheus-proxy/internal/policy"
+	"github.com/s-humphreys/prometheus-proxy/internal/queryrange"
+	"github.com/s-humphreys/prometheus-proxy/internal/tenancy"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 )
 
 type Config struct {
@@ -9,4 +21,36 @@ type Config struct {
 	LogLevel      string
 	Port          int
 	Client        auth.Client
+	UpstreamTLS   *tlsconfig.Config
+	// HTTP client used for upstream requests, created from UpstreamTLS if unset
+	HTTPClient *http.Client
+	// Authenticates callers of the proxy, all callers are accepted if empty
+	Inbound inbound.Chain
+	// Rejects queries denied by a policy file, all queries are allowed if nil
+	Policy *policy.Engine
+	// Cost limits applied to queries, which are unlimited if unset
+	Limits *limits.Limits
+	// Restricts callers to their label values, queries are unrestricted if nil
+	Tenancy *tenancy.Enforcer
+	// Splits long range queries into concurrent sub-range queries, if set
+	Splitter *queryrange.Splitter
+	// Caches range query results, if set
+	ResultsCache *queryrange.ResultsCache
+	// Caches label, series and metadata responses, if set
+	MetadataCache *metacache.MetadataCache
+	// Coalesces identical concurrent upstream requests, if set
+	Deduplicator *dedup.Deduplicator
+	// Decides which caller headers are forwarded upstream, the default
+	// allowlist applies if nil
+	Headers *headerpolicy.Policy
+	// The largest request body accepted, unlimited if 0
+	MaxRequestBodyBytes int64
+	// GET requests with longer query strings are forwarded as POST requests,
+	// if set
+	MaxGetQueryLength int
+	// Routes requests to named upstreams, all requests are forwarded to
+	// PrometheusUrl if nil
+	Upstreams *upstream.Router
+	// TLS settings for the proxy's listener, which serves plain HTTP if unset
+	ServerTLS *tlsconfig.Config
 }
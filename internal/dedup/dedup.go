@@ -0,0 +1,147 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
+)
+
+// Deduplicator coalesces identical concurrent requests, such as the panels of
+// a dashboard loaded by many users at once, into a single upstream request
+// whose response is written to every waiting caller
+type Deduplicator struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// An upstream request shared by its waiting callers
+type call struct {
+	done    chan struct{}
+	rec     *promapi.Recorder
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Middleware passes the first of identical concurrent requests to the next
+// handler, and writes its response to every identical request which arrives
+// before it completes. Requests are identical if they have the same method,
+// path, parameters and caller. The shared request is cancelled only once
+// every waiting caller has disconnected
+func (d *Deduplicator) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params, err := promapi.RequestParams(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		key := requestKey(r, params)
+
+		d.mu.Lock()
+		if d.calls == nil {
+			d.calls = make(map[string]*call)
+		}
+		c, shared := d.calls[key]
+		if !shared {
+			// The shared request outlives any one caller, but keeps the
+			// values of the first, such as the caller identity
+			ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+			c = &call{done: make(chan struct{}), rec: promapi.NewRecorder(), cancel: cancel}
+			d.calls[key] = c
+			go d.execute(key, c, r.Clone(ctx), next)
+		}
+		c.waiters++
+		d.mu.Unlock()
+
+		if shared {
+			logger.WithRequestFields(r).Debug("joined identical in-flight request")
+		}
+
+		select {
+		case <-c.done:
+			c.rec.Replay(w)
+		case <-r.Context().Done():
+			d.leave(key, c)
+		}
+	})
+}
+
+// Passes the shared request to the next handler, releasing its waiters
+func (d *Deduplicator) execute(key string, c *call, r *http.Request, next http.Handler) {
+	defer close(c.done)
+	defer c.cancel()
+	next.ServeHTTP(c.rec, r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.calls[key] == c {
+		delete(d.calls, key)
+	}
+}
+
+// Removes a disconnected waiter, cancelling the shared request if it was the
+// last. Later identical requests start a new shared request rather than
+// joining the cancelled one
+func (d *Deduplicator) leave(key string, c *call) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.waiters--
+	if c.waiters > 0 {
+		return
+	}
+	c.cancel()
+	if d.calls[key] == c {
+		delete(d.calls, key)
+	}
+}
+
+// Returns the key identifying identical requests, from the caller, method,
+// path and parameters, with the query normalised and repeated parameters
+// sorted
+func requestKey(r *http.Request, params url.Values) string {
+	expression := promapi.ExpressionParam(r.URL.Path)
+	normalized := make(url.Values, len(params))
+	for k, values := range params {
+		values = slices.Clone(values)
+		if k == expression {
+			for i, value := range values {
+				if query, err := promql.Normalize(value); err == nil {
+					values[i] = query
+				}
+			}
+		}
+		slices.Sort(values)
+		normalized[k] = values
+	}
+
+	hash := sha256.New()
+	if identity, ok := inbound.IdentityFromContext(r.Context()); ok {
+		hash.Write([]byte(identity.Name))
+	}
+	// The upstream prefix is removed from the path, so routed requests are
+	// told apart by their upstream
+	if u, ok := upstream.FromContext(r.Context()); ok {
+		hash.Write([]byte{0})
+		hash.Write([]byte(u.Name))
+	}
+	// Headers such as X-Scope-OrgID select a tenant without inbound auth
+	if key := headerpolicy.RequestKey(r); key != "" {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+	}
+	for _, part := range []string{r.Method, r.URL.Path, normalized.Encode()} {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
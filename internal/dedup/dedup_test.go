@@ -0,0 +1,199 @@
+package dedup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// An upstream which blocks each request until released, counting requests and
+// recording whether they were cancelled
+type blockingUpstream struct {
+	calls     atomic.Int32
+	started   chan struct{}
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func newBlockingUpstream() *blockingUpstream {
+	return &blockingUpstream{
+		started:   make(chan struct{}, 10),
+		release:   make(chan struct{}),
+		cancelled: make(chan struct{}, 10),
+	}
+}
+
+func (b *blockingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := b.calls.Add(1)
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Call", string('0'+rune(n)))
+		w.Write([]byte(`{"status":"success"}`))
+	case <-r.Context().Done():
+		b.cancelled <- struct{}{}
+	}
+}
+
+// Serves a request in the background, returning a channel receiving the
+// response
+func serve(t *testing.T, handler http.Handler, req *http.Request) <-chan *httptest.ResponseRecorder {
+	t.Helper()
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		responses <- w
+	}()
+	return responses
+}
+
+// Waits until n requests are waiting on the shared request for the key
+func waitForWaiters(t *testing.T, d *Deduplicator, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		waiters := 0
+		for _, c := range d.calls {
+			waiters += c.waiters
+		}
+		return waiters == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	upstream := newBlockingUpstream()
+	d := &Deduplicator{}
+	handler := d.Middleware(testutil.CreateTestLogger(t), upstream)
+
+	var responses []<-chan *httptest.ResponseRecorder
+	for _, target := range []string{
+		"/api/v1/query?query=sum(rate(x[5m]))&time=1700000000",
+		"/api/v1/query?time=1700000000&query=sum%20(%20rate(x[5m])%20)",
+	} {
+		responses = append(responses, serve(t, handler, testutil.CreateHTTPRequest(t, http.MethodGet, target, nil)))
+	}
+	post := testutil.CreateHTTPRequest(t, http.MethodPost, "/api/v1/query", strings.NewReader("query=sum(rate(x[5m]))&time=1700000000"))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	postResponse := serve(t, handler, post)
+
+	waitForWaiters(t, d, 3)
+	close(upstream.release)
+
+	for _, response := range responses {
+		w := <-response
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `{"status":"success"}`, w.Body.String())
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	}
+	<-postResponse
+
+	// The GET requests share a call, the POST request is forwarded separately
+	assert.Equal(t, int32(2), upstream.calls.Load())
+	assert.Empty(t, d.calls)
+}
+
+func TestMiddleware_Callers(t *testing.T) {
+	t.Parallel()
+	upstream := newBlockingUpstream()
+	d := &Deduplicator{}
+	handler := d.Middleware(testutil.CreateTestLogger(t), upstream)
+
+	var responses []<-chan *httptest.ResponseRecorder
+	for _, caller := range []string{"alice", "bob", "alice"} {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query?query=up", nil)
+		req = req.WithContext(inbound.WithIdentity(req.Context(), &inbound.Identity{Name: caller}))
+		responses = append(responses, serve(t, handler, req))
+	}
+
+	waitForWaiters(t, d, 3)
+	close(upstream.release)
+	for _, response := range responses {
+		<-response
+	}
+	assert.Equal(t, int32(2), upstream.calls.Load())
+}
+
+func TestMiddleware_Cancellation(t *testing.T) {
+	t.Parallel()
+	upstream := newBlockingUpstream()
+	d := &Deduplicator{}
+	handler := d.Middleware(testutil.CreateTestLogger(t), upstream)
+
+	newRequest := func() (*http.Request, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query?query=up", nil).WithContext(ctx), cancel
+	}
+
+	// The shared request continues while any caller is waiting for it
+	first, cancelFirst := newRequest()
+	second, cancelSecond := newRequest()
+	firstResponse := serve(t, handler, first)
+	secondResponse := serve(t, handler, second)
+	waitForWaiters(t, d, 2)
+	cancelFirst()
+	<-firstResponse
+	waitForWaiters(t, d, 1)
+	assert.Empty(t, upstream.cancelled)
+
+	// It is cancelled once every caller has disconnected
+	cancelSecond()
+	<-secondResponse
+	select {
+	case <-upstream.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("shared request was not cancelled")
+	}
+
+	// Later requests are not joined to the cancelled request
+	third, cancelThird := newRequest()
+	defer cancelThird()
+	thirdResponse := serve(t, handler, third)
+	waitForWaiters(t, d, 1)
+	close(upstream.release)
+	w := <-thirdResponse
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-Call"))
+}
+
+func TestRequestKey(t *testing.T) {
+	t.Parallel()
+	key := func(method, target string) string {
+		req := testutil.CreateHTTPRequest(t, method, target, nil)
+		return requestKey(req, req.URL.Query())
+	}
+
+	base := key(http.MethodGet, "/api/v1/series?match[]=up&match[]=node_load1{job='a'}")
+	assert.Equal(t, base, key(http.MethodGet, "/api/v1/series?match[]=node_load1%7B%20job%3D'a'%20%7D&match[]=up"))
+	assert.NotEqual(t, base, key(http.MethodGet, "/api/v1/series?match[]=up"))
+	assert.NotEqual(t, base, key(http.MethodGet, "/api/v1/labels?match[]=up&match[]=node_load1{job='a'}"))
+	assert.NotEqual(t, base, key(http.MethodPost, "/api/v1/series?match[]=up&match[]=node_load1{job='a'}"))
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/series?match[]=up&match[]=node_load1{job='a'}", nil)
+	req = req.WithContext(upstream.WithUpstream(req.Context(), &upstream.Upstream{Name: "regional"}))
+	assert.NotEqual(t, base, requestKey(req, req.URL.Query()))
+
+	// Tenants selected by a forwarded header never share a request
+	tenantKey := func(orgID string) string {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("X-Scope-OrgID", orgID)
+		req = req.WithContext(headerpolicy.WithPolicy(req.Context(), &headerpolicy.Policy{Allow: []string{"X-Scope-OrgID"}}))
+		return requestKey(req, req.URL.Query())
+	}
+	assert.NotEqual(t, tenantKey("tenant-1"), tenantKey("tenant-2"))
+	assert.Equal(t, tenantKey("tenant-1"), tenantKey("tenant-1"))
+}
@@ -0,0 +1,54 @@
+package filewatch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// File caches the contents of a file on disk, re-reading it whenever its
+// modification time or size changes. This suits Kubernetes secret and
+// configmap mounts, which are atomically swapped when updated
+type File struct {
+	Path string
+
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+	size    int64
+	loaded  bool
+}
+
+// New creates a watched file for the provided path
+func New(path string) *File {
+	return &File{Path: path}
+}
+
+// Read returns the current contents of the file, and whether they changed
+// since the previous call. If the file cannot be read after a successful
+// load, the error is returned alongside the last known contents
+func (f *File) Read() ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return f.data, false, err
+	}
+
+	if f.loaded && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.data, false, nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return f.data, false, err
+	}
+
+	f.data = data
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.loaded = true
+
+	return data, true, nil
+}
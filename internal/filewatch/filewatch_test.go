@@ -0,0 +1,81 @@
+package filewatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRead(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("first"), 0o600))
+
+	f := New(path)
+
+	data, changed, err := f.Read()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "first", string(data))
+
+	data, changed, err = f.Read()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "first", string(data))
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0o600))
+	// Ensure the modification time differs on filesystems with coarse timestamps
+	future := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	data, changed, err = f.Read()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "second", string(data))
+}
+
+func TestFileRead_SymlinkSwap(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	link := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(first, []byte("first"), 0o600))
+	require.NoError(t, os.WriteFile(second, []byte("second-token"), 0o600))
+	require.NoError(t, os.Symlink(first, link))
+
+	f := New(link)
+	data, _, err := f.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	// Kubernetes updates secret mounts by swapping a symlink
+	tmp := filepath.Join(dir, "token.tmp")
+	require.NoError(t, os.Symlink(second, tmp))
+	require.NoError(t, os.Rename(tmp, link))
+
+	data, changed, err := f.Read()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "second-token", string(data))
+}
+
+func TestFileRead_MissingFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+
+	f := New(path)
+	_, _, err := f.Read()
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(path))
+	data, changed, err := f.Read()
+	assert.Error(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "data", string(data), "last known contents are returned")
+}
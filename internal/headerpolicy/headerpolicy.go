@@ -0,0 +1,175 @@
+package headerpolicy
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// DefaultAllow lists the caller headers forwarded upstream by default, which
+// describe the client and trace the request without affecting the response.
+// Names ending in * match any header with that prefix
+var DefaultAllow = []string{
+	"Accept",
+	"Accept-Language",
+	"User-Agent",
+	"X-Grafana-*",
+	"X-Dashboard-Uid",
+	"X-Panel-Id",
+	"X-Request-Id",
+	"Traceparent",
+	"Tracestate",
+	"Baggage",
+	"X-B3-*",
+	"B3",
+}
+
+// Headers which are never forwarded from callers, as the proxy sets them for
+// the upstream request itself. Credentials would otherwise let callers bypass
+// the upstream identity, and responses are decompressed by the proxy's client
+var protected = []string{
+	"Authorization",
+	"Cookie",
+	"Host",
+	"Content-Length",
+	"Content-Type",
+	"Accept-Encoding",
+	"Forwarded",
+	"X-Forwarded-*",
+	"X-Amz-*",
+}
+
+// Hop-by-hop headers describe a single connection, so are never forwarded in
+// either direction (RFC 7230 section 6.1)
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Policy decides which caller headers are forwarded to the upstream
+type Policy struct {
+	// Headers forwarded in addition to DefaultAllow
+	Allow []string
+	// Headers never forwarded, overriding both allow lists
+	Deny []string
+}
+
+// Copies the caller headers allowed by the policy from src to dst, skipping
+// hop-by-hop and protected headers
+func (p *Policy) ForwardRequest(dst, src http.Header) {
+	connection := connectionHeaders(src)
+	for name, values := range src {
+		if p.forwards(name, connection, DefaultAllow) || p.forwards(name, connection, p.Allow) {
+			dst[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// Returns the caller headers forwarded only because of the policy's Allow
+// list, sorted and encoded as a string. Unlike the default allowlist, these
+// headers may change the upstream response, e.g. X-Scope-OrgID, so requests
+// differing in them must not share responses
+func (p *Policy) Key(src http.Header) string {
+	connection := connectionHeaders(src)
+	var names []string
+	for name := range src {
+		if !matchAny(DefaultAllow, name) && p.forwards(name, connection, p.Allow) {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(http.CanonicalHeaderKey(a), http.CanonicalHeaderKey(b))
+	})
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(http.CanonicalHeaderKey(name))
+		for _, value := range src[name] {
+			key.WriteByte(0)
+			key.WriteString(value)
+		}
+		key.WriteByte('\n')
+	}
+	return key.String()
+}
+
+// Reports whether the header matches the allowlist and is neither hop-by-hop,
+// protected nor denied
+func (p *Policy) forwards(name string, connection, allow []string) bool {
+	if isHopByHop(name, connection) || matchAny(protected, name) || matchAny(p.Deny, name) {
+		return false
+	}
+	return matchAny(allow, name)
+}
+
+type policyKey struct{}
+
+// Returns a copy of the context carrying the header policy applied to the
+// request
+func WithPolicy(ctx context.Context, policy *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// Returns the Key of the request's forwarded headers under the policy stored
+// in its context, or an empty string if there is none
+func RequestKey(r *http.Request) string {
+	policy, ok := r.Context().Value(policyKey{}).(*Policy)
+	if !ok {
+		return ""
+	}
+	return policy.Key(r.Header)
+}
+
+// Copies the upstream response headers from src to dst, skipping hop-by-hop
+// headers
+func ForwardResponse(dst, src http.Header) {
+	connection := connectionHeaders(src)
+	for name, values := range src {
+		if isHopByHop(name, connection) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// Returns the headers listed in the Connection header, which are hop-by-hop
+func connectionHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Connection") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func isHopByHop(name string, connection []string) bool {
+	return matchAny(hopByHop, name) || matchAny(connection, name)
+}
+
+// Returns whether the header matches any of the names, case-insensitively,
+// where names ending in * match by prefix
+func matchAny(names []string, header string) bool {
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			if len(header) >= len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+	return false
+}
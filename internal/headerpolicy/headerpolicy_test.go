@@ -0,0 +1,120 @@
+package headerpolicy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardRequest(t *testing.T) {
+	t.Parallel()
+	src := http.Header{
+		"Accept":              {"application/json"},
+		"User-Agent":          {"Grafana/11.0.0"},
+		"X-Grafana-Org-Id":    {"1"},
+		"Traceparent":         {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"X-Panel-Id":          {"4"},
+		"X-Custom":            {"a", "b"},
+		"X-Internal-Secret":   {"s3cr3t"},
+		"Authorization":       {"Bearer caller-token"},
+		"Cookie":              {"session=abc"},
+		"Accept-Encoding":     {"gzip"},
+		"X-Forwarded-For":     {"10.0.0.1"},
+		"Connection":          {"keep-alive, X-Grafana-Device-Id"},
+		"X-Grafana-Device-Id": {"abc"},
+		"Keep-Alive":          {"timeout=5"},
+		"Te":                  {"trailers"},
+	}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		expected http.Header
+	}{
+		{
+			name:   "default allowlist",
+			policy: &Policy{},
+			expected: http.Header{
+				"Accept":           {"application/json"},
+				"User-Agent":       {"Grafana/11.0.0"},
+				"X-Grafana-Org-Id": {"1"},
+				"Traceparent":      {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+				"X-Panel-Id":       {"4"},
+			},
+		},
+		{
+			name:   "extra allowed and denied headers",
+			policy: &Policy{Allow: []string{"x-custom", "Authorization", "X-Forwarded-*"}, Deny: []string{"X-Grafana-*", "User-Agent"}},
+			expected: http.Header{
+				"Accept":      {"application/json"},
+				"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+				"X-Panel-Id":  {"4"},
+				"X-Custom":    {"a", "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dst := make(http.Header)
+			tt.policy.ForwardRequest(dst, src)
+			assert.Equal(t, tt.expected, dst)
+		})
+	}
+}
+
+func TestPolicyKey(t *testing.T) {
+	t.Parallel()
+	policy := &Policy{Allow: []string{"X-Scope-OrgID", "X-Custom-*", "User-Agent"}, Deny: []string{"X-Custom-Denied"}}
+
+	key := policy.Key(http.Header{
+		"X-Scope-Orgid":   {"tenant-1"},
+		"X-Custom-B":      {"b1", "b2"},
+		"X-Custom-A":      {"a"},
+		"X-Custom-Denied": {"d"},
+		"User-Agent":      {"Grafana/11.0.0"},
+		"Traceparent":     {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"Authorization":   {"Bearer caller-token"},
+	})
+	// Headers of the default allowlist vary per request, so are not part of the key
+	assert.Equal(t, "X-Custom-A\x00a\nX-Custom-B\x00b1\x00b2\nX-Scope-Orgid\x00tenant-1\n", key)
+	assert.NotEqual(t, key, policy.Key(http.Header{"X-Scope-Orgid": {"tenant-2"}, "X-Custom-B": {"b1", "b2"}, "X-Custom-A": {"a"}}))
+	assert.Empty(t, (&Policy{}).Key(http.Header{"X-Scope-Orgid": {"tenant-1"}}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	req.Header.Set("X-Scope-OrgID", "tenant-1")
+	assert.Empty(t, RequestKey(req))
+	req = req.WithContext(WithPolicy(req.Context(), policy))
+	assert.Equal(t, "X-Scope-Orgid\x00tenant-1\n", RequestKey(req))
+}
+
+func TestForwardResponse(t *testing.T) {
+	t.Parallel()
+	dst := http.Header{"X-Existing": {"1"}}
+	ForwardResponse(dst, http.Header{
+		"Content-Type":       {"application/json"},
+		"Vary":               {"Origin", "Accept-Encoding"},
+		"Connection":         {"close, X-Hop"},
+		"X-Hop":              {"1"},
+		"Transfer-Encoding":  {"chunked"},
+		"Proxy-Authenticate": {"Basic"},
+	})
+
+	assert.Equal(t, http.Header{
+		"X-Existing":   {"1"},
+		"Content-Type": {"application/json"},
+		"Vary":         {"Origin", "Accept-Encoding"},
+	}, dst)
+}
+
+func TestMatchAny(t *testing.T) {
+	t.Parallel()
+	names := []string{"X-Grafana-*", "Accept"}
+	assert.True(t, matchAny(names, "x-grafana-org-id"))
+	assert.True(t, matchAny(names, "ACCEPT"))
+	assert.False(t, matchAny(names, "Accept-Language"))
+	assert.False(t, matchAny(names, "X-Grafan"))
+}
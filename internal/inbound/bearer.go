@@ -0,0 +1,126 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var errUnknownBearerToken = errors.New("unknown bearer token")
+
+// BearerAuthenticator accepts static bearer tokens read from a file in the
+// Kubernetes static token format, one `token,user,uid,"group1,group2"` entry
+// per line, where uid and groups are optional. The file is re-read whenever it
+// changes, and the last valid tokens are kept if it becomes unreadable
+type BearerAuthenticator struct {
+	TokenFile string
+
+	file   *filewatch.File
+	logger *logger.Logger
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]*Identity
+}
+
+// Performs the initial read of the token file
+func (ba *BearerAuthenticator) Init(logger *logger.Logger) error {
+	ba.logger = logger
+	ba.file = filewatch.New(ba.TokenFile)
+	_, err := ba.load()
+	return err
+}
+
+// Verifies the bearer token in the Authorization header
+func (ba *BearerAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	tokens, err := ba.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens are looked up by hash, so lookup timing reveals nothing about them
+	identity, ok := tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errUnknownBearerToken
+	}
+	return identity, nil
+}
+
+// Advertises bearer authentication
+func (ba *BearerAuthenticator) Challenge() string {
+	return `Bearer realm="prometheus-proxy"`
+}
+
+// Returns the tokens, re-reading the file if it has changed
+func (ba *BearerAuthenticator) load() (map[[sha256.Size]byte]*Identity, error) {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	data, changed, err := ba.file.Read()
+	if err != nil {
+		if ba.tokens == nil {
+			return nil, fmt.Errorf("failed to read bearer token file: %w", err)
+		}
+		ba.logger.Warn("failed to re-read bearer token file, using last known tokens", "path", ba.file.Path, "error", err)
+		return ba.tokens, nil
+	}
+	if ba.tokens != nil && !changed {
+		return ba.tokens, nil
+	}
+
+	tokens, err := parseTokenFile(data)
+	if err != nil {
+		if ba.tokens == nil {
+			return nil, err
+		}
+		ba.logger.Warn("failed to parse bearer token file, using last known tokens", "path", ba.file.Path, "error", err)
+		return ba.tokens, nil
+	}
+
+	ba.logger.Info("loaded bearer token file", "path", ba.file.Path, "tokens", len(tokens))
+	ba.tokens = tokens
+	return tokens, nil
+}
+
+// Parses a Kubernetes static token file
+func parseTokenFile(data []byte) (map[[sha256.Size]byte]*Identity, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	tokens := make(map[[sha256.Size]byte]*Identity)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bearer token file: %w", err)
+		}
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("failed to parse bearer token file: line %d must contain a token and user", line)
+		}
+
+		identity := &Identity{Name: record[1], Method: "bearer"}
+		if len(record) > 3 && record[3] != "" {
+			identity.Groups = strings.Split(record[3], ",")
+		}
+		tokens[sha256.Sum256([]byte(record[0]))] = identity
+	}
+	return tokens, nil
+}
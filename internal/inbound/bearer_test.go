@@ -0,0 +1,70 @@
+package inbound
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerAuthenticator(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testutil.WriteFile(t, dir, "tokens.csv", []byte(`# token,user,uid,groups
+grafana-token,grafana,1001,"dashboards,viewers"
+kiali-token,kiali
+`))
+
+	ba := &BearerAuthenticator{TokenFile: path}
+	require.NoError(t, ba.Init(testutil.CreateTestLogger(t)))
+
+	authenticate := func(header string) (*Identity, error) {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		return ba.Authenticate(req)
+	}
+
+	identity, err := authenticate("Bearer grafana-token")
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{Name: "grafana", Groups: []string{"dashboards", "viewers"}, Method: "bearer"}, identity)
+
+	identity, err = authenticate("Bearer kiali-token")
+	require.NoError(t, err)
+	assert.Equal(t, "kiali", identity.Name)
+
+	_, err = authenticate("Bearer unknown")
+	assert.Equal(t, errUnknownBearerToken, err)
+
+	_, err = authenticate("")
+	assert.Equal(t, ErrNoCredentials, err)
+
+	// Tokens are reloaded when the file changes
+	testutil.WriteFile(t, dir, "tokens.csv", []byte("rotated-token,grafana\n"))
+	_, err = authenticate("Bearer grafana-token")
+	assert.Equal(t, errUnknownBearerToken, err)
+	identity, err = authenticate("Bearer rotated-token")
+	require.NoError(t, err)
+	assert.Equal(t, "grafana", identity.Name)
+
+	// An invalid file keeps the last known tokens
+	testutil.WriteFile(t, dir, "tokens.csv", []byte("missing-user\n"))
+	_, err = authenticate("Bearer rotated-token")
+	assert.NoError(t, err)
+}
+
+func TestBearerAuthenticator_InitErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	err := (&BearerAuthenticator{TokenFile: filepath.Join(dir, "missing")}).Init(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to read bearer token file")
+
+	path := testutil.WriteFile(t, dir, "tokens.csv", []byte("token-only\n"))
+	err = (&BearerAuthenticator{TokenFile: path}).Init(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "line 1 must contain a token and user")
+}
@@ -0,0 +1,195 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUnknownUser       = errors.New("unknown basic auth user")
+	errIncorrectPassword = errors.New("incorrect basic auth password")
+	errUnsupportedHash   = errors.New("unsupported htpasswd hash, use bcrypt, apr1 or sha")
+)
+
+// HtpasswdAuthenticator accepts HTTP basic auth credentials verified against
+// an Apache htpasswd file with bcrypt, apr1 (MD5) or SHA hashes. The file is
+// re-read whenever it changes, and the last valid users are kept if it
+// becomes unreadable
+type HtpasswdAuthenticator struct {
+	File string
+
+	file   *filewatch.File
+	logger *logger.Logger
+
+	mu    sync.Mutex
+	users map[string]string
+}
+
+// Performs the initial read of the htpasswd file
+func (ha *HtpasswdAuthenticator) Init(logger *logger.Logger) error {
+	ha.logger = logger
+	ha.file = filewatch.New(ha.File)
+	_, err := ha.load()
+	return err
+}
+
+// Verifies the basic auth credentials in the Authorization header
+func (ha *HtpasswdAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	users, err := ha.load()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := users[username]
+	if !ok {
+		return nil, errUnknownUser
+	}
+	if err := verifyHtpasswd(hash, password); err != nil {
+		return nil, err
+	}
+	return &Identity{Name: username, Method: "htpasswd"}, nil
+}
+
+// Advertises basic authentication
+func (ha *HtpasswdAuthenticator) Challenge() string {
+	return `Basic realm="prometheus-proxy"`
+}
+
+// Returns the users, re-reading the file if it has changed
+func (ha *HtpasswdAuthenticator) load() (map[string]string, error) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	data, changed, err := ha.file.Read()
+	if err != nil {
+		if ha.users == nil {
+			return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+		}
+		ha.logger.Warn("failed to re-read htpasswd file, using last known users", "path", ha.file.Path, "error", err)
+		return ha.users, nil
+	}
+	if ha.users != nil && !changed {
+		return ha.users, nil
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		users[username] = hash
+	}
+
+	ha.logger.Info("loaded htpasswd file", "path", ha.file.Path, "users", len(users))
+	ha.users = users
+	return users, nil
+}
+
+// Verifies a password against an htpasswd hash
+func verifyHtpasswd(hash, password string) error {
+	var expected, actual []byte
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return errIncorrectPassword
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		expected, actual = []byte(hash), []byte(apr1(password, salt))
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected, actual = []byte(hash), []byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return errUnsupportedHash
+	}
+
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return errIncorrectPassword
+	}
+	return nil
+}
+
+// Computes the Apache variant of the MD5 crypt hash
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for range n {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return out.String()
+}
@@ -0,0 +1,80 @@
+package inbound
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApr1(t *testing.T) {
+	t.Parallel()
+	// Generated with openssl passwd -apr1
+	assert.Equal(t, "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", apr1("password", "saltsalt"))
+	assert.Equal(t, "$apr1$r31.....$Fo17C32hnAa5w9qaF8gaB.", apr1("prometheus", "r31....."))
+}
+
+func TestVerifyHtpasswd(t *testing.T) {
+	t.Parallel()
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		expected error
+	}{
+		{name: "bcrypt", hash: string(bcryptHash), password: "password"},
+		{name: "bcrypt incorrect", hash: string(bcryptHash), password: "wrong", expected: errIncorrectPassword},
+		{name: "apr1", hash: "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", password: "password"},
+		{name: "apr1 incorrect", hash: "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", password: "wrong", expected: errIncorrectPassword},
+		// base64(sha1("password"))
+		{name: "sha", hash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", password: "password"},
+		{name: "sha incorrect", hash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", password: "wrong", expected: errIncorrectPassword},
+		{name: "plain text", hash: "password", password: "password", expected: errUnsupportedHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, verifyHtpasswd(tt.hash, tt.password))
+		})
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testutil.WriteFile(t, dir, ".htpasswd", []byte("# users\ngrafana:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"))
+
+	ha := &HtpasswdAuthenticator{File: path}
+	require.NoError(t, ha.Init(testutil.CreateTestLogger(t)))
+	assert.Equal(t, `Basic realm="prometheus-proxy"`, ha.Challenge())
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+	_, err := ha.Authenticate(req)
+	assert.Equal(t, ErrNoCredentials, err)
+
+	req.SetBasicAuth("grafana", "password")
+	identity, err := ha.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{Name: "grafana", Method: "htpasswd"}, identity)
+
+	req.SetBasicAuth("grafana", "wrong")
+	_, err = ha.Authenticate(req)
+	assert.Equal(t, errIncorrectPassword, err)
+
+	req.SetBasicAuth("kiali", "password")
+	_, err = ha.Authenticate(req)
+	assert.Equal(t, errUnknownUser, err)
+
+	// Users are reloaded when the file changes
+	testutil.WriteFile(t, dir, ".htpasswd", []byte("kiali:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	identity, err = ha.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "kiali", identity.Name)
+}
@@ -0,0 +1,145 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+)
+
+var (
+	// Returned by authenticators when the request carries no credentials
+	// they understand, so the next authenticator is tried
+	ErrNoCredentials = errors.New("no credentials provided")
+
+	errAuthenticationRequired = errors.New("authentication required")
+	errInvalidCredentials     = errors.New("invalid credentials")
+)
+
+// Identity describes an authenticated caller of the proxy
+type Identity struct {
+	// The user, service account or certificate common name
+	Name   string
+	Groups []string
+	// The authenticator which verified the caller, e.g. "bearer" or "mtls"
+	Method string
+}
+
+// Authenticator verifies the credentials of an inbound request
+type Authenticator interface {
+	// Returns the identity of the caller, ErrNoCredentials if the request
+	// carries no credentials of the supported type, or an error if the
+	// credentials are invalid
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Initialiser is implemented by authenticators which load files or create
+// clients before use
+type Initialiser interface {
+	Init(logger *logger.Logger) error
+}
+
+// Challenger is implemented by authenticators which advertise a
+// WWW-Authenticate challenge on 401 responses
+type Challenger interface {
+	Challenge() string
+}
+
+// Chain tries each authenticator in order, returning the first identity
+type Chain []Authenticator
+
+// Initialises every authenticator in the chain
+func (c Chain) Init(logger *logger.Logger) error {
+	for _, authenticator := range c {
+		if initialiser, ok := authenticator.(Initialiser); ok {
+			if err := initialiser.Init(logger); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the identity from the first authenticator to accept the request
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	var errs []error
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoCredentials
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Returns the challenges of every authenticator in the chain
+func (c Chain) challenges() []string {
+	var challenges []string
+	for _, authenticator := range c {
+		if challenger, ok := authenticator.(Challenger); ok && !slices.Contains(challenges, challenger.Challenge()) {
+			challenges = append(challenges, challenger.Challenge())
+		}
+	}
+	return challenges
+}
+
+type identityKey struct{}
+
+// Returns a copy of the context carrying the caller identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Returns the caller identity stored in the context, if any
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// Middleware authenticates requests before passing them to the next handler,
+// storing the caller identity in the request context. Unauthenticated
+// requests receive a Prometheus-style 401 JSON error
+func Middleware(logger *logger.Logger, authenticators Chain, next http.Handler) http.Handler {
+	challenge := strings.Join(authenticators.challenges(), ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authenticators.Authenticate(r)
+		if err != nil {
+			l := logger.WithRequestFields(r)
+			if challenge != "" {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+
+			if errors.Is(err, ErrNoCredentials) {
+				l.Warn("rejected unauthenticated request")
+				promapi.WriteError(w, http.StatusUnauthorized, promapi.ErrorUnauthorized, errAuthenticationRequired)
+				return
+			}
+			l.Warn("rejected request with invalid credentials", "error", err)
+			promapi.WriteError(w, http.StatusUnauthorized, promapi.ErrorUnauthorized, errInvalidCredentials)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
+
+// Returns the bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,140 @@
+package inbound
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Accepts requests carrying a fixed X-Test-User header
+type fakeAuthenticator struct {
+	user string
+}
+
+func (f *fakeAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	user := r.Header.Get("X-Test-User")
+	switch user {
+	case "":
+		return nil, ErrNoCredentials
+	case f.user:
+		return &Identity{Name: user, Method: "fake"}, nil
+	default:
+		return nil, errors.New("unknown test user")
+	}
+}
+
+func (f *fakeAuthenticator) Challenge() string {
+	return `Test realm="prometheus-proxy"`
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	handler := Middleware(testutil.CreateTestLogger(t), Chain{&fakeAuthenticator{user: "alice"}, &ClientCertAuthenticator{}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := IdentityFromContext(r.Context())
+			require.True(t, ok)
+			w.Write([]byte(identity.Name))
+		}))
+
+	tests := []struct {
+		name         string
+		user         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "authenticated",
+			user:         "alice",
+			expectedCode: http.StatusOK,
+			expectedBody: "alice",
+		},
+		{
+			name:         "no credentials",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"status":"error","errorType":"unauthorized","error":"authentication required"}`,
+		},
+		{
+			name:         "invalid credentials",
+			user:         "mallory",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"status":"error","errorType":"unauthorized","error":"invalid credentials"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query?query=up", nil)
+			if tt.user != "" {
+				req.Header.Set("X-Test-User", tt.user)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode == http.StatusOK {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+				return
+			}
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			assert.Equal(t, `Test realm="prometheus-proxy"`, w.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+	chain := Chain{&fakeAuthenticator{user: "alice"}, &fakeAuthenticator{user: "bob"}}
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/", nil)
+	_, err := chain.Authenticate(req)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	// Credentials rejected by one authenticator may be accepted by the next
+	req.Header.Set("X-Test-User", "bob")
+	identity, err := chain.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", identity.Name)
+
+	req.Header.Set("X-Test-User", "mallory")
+	_, err = chain.Authenticate(req)
+	assert.ErrorContains(t, err, "unknown test user")
+	assert.NotErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		header   string
+		expected string
+		ok       bool
+	}{
+		{header: "Bearer abc", expected: "abc", ok: true},
+		{header: "bearer  abc ", expected: "abc", ok: true},
+		{header: "Basic dXNlcjpwYXNz"},
+		{header: "Bearer "},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", tt.header)
+		token, ok := bearerToken(req)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.expected, token, tt.header)
+	}
+}
+
+func TestChainInit(t *testing.T) {
+	t.Parallel()
+	chain := Chain{&ClientCertAuthenticator{}, &HtpasswdAuthenticator{File: "/missing/.htpasswd"}}
+
+	err := chain.Init(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to read htpasswd file")
+}
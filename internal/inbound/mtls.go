@@ -0,0 +1,35 @@
+package inbound
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+)
+
+var errClientCertNotAllowed = errors.New("client certificate common name is not allowed")
+
+// ClientCertAuthenticator accepts callers presenting a client certificate
+// verified during the TLS handshake against the listener's client CA. The
+// identity is the certificate common name, with its organizations as groups
+type ClientCertAuthenticator struct {
+	// Restricts the accepted common names, any verified certificate is accepted if empty
+	AllowedNames []string
+}
+
+// Returns the identity from the verified client certificate
+func (ca *ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(ca.AllowedNames) > 0 && !slices.Contains(ca.AllowedNames, cert.Subject.CommonName) {
+		return nil, errClientCertNotAllowed
+	}
+
+	return &Identity{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.Organization,
+		Method: "mtls",
+	}, nil
+}
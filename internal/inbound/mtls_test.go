@@ -0,0 +1,73 @@
+package inbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertAuthenticator(t *testing.T) {
+	t.Parallel()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "grafana", Organization: []string{"observability"}}}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	tests := []struct {
+		name          string
+		authenticator *ClientCertAuthenticator
+		state         *tls.ConnectionState
+		expected      *Identity
+		expectedErr   error
+	}{
+		{
+			name:          "verified certificate",
+			authenticator: &ClientCertAuthenticator{},
+			state:         verified,
+			expected:      &Identity{Name: "grafana", Groups: []string{"observability"}, Method: "mtls"},
+		},
+		{
+			name:          "allowed common name",
+			authenticator: &ClientCertAuthenticator{AllowedNames: []string{"kiali", "grafana"}},
+			state:         verified,
+			expected:      &Identity{Name: "grafana", Groups: []string{"observability"}, Method: "mtls"},
+		},
+		{
+			name:          "disallowed common name",
+			authenticator: &ClientCertAuthenticator{AllowedNames: []string{"kiali"}},
+			state:         verified,
+			expectedErr:   errClientCertNotAllowed,
+		},
+		{
+			name:          "no client certificate",
+			authenticator: &ClientCertAuthenticator{},
+			state:         &tls.ConnectionState{},
+			expectedErr:   ErrNoCredentials,
+		},
+		{
+			name:          "plain http",
+			authenticator: &ClientCertAuthenticator{},
+			expectedErr:   ErrNoCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+			req.TLS = tt.state
+
+			identity, err := tt.authenticator.Authenticate(req)
+			if tt.expectedErr != nil {
+				assert.Equal(t, tt.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, identity)
+		})
+	}
+}
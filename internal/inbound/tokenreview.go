@@ -0,0 +1,280 @@
+package inbound
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+)
+
+var (
+	errTokenNotAuthenticated = errors.New("token was not authenticated by the kubernetes api server")
+	errNoAPIServer           = errors.New("kubernetes api server url is unset and KUBERNETES_SERVICE_HOST is not available")
+
+	tokenReviewPath            = "/apis/authentication.k8s.io/v1/tokenreviews"
+	serviceAccountTokenFile    = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile       = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	tokenReviewDefaultCacheTTL = time.Minute
+	// The most reviews cached, evicting the oldest once full. Rejected tokens
+	// are chosen by callers, so they have their own smaller cache which cannot
+	// evict the reviews of authenticated callers
+	tokenReviewMaxCacheEntries    = 10000
+	tokenReviewMaxRejectedEntries = 1000
+)
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string   `json:"username"`
+		Groups   []string `json:"groups"`
+	} `json:"user"`
+	Error string `json:"error"`
+}
+
+type cachedReview struct {
+	key      [sha256.Size]byte
+	identity *Identity
+	err      error
+	expires  time.Time
+}
+
+// reviewCache holds at most maxEntries reviews. Every review is cached for the same
+// TTL, so the oldest review is evicted first
+type reviewCache struct {
+	maxEntries int
+	order      *list.List
+	entries    map[[sha256.Size]byte]*list.Element
+}
+
+func newReviewCache(maxEntries int) *reviewCache {
+	return &reviewCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// Returns the review of the token if it has not expired
+func (c *reviewCache) get(key [sha256.Size]byte) (*cachedReview, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	review := element.Value.(*cachedReview)
+	if !time.Now().Before(review.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	return review, true
+}
+
+// Stores a review, evicting expired reviews and then the oldest to make room
+func (c *reviewCache) add(review *cachedReview) {
+	if element, ok := c.entries[review.key]; ok {
+		c.remove(element)
+	}
+	now := time.Now()
+	for oldest := c.order.Front(); oldest != nil; oldest = c.order.Front() {
+		if len(c.entries) < c.maxEntries && now.Before(oldest.Value.(*cachedReview).expires) {
+			break
+		}
+		c.remove(oldest)
+	}
+	c.entries[review.key] = c.order.PushBack(review)
+}
+
+func (c *reviewCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cachedReview).key)
+}
+
+// TokenReviewAuthenticator validates bearer tokens, typically Kubernetes
+// ServiceAccount tokens, with the Kubernetes TokenReview API. Review results
+// are cached to limit load on the API server
+type TokenReviewAuthenticator struct {
+	// Defaults to the in-cluster API server
+	APIServerURL string
+	// The token used to call the API server, defaults to the pod's ServiceAccount token
+	TokenFile string
+	// The CA used to verify the API server, defaults to the in-cluster CA
+	CAFile string
+	// Audiences the token must be valid for, the API server's default if empty
+	Audiences []string
+	CacheTTL  time.Duration
+
+	logger     *logger.Logger
+	token      *filewatch.File
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	reviews  *reviewCache
+	rejected *reviewCache
+}
+
+// Resolves the in-cluster defaults and creates the API server client
+func (ta *TokenReviewAuthenticator) Init(logger *logger.Logger) error {
+	ta.logger = logger
+	if ta.APIServerURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errNoAPIServer
+		}
+		ta.APIServerURL = "https://" + net.JoinHostPort(host, port)
+	}
+	ta.APIServerURL = strings.TrimSuffix(ta.APIServerURL, "/")
+	if ta.TokenFile == "" {
+		ta.TokenFile = serviceAccountTokenFile
+	}
+	if ta.CAFile == "" {
+		ta.CAFile = serviceAccountCAFile
+	}
+	if ta.CacheTTL <= 0 {
+		ta.CacheTTL = tokenReviewDefaultCacheTTL
+	}
+	ta.token = filewatch.New(ta.TokenFile)
+	ta.reviews = newReviewCache(tokenReviewMaxCacheEntries)
+	ta.rejected = newReviewCache(tokenReviewMaxRejectedEntries)
+
+	if ta.httpClient == nil {
+		apiServer, err := url.Parse(ta.APIServerURL)
+		if err != nil {
+			return fmt.Errorf("invalid api server url %q: %w", ta.APIServerURL, err)
+		}
+		// The certificate is verified against the API server host, which is
+		// usually the IP address of the kubernetes service
+		tlsConfig, err := (&tlsconfig.Config{CAFile: ta.CAFile, ServerName: apiServer.Hostname()}).NewTLSConfig(logger)
+		if err != nil {
+			return err
+		}
+		ta.httpClient = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+
+	logger.Info("using kubernetes token review for inbound authentication", "api_server", ta.APIServerURL, "audiences", ta.Audiences)
+	return nil
+}
+
+// Validates the bearer token in the Authorization header
+func (ta *TokenReviewAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	key := sha256.Sum256([]byte(token))
+	ta.mu.Lock()
+	cached, ok := ta.reviews.get(key)
+	if !ok {
+		cached, ok = ta.rejected.get(key)
+	}
+	ta.mu.Unlock()
+	if ok {
+		return cached.identity, cached.err
+	}
+
+	identity, err := ta.review(r, token)
+	if err != nil && !errors.Is(err, errTokenNotAuthenticated) {
+		// Failures to reach the API server are not cached
+		return nil, err
+	}
+
+	review := &cachedReview{key: key, identity: identity, err: err, expires: time.Now().Add(ta.CacheTTL)}
+	ta.mu.Lock()
+	if err != nil {
+		ta.rejected.add(review)
+	} else {
+		ta.reviews.add(review)
+	}
+	ta.mu.Unlock()
+
+	return identity, err
+}
+
+// Advertises bearer authentication
+func (ta *TokenReviewAuthenticator) Challenge() string {
+	return `Bearer realm="prometheus-proxy"`
+}
+
+// Submits a TokenReview for the token to the API server
+func (ta *TokenReviewAuthenticator) review(r *http.Request, token string) (*Identity, error) {
+	data, _, err := ta.token.Read()
+	if data == nil {
+		return nil, fmt.Errorf("failed to read kubernetes service account token: %w", err)
+	}
+
+	body, err := json.Marshal(&tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: ta.Audiences},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, ta.APIServerURL+tokenReviewPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(data)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ta.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call kubernetes token review api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("kubernetes token review api returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var review tokenReview
+	if err := json.Unmarshal(respBody, &review); err != nil {
+		return nil, fmt.Errorf("failed to decode token review: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, fmt.Errorf("%w: %s", errTokenNotAuthenticated, review.Status.Error)
+		}
+		return nil, errTokenNotAuthenticated
+	}
+
+	return &Identity{
+		Name:   review.Status.User.Username,
+		Groups: review.Status.User.Groups,
+		Method: "tokenreview",
+	}, nil
+}
@@ -0,0 +1,182 @@
+package inbound
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a fake Kubernetes API server which authenticates "valid-token" as a
+// ServiceAccount, returning the server and a counter of token reviews
+func newFakeAPIServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var reviews atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tokenReviewPath || r.Header.Get("Authorization") != "Bearer proxy-sa-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reviews.Add(1)
+
+		var review tokenReview
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		assert.Equal(t, "TokenReview", review.Kind)
+		assert.Equal(t, []string{"prometheus-proxy"}, review.Spec.Audiences)
+
+		review.Status.Authenticated = review.Spec.Token == "valid-token"
+		if review.Status.Authenticated {
+			review.Status.User.Username = "system:serviceaccount:monitoring:grafana"
+			review.Status.User.Groups = []string{"system:serviceaccounts", "system:serviceaccounts:monitoring"}
+		} else {
+			review.Status.Error = "token has expired"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&review)
+	}))
+	t.Cleanup(server.Close)
+	return server, &reviews
+}
+
+func TestTokenReviewAuthenticator(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	server, reviews := newFakeAPIServer(t)
+
+	ta := &TokenReviewAuthenticator{
+		APIServerURL: server.URL,
+		TokenFile:    testutil.WriteFile(t, dir, "token", []byte("proxy-sa-token\n")),
+		CAFile:       testutil.WriteFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+		Audiences:    []string{"prometheus-proxy"},
+	}
+	require.NoError(t, ta.Init(testutil.CreateTestLogger(t)))
+
+	authenticate := func(token string) (*Identity, error) {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return ta.Authenticate(req)
+	}
+
+	for range 3 {
+		identity, err := authenticate("valid-token")
+		require.NoError(t, err)
+		assert.Equal(t, &Identity{
+			Name:   "system:serviceaccount:monitoring:grafana",
+			Groups: []string{"system:serviceaccounts", "system:serviceaccounts:monitoring"},
+			Method: "tokenreview",
+		}, identity)
+	}
+	assert.Equal(t, int32(1), reviews.Load())
+
+	// Rejected tokens are cached too
+	for range 2 {
+		_, err := authenticate("expired-token")
+		assert.ErrorIs(t, err, errTokenNotAuthenticated)
+		assert.ErrorContains(t, err, "token has expired")
+	}
+	assert.Equal(t, int32(2), reviews.Load())
+
+	_, err := authenticate("")
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestTokenReviewAuthenticator_BoundedCache(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	server, reviews := newFakeAPIServer(t)
+
+	ta := &TokenReviewAuthenticator{
+		APIServerURL: server.URL,
+		TokenFile:    testutil.WriteFile(t, dir, "token", []byte("proxy-sa-token")),
+		CAFile:       testutil.WriteFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+		Audiences:    []string{"prometheus-proxy"},
+	}
+	require.NoError(t, ta.Init(testutil.CreateTestLogger(t)))
+	ta.rejected = newReviewCache(2)
+
+	authenticate := func(token string) error {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := ta.Authenticate(req)
+		return err
+	}
+
+	require.NoError(t, authenticate("valid-token"))
+	// Random tokens neither grow the cache beyond its size nor evict the
+	// reviews of authenticated callers
+	for i := range 10 {
+		assert.ErrorIs(t, authenticate(fmt.Sprintf("random-%d", i)), errTokenNotAuthenticated)
+	}
+	assert.Len(t, ta.rejected.entries, 2)
+	assert.Equal(t, 1, ta.reviews.order.Len())
+
+	require.NoError(t, authenticate("valid-token"))
+	assert.Equal(t, int32(11), reviews.Load())
+}
+
+func TestReviewCache(t *testing.T) {
+	t.Parallel()
+	cache := newReviewCache(2)
+	review := func(token string, ttl time.Duration) *cachedReview {
+		return &cachedReview{key: sha256.Sum256([]byte(token)), expires: time.Now().Add(ttl)}
+	}
+
+	cache.add(review("a", time.Minute))
+	cache.add(review("b", time.Minute))
+	cache.add(review("c", time.Minute))
+	_, ok := cache.get(sha256.Sum256([]byte("a")))
+	assert.False(t, ok, "the oldest review is evicted once full")
+	_, ok = cache.get(sha256.Sum256([]byte("c")))
+	assert.True(t, ok)
+
+	cache.add(review("b", -time.Second))
+	_, ok = cache.get(sha256.Sum256([]byte("b")))
+	assert.False(t, ok, "expired reviews are not returned")
+	assert.Equal(t, 1, cache.order.Len())
+	assert.Len(t, cache.entries, 1)
+}
+
+func TestTokenReviewAuthenticator_APIServerErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	server, reviews := newFakeAPIServer(t)
+
+	ta := &TokenReviewAuthenticator{
+		APIServerURL: server.URL,
+		TokenFile:    testutil.WriteFile(t, dir, "token", []byte("wrong-sa-token")),
+		CAFile:       testutil.WriteFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	}
+	require.NoError(t, ta.Init(testutil.CreateTestLogger(t)))
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer valid-token")
+	_, err := ta.Authenticate(req)
+	assert.ErrorContains(t, err, "kubernetes token review api returned status 403")
+
+	// API server failures are not cached, so a fixed token is used immediately
+	testutil.WriteFile(t, dir, "token", []byte("proxy-sa-token"))
+	ta.Audiences = []string{"prometheus-proxy"}
+	_, err = ta.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), reviews.Load())
+}
+
+func TestTokenReviewAuthenticator_InClusterDefaults(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	err := (&TokenReviewAuthenticator{}).Init(testutil.CreateTestLogger(t))
+	assert.Equal(t, errNoAPIServer, err)
+}
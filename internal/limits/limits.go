@@ -0,0 +1,166 @@
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+)
+
+var errEndBeforeStart = errors.New("end timestamp must not be before start time")
+
+// Limits restricts the cost of queries before they are forwarded. Zero values
+// disable a limit
+type Limits struct {
+	// The longest time range of a range query
+	MaxRange time.Duration
+	// The most points per series a range query may return, (end-start)/step+1
+	MaxPoints int
+	// The smallest step of a range query
+	MinStep time.Duration
+	// The longest range selector or subquery of a query
+	MaxLookback time.Duration
+	// Clamps range queries exceeding the range, points or step limits to them,
+	// rather than rejecting the request. Lookback is always rejected, as
+	// shortening a range selector changes what the query computes
+	Clamp bool
+}
+
+// Reports whether any limit is set
+func (l *Limits) IsSet() bool {
+	return l != nil && (l.MaxRange > 0 || l.MaxPoints > 0 || l.MinStep > 0 || l.MaxLookback > 0)
+}
+
+// Middleware enforces the limits on query and query_range requests, rejecting
+// offending requests with a bad_data error or clamping them to the limits
+func (l *Limits) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" && r.URL.Path != "/api/v1/query_range" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqLogger := logger.WithRequestFields(r)
+		params, err := promapi.RequestParams(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+
+		if err := l.checkLookback(params.Get(promapi.ParamQuery)); err != nil {
+			reqLogger.Warn("rejected query exceeding limits", "error", err)
+			promapi.WriteError(w, http.StatusBadRequest, promapi.ErrorBadData, err)
+			return
+		}
+
+		if r.URL.Path == "/api/v1/query_range" {
+			clamped, err := l.limitRange(params)
+			if err != nil {
+				reqLogger.Warn("rejected query exceeding limits", "error", err)
+				promapi.WriteError(w, http.StatusBadRequest, promapi.ErrorBadData, err)
+				return
+			}
+			if len(clamped) > 0 {
+				reqLogger.Info("clamped query to limits", "clamped", clamped,
+					"start", params.Get("start"), "end", params.Get("end"), "step", params.Get("step"))
+				promapi.SetRequestParams(r, params)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns an error if a range selector or subquery of the query looks back
+// further than allowed
+func (l *Limits) checkLookback(query string) error {
+	if l.MaxLookback <= 0 || query == "" {
+		return nil
+	}
+	parsed, err := promql.Parse(query)
+	if err != nil {
+		return fmt.Errorf("failed to parse query: %w", err)
+	}
+	for _, lookback := range parsed.Ranges {
+		if lookback > l.MaxLookback {
+			return fmt.Errorf("range of %s exceeds the maximum lookback of %s", lookback, l.MaxLookback)
+		}
+	}
+	return nil
+}
+
+// Applies the range, step and points limits to the parameters of a range
+// query, returning the names of the limits it was clamped to, or an error if
+// it exceeds them and clamping is disabled
+func (l *Limits) limitRange(params url.Values) ([]string, error) {
+	// Incomplete requests are left for Prometheus to reject
+	if params.Get("start") == "" || params.Get("end") == "" || params.Get("step") == "" {
+		return nil, nil
+	}
+	start, err := promapi.ParseTime(params.Get("start"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter \"start\": %w", err)
+	}
+	end, err := promapi.ParseTime(params.Get("end"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter \"end\": %w", err)
+	}
+	step, err := promql.ParseDuration(params.Get("step"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter \"step\": %w", err)
+	}
+	if end.Before(start) {
+		return nil, errEndBeforeStart
+	}
+
+	var clamped []string
+	if l.MinStep > 0 && step < l.MinStep {
+		if !l.Clamp {
+			return nil, fmt.Errorf("step of %s is below the minimum of %s, increase the step", step, l.MinStep)
+		}
+		step = l.MinStep
+		clamped = append(clamped, "min_step")
+	}
+
+	if l.MaxRange > 0 && end.Sub(start) > l.MaxRange {
+		if !l.Clamp {
+			return nil, fmt.Errorf("query range of %s exceeds the maximum of %s, shorten the time range", end.Sub(start), l.MaxRange)
+		}
+		// The most recent data is kept, as dashboards usually end at now
+		start = end.Add(-l.MaxRange)
+		clamped = append(clamped, "max_range")
+	}
+
+	if l.MaxPoints > 0 && step > 0 {
+		if points := int64(end.Sub(start)/step) + 1; points > int64(l.MaxPoints) {
+			if !l.Clamp {
+				return nil, fmt.Errorf("query would return %d points per series, exceeding the maximum of %d, increase the step", points, l.MaxPoints)
+			}
+			step = minStepForPoints(end.Sub(start), l.MaxPoints)
+			clamped = append(clamped, "max_points")
+		}
+	}
+
+	if len(clamped) > 0 {
+		params.Set("start", promapi.FormatTime(start))
+		params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+	}
+	return clamped, nil
+}
+
+// Returns the smallest whole-second step returning at most maxPoints points
+// over the duration, where maxPoints is at least 2
+func minStepForPoints(duration time.Duration, maxPoints int) time.Duration {
+	step := time.Duration(math.Ceil(float64(duration) / float64(maxPoints-1)))
+	if rounded := step.Truncate(time.Second); rounded < step {
+		step = rounded + time.Second
+	}
+	return step
+}
@@ -0,0 +1,165 @@
+package limits
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitRange(t *testing.T) {
+	t.Parallel()
+	limits := &Limits{MaxRange: 7 * 24 * time.Hour, MaxPoints: 11000, MinStep: 30 * time.Second}
+	clamping := *limits
+	clamping.Clamp = true
+
+	tests := []struct {
+		name            string
+		limits          *Limits
+		params          url.Values
+		expectedErr     string
+		expectedClamped []string
+		expectedParams  url.Values
+	}{
+		{
+			name:           "within limits",
+			limits:         limits,
+			params:         url.Values{"start": {"1700000000"}, "end": {"1700003600"}, "step": {"60"}},
+			expectedParams: url.Values{"start": {"1700000000"}, "end": {"1700003600"}, "step": {"60"}},
+		},
+		{
+			name:           "rfc3339 and duration step",
+			limits:         limits,
+			params:         url.Values{"start": {"2026-01-01T00:00:00Z"}, "end": {"2026-01-02T00:00:00.5Z"}, "step": {"1m"}},
+			expectedParams: url.Values{"start": {"2026-01-01T00:00:00Z"}, "end": {"2026-01-02T00:00:00.5Z"}, "step": {"1m"}},
+		},
+		{
+			name:        "range too long",
+			limits:      limits,
+			params:      url.Values{"start": {"1700000000"}, "end": {"1701000000"}, "step": {"3600"}},
+			expectedErr: "query range of 277h46m40s exceeds the maximum of 168h0m0s",
+		},
+		{
+			name:        "step too small",
+			limits:      limits,
+			params:      url.Values{"start": {"1700000000"}, "end": {"1700003600"}, "step": {"15s"}},
+			expectedErr: "step of 15s is below the minimum of 30s",
+		},
+		{
+			name:        "too many points",
+			limits:      limits,
+			params:      url.Values{"start": {"1700000000"}, "end": {"1700604800"}, "step": {"30"}},
+			expectedErr: "query would return 20161 points per series, exceeding the maximum of 11000",
+		},
+		{
+			name:        "end before start",
+			limits:      limits,
+			params:      url.Values{"start": {"1700003600"}, "end": {"1700000000"}, "step": {"60"}},
+			expectedErr: "end timestamp must not be before start time",
+		},
+		{
+			name:        "invalid start",
+			limits:      limits,
+			params:      url.Values{"start": {"yesterday"}, "end": {"1700000000"}, "step": {"60"}},
+			expectedErr: `invalid parameter "start"`,
+		},
+		{
+			name:           "incomplete request",
+			limits:         limits,
+			params:         url.Values{"start": {"1700000000"}},
+			expectedParams: url.Values{"start": {"1700000000"}},
+		},
+		{
+			name:            "clamp range",
+			limits:          &clamping,
+			params:          url.Values{"start": {"1700000000"}, "end": {"1701000000.5"}, "step": {"3600"}},
+			expectedClamped: []string{"max_range"},
+			expectedParams:  url.Values{"start": {"1700395200.5"}, "end": {"1701000000.5"}, "step": {"3600"}},
+		},
+		{
+			name:            "clamp step",
+			limits:          &clamping,
+			params:          url.Values{"start": {"1700000000"}, "end": {"1700003600"}, "step": {"15s"}},
+			expectedClamped: []string{"min_step"},
+			expectedParams:  url.Values{"start": {"1700000000"}, "end": {"1700003600"}, "step": {"30"}},
+		},
+		{
+			name:            "clamp points",
+			limits:          &clamping,
+			params:          url.Values{"start": {"1700000000"}, "end": {"1700604800"}, "step": {"30"}},
+			expectedClamped: []string{"max_points"},
+			expectedParams:  url.Values{"start": {"1700000000"}, "end": {"1700604800"}, "step": {"55"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			clamped, err := tt.limits.limitRange(tt.params)
+			if tt.expectedErr != "" {
+				assert.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedClamped, clamped)
+			assert.Equal(t, tt.expectedParams, tt.params)
+		})
+	}
+}
+
+func TestMinStepForPoints(t *testing.T) {
+	t.Parallel()
+	step := minStepForPoints(7*24*time.Hour, 11000)
+	assert.Equal(t, 55*time.Second, step)
+	assert.LessOrEqual(t, int64(7*24*time.Hour/step)+1, int64(11000))
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	limits := &Limits{MaxLookback: 7 * 24 * time.Hour, MinStep: time.Minute, Clamp: true}
+
+	var forwarded string
+	handler := limits.Middleware(testutil.CreateTestLogger(t), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		forwarded = r.URL.RawQuery + string(body)
+	}))
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		req := testutil.CreateHTTPRequest(t, method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", promapi.FormContentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/api/v1/query?query=rate(up[5m])", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "query=rate(up[5m])", forwarded)
+
+	w = serve(http.MethodGet, "/api/v1/query?query=max_over_time(up[30d])", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"range of 720h0m0s exceeds the maximum lookback of 168h0m0s"}`, w.Body.String())
+
+	w = serve(http.MethodPost, "/api/v1/query_range", "query=up&start=0&end=3600&step=15")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "end=3600&query=up&start=0&step=60", forwarded)
+
+	w = serve(http.MethodGet, "/api/v1/series?match[]=up[30d]", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestIsSet(t *testing.T) {
+	t.Parallel()
+	assert.False(t, (*Limits)(nil).IsSet())
+	assert.False(t, (&Limits{Clamp: true}).IsSet())
+	assert.True(t, (&Limits{MaxPoints: 11000}).IsSet())
+}
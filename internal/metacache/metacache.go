@@ -0,0 +1,202 @@
+package metacache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
+	"golang.org/x/sync/singleflight"
+)
+
+// Routes whose responses may be cached, configured by name
+const (
+	RouteLabels      = "labels"
+	RouteLabelValues = "label_values"
+	RouteSeries      = "series"
+	RouteMetadata    = "metadata"
+)
+
+// DefaultTTLs are how long responses of each route are fresh by default
+var DefaultTTLs = map[string]time.Duration{
+	RouteLabels:      5 * time.Minute,
+	RouteLabelValues: 5 * time.Minute,
+	RouteSeries:      time.Minute,
+	RouteMetadata:    15 * time.Minute,
+}
+
+// MetadataCache caches the responses of the label, series and metadata
+// endpoints, which Grafana's query editor requests on every keystroke. Stale
+// responses are served while they are refreshed in the background
+type MetadataCache struct {
+	Cache cache.Cache
+	// How long responses are fresh for each route, routes without a TTL are
+	// not cached
+	TTLs map[string]time.Duration
+	// How long after expiring a response is served while it is refreshed
+	StaleWhileRevalidate time.Duration
+
+	now        func() time.Time
+	refreshing singleflight.Group
+}
+
+// A cached response
+type entry struct {
+	Body        []byte    `json:"body"`
+	ContentType string    `json:"content_type"`
+	Fetched     time.Time `json:"fetched"`
+}
+
+// Middleware serves cacheable requests from the cache, passing misses and
+// refreshes to the next handler. Requests with Cache-Control: no-cache skip
+// the cached response and refresh it, and no-store skips the cache entirely
+func (c *MetadataCache) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ttl, ok := c.TTLs[route(r.URL.Path)]
+		cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+		if !ok || ttl <= 0 || strings.Contains(cacheControl, "no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params, err := promapi.RequestParams(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		key := cacheKey(r, params, ttl)
+		l := logger.WithRequestFields(r)
+
+		if !strings.Contains(cacheControl, "no-cache") {
+			cached, ok := c.load(key)
+			age := c.clock().Sub(cached.Fetched)
+			if ok && age < ttl+c.StaleWhileRevalidate {
+				if age >= ttl {
+					c.revalidate(l, r, key, ttl, next)
+				}
+				l.Debug("served metadata from cache", "age", age, "stale", age >= ttl)
+				w.Header().Set("Content-Type", cached.ContentType)
+				w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+				w.Write(cached.Body)
+				return
+			}
+		}
+
+		rec := c.fetch(r, key, ttl, next)
+		rec.Replay(w)
+	})
+}
+
+// Refreshes a stale response in the background, once per key at a time
+func (c *MetadataCache) revalidate(logger *logger.Logger, r *http.Request, key string, ttl time.Duration, next http.Handler) {
+	// The refresh outlives the request, but keeps its values such as the
+	// caller identity
+	refresh := r.Clone(context.WithoutCancel(r.Context()))
+	c.refreshing.DoChan(key, func() (any, error) {
+		rec := c.fetch(refresh, key, ttl, next)
+		if rec.Status != http.StatusOK {
+			logger.Warn("failed to refresh cached metadata", "status_code", rec.Status)
+		}
+		return nil, nil
+	})
+}
+
+// Passes the request to the next handler, caching a successful response
+func (c *MetadataCache) fetch(r *http.Request, key string, ttl time.Duration, next http.Handler) *promapi.Recorder {
+	rec := promapi.NewRecorder()
+	next.ServeHTTP(rec, r)
+	if rec.Status != http.StatusOK {
+		return rec
+	}
+
+	data, err := json.Marshal(&entry{
+		Body:        rec.Body.Bytes(),
+		ContentType: rec.Header().Get("Content-Type"),
+		Fetched:     c.clock(),
+	})
+	if err == nil {
+		c.Cache.Set(key, data, ttl+c.StaleWhileRevalidate)
+	}
+	return rec
+}
+
+// Returns the cached response for the key, which is empty on a miss
+func (c *MetadataCache) load(key string) (*entry, bool) {
+	var cached entry
+	data, ok := c.Cache.Get(key)
+	if !ok || json.Unmarshal(data, &cached) != nil {
+		return &cached, false
+	}
+	return &cached, true
+}
+
+func (c *MetadataCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Returns the name of a cacheable route, or an empty string
+func route(path string) string {
+	switch {
+	case path == "/api/v1/labels":
+		return RouteLabels
+	case strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"):
+		return RouteLabelValues
+	case path == "/api/v1/series":
+		return RouteSeries
+	case path == "/api/v1/metadata":
+		return RouteMetadata
+	}
+	return ""
+}
+
+// Returns the cache key of a request, from the caller, path and parameters,
+// with repeated parameters sorted. Grafana moves start and end with every
+// request, so they are truncated to the TTL, which at worst widens the time
+// range a cached response reflects by one TTL
+func cacheKey(r *http.Request, params url.Values, ttl time.Duration) string {
+	normalized := make(url.Values, len(params))
+	for k, values := range params {
+		normalized[k] = slices.Sorted(slices.Values(values))
+	}
+	for _, k := range []string{"start", "end"} {
+		if t, err := promapi.ParseTime(params.Get(k)); err == nil {
+			normalized.Set(k, promapi.FormatTime(t.Truncate(ttl)))
+		}
+	}
+
+	hash := sha256.New()
+	if identity, ok := inbound.IdentityFromContext(r.Context()); ok {
+		hash.Write([]byte(identity.Name))
+	}
+	// The upstream prefix is removed from the path, so routed requests are
+	// told apart by their upstream
+	if u, ok := upstream.FromContext(r.Context()); ok {
+		hash.Write([]byte{0})
+		hash.Write([]byte(u.Name))
+	}
+	// Headers such as X-Scope-OrgID select a tenant without inbound auth
+	if key := headerpolicy.RequestKey(r); key != "" {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.Path))
+	hash.Write([]byte{0})
+	hash.Write([]byte(normalized.Encode()))
+	return "metadata:" + hex.EncodeToString(hash.Sum(nil))
+}
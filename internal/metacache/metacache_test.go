@@ -0,0 +1,186 @@
+package metacache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A clock which only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Returns a handler answering with a body numbering each upstream call
+func newCountingUpstream(calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if r.URL.Query().Get("match[]") == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte{'0' + byte(n)})
+	})
+}
+
+func newTestCache(clock *fakeClock) *MetadataCache {
+	return &MetadataCache{
+		Cache: cache.NewMemory(1 << 20),
+		TTLs: map[string]time.Duration{
+			RouteLabels:      time.Minute,
+			RouteLabelValues: time.Minute,
+		},
+		StaleWhileRevalidate: time.Hour,
+		now:                  clock.Now,
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	var calls atomic.Int32
+	c := newTestCache(clock)
+	handler := c.Middleware(testutil.CreateTestLogger(t), newCountingUpstream(&calls))
+
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/v1/labels?match[]=up&match[]=node", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Body.String())
+
+	// Repeated parameters in another order share the cached response
+	w = get("/api/v1/labels?match[]=node&match[]=up", nil)
+	assert.Equal(t, "1", w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Other parameters and routes are cached separately
+	assert.Equal(t, "2", get("/api/v1/labels?match[]=up", nil).Body.String())
+	assert.Equal(t, "3", get("/api/v1/label/job/values", nil).Body.String())
+
+	// Routes without a TTL are not cached
+	assert.Equal(t, "4", get("/api/v1/metadata", nil).Body.String())
+	assert.Equal(t, "5", get("/api/v1/metadata", nil).Body.String())
+
+	// Failed responses are not cached
+	assert.Equal(t, http.StatusServiceUnavailable, get("/api/v1/labels?match[]=fail", nil).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/api/v1/labels?match[]=fail", nil).Code)
+	assert.Equal(t, int32(7), calls.Load())
+
+	// no-cache refreshes the cached response, no-store bypasses the cache
+	w = get("/api/v1/label/job/values", http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "8", w.Body.String())
+	assert.Equal(t, "8", get("/api/v1/label/job/values", nil).Body.String())
+	w = get("/api/v1/label/job/values", http.Header{"Cache-Control": {"no-store"}})
+	assert.Equal(t, "9", w.Body.String())
+	assert.Equal(t, "8", get("/api/v1/label/job/values", nil).Body.String())
+}
+
+func TestMiddleware_StaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	var calls atomic.Int32
+	c := newTestCache(clock)
+	handler := c.Middleware(testutil.CreateTestLogger(t), newCountingUpstream(&calls))
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/labels", nil))
+		return w
+	}
+
+	assert.Equal(t, "1", get().Body.String())
+
+	// Stale responses are served while they are refreshed in the background
+	clock.Advance(2 * time.Minute)
+	w := get()
+	assert.Equal(t, "1", w.Body.String())
+	assert.Equal(t, "120", w.Header().Get("Age"))
+	require.Eventually(t, func() bool { return get().Body.String() == "2" }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Responses are dropped once they are too stale to serve
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, "3", get().Body.String())
+}
+
+func TestCacheKey(t *testing.T) {
+	t.Parallel()
+	key := func(target string, caller string) string {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, target, nil)
+		if caller != "" {
+			req = req.WithContext(inbound.WithIdentity(req.Context(), &inbound.Identity{Name: caller}))
+		}
+		return cacheKey(req, req.URL.Query(), time.Minute)
+	}
+
+	base := key("/api/v1/labels?start=1700000000&end=1700003600", "alice")
+	assert.Equal(t, base, key("/api/v1/labels?end=1700003630&start=1700000010", "alice"))
+	assert.NotEqual(t, base, key("/api/v1/labels?start=1700000000&end=1700003660", "alice"))
+	assert.NotEqual(t, base, key("/api/v1/labels?start=1700000000&end=1700003600", "bob"))
+	assert.NotEqual(t, base, key("/api/v1/series?start=1700000000&end=1700003600", "alice"))
+
+	// Requests routed to a named upstream are cached apart from the default
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/labels?start=1700000000&end=1700003600", nil)
+	req = req.WithContext(upstream.WithUpstream(inbound.WithIdentity(req.Context(), &inbound.Identity{Name: "alice"}), &upstream.Upstream{Name: "regional"}))
+	assert.NotEqual(t, base, cacheKey(req, req.URL.Query(), time.Minute))
+
+	// Headers forwarded by the policy, such as a tenant, are part of the key
+	tenantKey := func(orgID string) string {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/labels", nil)
+		req.Header.Set("X-Scope-OrgID", orgID)
+		req.Header.Set("User-Agent", orgID)
+		req = req.WithContext(headerpolicy.WithPolicy(req.Context(), &headerpolicy.Policy{Allow: []string{"X-Scope-OrgID"}}))
+		return cacheKey(req, req.URL.Query(), time.Minute)
+	}
+	assert.NotEqual(t, tenantKey("tenant-1"), tenantKey("tenant-2"))
+}
+
+func TestRoute(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"/api/v1/labels":                RouteLabels,
+		"/api/v1/label/job/values":      RouteLabelValues,
+		"/api/v1/label/__name__/values": RouteLabelValues,
+		"/api/v1/series":                RouteSeries,
+		"/api/v1/metadata":              RouteMetadata,
+		"/api/v1/query":                 "",
+		"/api/v1/label/job":             "",
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, route(path), path)
+	}
+}
@@ -0,0 +1,273 @@
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+var errDeniedByDefault = errors.New("query rejected by policy: no rule allows it")
+
+// Rule matches queries by their contents. Every criterion which is set must
+// match for the rule to apply, and a criterion matches if any of its entries
+// does. A rule without criteria matches every query
+type Rule struct {
+	Name string `yaml:"name"`
+	// Either allow or deny, deny if unset
+	Action string `yaml:"action"`
+	// Returned to the caller when the rule denies a query
+	Message string `yaml:"message"`
+	// Regular expressions matching the whole metric name of a selector. An
+	// empty expression matches selectors without a metric name
+	Metrics []string `yaml:"metrics"`
+	// Label matchers in PromQL syntax, e.g. __name__=~".+", matching a
+	// selector with an identical matcher
+	Matchers []string `yaml:"matchers"`
+	// Names of functions or aggregation operators used by the query
+	Functions []string `yaml:"functions"`
+	// Labels used in a by or without clause
+	Grouping []string `yaml:"grouping"`
+	// A regular expression matching anywhere in the raw query
+	Query string `yaml:"query"`
+
+	metrics  []*regexp.Regexp
+	matchers []promql.Matcher
+	query    *regexp.Regexp
+}
+
+// Policy is an ordered list of rules, where the first rule to match a query
+// decides whether it is forwarded
+type Policy struct {
+	// The action for queries which match no rule, allow if unset
+	Default string  `yaml:"default"`
+	Rules   []*Rule `yaml:"rules"`
+}
+
+// Parses a policy file, compiling the expressions and matchers of its rules
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(policy); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if policy.Default == "" {
+		policy.Default = ActionAllow
+	}
+	if policy.Default != ActionAllow && policy.Default != ActionDeny {
+		return nil, fmt.Errorf("invalid default action %q, allowed values are: [%s %s]", policy.Default, ActionAllow, ActionDeny)
+	}
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", rule.Name, err)
+		}
+	}
+	return policy, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Action == "" {
+		r.Action = ActionDeny
+	}
+	if r.Action != ActionAllow && r.Action != ActionDeny {
+		return fmt.Errorf("invalid action %q, allowed values are: [%s %s]", r.Action, ActionAllow, ActionDeny)
+	}
+
+	for _, metric := range r.Metrics {
+		// Anchored like the regular expression matchers of PromQL
+		re, err := regexp.Compile("^(?:" + metric + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid metric expression %q: %w", metric, err)
+		}
+		r.metrics = append(r.metrics, re)
+	}
+
+	for _, matcher := range r.Matchers {
+		query, err := promql.Parse("{" + matcher + "}")
+		if err != nil || len(query.Selectors) != 1 || len(query.Selectors[0].Matchers) != 1 {
+			return fmt.Errorf("invalid matcher %q", matcher)
+		}
+		r.matchers = append(r.matchers, query.Selectors[0].Matchers[0])
+	}
+
+	if r.Query != "" {
+		re, err := regexp.Compile(r.Query)
+		if err != nil {
+			return fmt.Errorf("invalid query expression %q: %w", r.Query, err)
+		}
+		r.query = re
+	}
+	return nil
+}
+
+// Reports whether the rule applies to the query
+func (r *Rule) matches(raw string, query *promql.Query) bool {
+	if r.query != nil && !r.query.MatchString(raw) {
+		return false
+	}
+	if len(r.Functions) > 0 && !slices.ContainsFunc(query.Functions, func(function string) bool {
+		return slices.ContainsFunc(r.Functions, func(name string) bool { return strings.EqualFold(name, function) })
+	}) {
+		return false
+	}
+	if len(r.Grouping) > 0 && !slices.ContainsFunc(query.Grouping, func(label string) bool {
+		return slices.Contains(r.Grouping, label)
+	}) {
+		return false
+	}
+	if len(r.metrics) > 0 && !slices.ContainsFunc(query.Selectors, func(selector promql.Selector) bool {
+		return slices.ContainsFunc(r.metrics, func(re *regexp.Regexp) bool { return re.MatchString(selector.MetricName) })
+	}) {
+		return false
+	}
+	if len(r.matchers) > 0 && !slices.ContainsFunc(query.Selectors, func(selector promql.Selector) bool {
+		return slices.ContainsFunc(selector.Matchers, func(m promql.Matcher) bool { return slices.Contains(r.matchers, m) })
+	}) {
+		return false
+	}
+	return true
+}
+
+// Returns an error describing why the query is denied, or nil if it is allowed
+func (p *Policy) Evaluate(raw string) error {
+	query, err := promql.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	for _, rule := range p.Rules {
+		if !rule.matches(raw, query) {
+			continue
+		}
+		if rule.Action == ActionAllow {
+			return nil
+		}
+		if rule.Message != "" {
+			return fmt.Errorf("query rejected by policy rule %q: %s", rule.Name, rule.Message)
+		}
+		return fmt.Errorf("query rejected by policy rule %q", rule.Name)
+	}
+
+	if p.Default == ActionDeny {
+		return errDeniedByDefault
+	}
+	return nil
+}
+
+// Engine evaluates the queries of requests against a policy file, which is
+// re-read whenever it changes. The last valid policy is kept if the file
+// becomes unreadable or invalid
+type Engine struct {
+	File string
+
+	file   *filewatch.File
+	logger *logger.Logger
+
+	mu     sync.Mutex
+	policy *Policy
+}
+
+// Performs the initial read of the policy file
+func (e *Engine) Init(logger *logger.Logger) error {
+	e.logger = logger
+	e.file = filewatch.New(e.File)
+	_, err := e.load()
+	return err
+}
+
+// Middleware rejects requests to the Prometheus API whose queries or series
+// matchers are denied by the policy, with a bad_data error
+func (e *Engine) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries, err := requestQueries(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		if len(queries) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy, err := e.load()
+		if err != nil {
+			logger.WithRequestFields(r).Error("failed to load query policy", "error", err)
+			promapi.WriteError(w, http.StatusInternalServerError, promapi.ErrorInternal, err)
+			return
+		}
+		for _, query := range queries {
+			if err := policy.Evaluate(query); err != nil {
+				logger.WithRequestFields(r).Warn("rejected query denied by policy", "query", query, "error", err)
+				promapi.WriteError(w, http.StatusBadRequest, promapi.ErrorBadData, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the policy, re-reading the file if it has changed
+func (e *Engine) load() (*Policy, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data, changed, err := e.file.Read()
+	if err != nil {
+		if e.policy == nil {
+			return nil, fmt.Errorf("failed to read query policy file: %w", err)
+		}
+		e.logger.Warn("failed to re-read query policy file, using last known policy", "path", e.file.Path, "error", err)
+		return e.policy, nil
+	}
+	if e.policy != nil && !changed {
+		return e.policy, nil
+	}
+
+	policy, err := Parse(data)
+	if err != nil {
+		if e.policy == nil {
+			return nil, fmt.Errorf("failed to parse query policy file: %w", err)
+		}
+		e.logger.Warn("failed to parse query policy file, using last known policy", "path", e.file.Path, "error", err)
+		return e.policy, nil
+	}
+
+	e.logger.Info("loaded query policy file", "path", e.file.Path, "rules", len(policy.Rules))
+	e.policy = policy
+	return policy, nil
+}
+
+// Returns the PromQL expressions of a Prometheus API request
+func requestQueries(r *http.Request) ([]string, error) {
+	key := promapi.ExpressionParam(r.URL.Path)
+	if key == "" {
+		return nil, nil
+	}
+	params, err := promapi.RequestParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return params[key], nil
+}
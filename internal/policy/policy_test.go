@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+rules:
+  - name: allow-recording-rules
+    action: allow
+    metrics: ['.+:.+']
+  - name: metric-name-cardinality
+    message: counting series by metric name scans every series
+    functions: [count]
+    grouping: [__name__]
+  - name: unrestricted-selector
+    matchers: ['__name__=~".+"', '__name__=~".*"']
+  - name: kube-audit
+    metrics: ['kube_audit_.*']
+  - name: no-metric-name
+    metrics: ['']
+  - name: long-query
+    query: '.{200,}'
+`
+
+func TestPolicyEvaluate(t *testing.T) {
+	t.Parallel()
+	policy, err := Parse([]byte(testPolicy))
+	require.NoError(t, err)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: `sum(rate(http_requests_total[5m]))`},
+		{query: `count by (job) (up)`},
+		{query: `count by (__name__) ({__name__=~"kube_.+"})`, expected: `query rejected by policy rule "metric-name-cardinality": counting series by metric name scans every series`},
+		{query: `count({__name__=~".+"})`, expected: `policy rule "unrestricted-selector"`},
+		{query: `rate(kube_audit_events_total[5m])`, expected: `policy rule "kube-audit"`},
+		{query: `{job="api"}`, expected: `policy rule "no-metric-name"`},
+		{query: `up + ` + strings.Repeat("1 + ", 50) + `1`, expected: `policy rule "long-query"`},
+		// Earlier allow rules take precedence
+		{query: `count by (__name__) (job:up:sum)`},
+		{query: `sum(up`, expected: "failed to parse query"},
+	}
+
+	for _, tt := range tests {
+		err := policy.Evaluate(tt.query)
+		if tt.expected == "" {
+			assert.NoError(t, err, tt.query)
+			continue
+		}
+		assert.ErrorContains(t, err, tt.expected, tt.query)
+	}
+}
+
+func TestPolicyEvaluate_DefaultDeny(t *testing.T) {
+	t.Parallel()
+	policy, err := Parse([]byte("default: deny\nrules:\n  - action: allow\n    metrics: [up]\n"))
+	require.NoError(t, err)
+
+	assert.NoError(t, policy.Evaluate(`sum(up)`))
+	assert.Equal(t, errDeniedByDefault, policy.Evaluate(`sum(down)`))
+}
+
+func TestParse_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{policy: "default: block", expected: `invalid default action "block"`},
+		{policy: "rules:\n  - action: block", expected: `invalid rule "rule 1": invalid action "block"`},
+		{policy: "rules:\n  - name: bad\n    metrics: ['(']", expected: `invalid rule "bad": invalid metric expression`},
+		{policy: "rules:\n  - matchers: ['job']", expected: `invalid matcher "job"`},
+		{policy: "rules:\n  - query: '['", expected: "invalid query expression"},
+		{policy: "rules:\n  - metric: [up]", expected: "field metric not found"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.policy))
+		assert.ErrorContains(t, err, tt.expected, tt.policy)
+	}
+}
+
+func TestEngineMiddleware(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testutil.WriteFile(t, dir, "policy.yaml", []byte(testPolicy))
+
+	engine := &Engine{File: path}
+	require.NoError(t, engine.Init(testutil.CreateTestLogger(t)))
+
+	var forwarded string
+	handler := engine.Middleware(testutil.CreateTestLogger(t), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		forwarded = string(body)
+	}))
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		req := testutil.CreateHTTPRequest(t, method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", promapi.FormContentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/api/v1/query?query=up", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(http.MethodGet, "/api/v1/series?match[]=up&match[]=kube_audit_events_total", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"query rejected by policy rule \"kube-audit\""}`, w.Body.String())
+
+	// POST bodies are evaluated and forwarded intact
+	w = serve(http.MethodPost, "/api/v1/query_range", "query=sum(up)&step=60")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "query=sum(up)&step=60", forwarded)
+
+	w = serve(http.MethodPost, "/api/v1/query", "query=count(kube_audit_events_total)")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Endpoints without queries are not evaluated
+	w = serve(http.MethodGet, "/api/v1/metadata?metric=kube_audit_events_total", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The policy is reloaded when the file changes
+	testutil.WriteFile(t, dir, "policy.yaml", []byte("default: deny\n"))
+	w = serve(http.MethodGet, "/api/v1/query?query=up", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Invalid policies are ignored in favour of the last valid policy
+	testutil.WriteFile(t, dir, "policy.yaml", []byte("default: block\n"))
+	w = serve(http.MethodGet, "/api/v1/query?query=up", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEngineInit(t *testing.T) {
+	t.Parallel()
+	err := (&Engine{File: "/missing/policy.yaml"}).Init(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to read query policy file")
+}
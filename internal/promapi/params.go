@@ -0,0 +1,111 @@
+package promapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Parameters holding PromQL in Prometheus API requests
+const (
+	ParamQuery = "query"
+	ParamMatch = "match[]"
+)
+
+// The content type of form encoded request bodies
+const FormContentType = "application/x-www-form-urlencoded"
+
+var errMultipartForm = errors.New("multipart form bodies are not supported")
+
+// Reports whether the request carries a form encoded body
+func IsFormRequest(r *http.Request) bool {
+	return mediaType(r) == FormContentType
+}
+
+// Returns the media type of the request body, without parameters
+func mediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// Returns the parameter holding PromQL for an API path, or an empty string
+// for endpoints such as metadata which do not select series
+func ExpressionParam(path string) string {
+	switch {
+	case path == "/api/v1/query", path == "/api/v1/query_range", path == "/api/v1/query_exemplars":
+		return ParamQuery
+	case path == "/api/v1/series", path == "/api/v1/labels", strings.HasPrefix(path, "/api/v1/label/"):
+		return ParamMatch
+	}
+	return ""
+}
+
+// Returns the parameters of a Prometheus API request. Like Prometheus, the
+// form body of a POST request is merged with its query string, with the body
+// values first so they take precedence for single valued parameters. A POST
+// request with both is rewritten to carry the merged parameters in its body
+// alone, so it is forwarded as Prometheus would interpret it. The body is
+// restored so it can be read again. Other bodies are neither read nor
+// changed, except multipart forms which Prometheus would also read parameters
+// from and are rejected, so no parameter escapes inspection
+func RequestParams(r *http.Request) (url.Values, error) {
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request parameters: %w", err)
+	}
+	if r.Method != http.MethodPost {
+		return params, nil
+	}
+	switch mediaType(r) {
+	case FormContentType:
+	case "multipart/form-data":
+		return nil, errMultipartForm
+	default:
+		return params, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		return params, nil
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request parameters: %w", err)
+	}
+	if len(params) > 0 {
+		for k, values := range params {
+			form[k] = append(form[k], values...)
+		}
+		r.URL.RawQuery = ""
+		SetRequestParams(r, form)
+	}
+	return form, nil
+}
+
+// Replaces the parameters of a request previously read with RequestParams
+func SetRequestParams(r *http.Request, params url.Values) {
+	encoded := params.Encode()
+	if r.Method == http.MethodPost && r.ContentLength > 0 && IsFormRequest(r) {
+		r.Body = io.NopCloser(strings.NewReader(encoded))
+		r.ContentLength = int64(len(encoded))
+		r.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+		return
+	}
+	r.URL.RawQuery = encoded
+}
@@ -0,0 +1,139 @@
+package promapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpressionParam(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, ParamQuery, ExpressionParam("/api/v1/query"))
+	assert.Equal(t, ParamQuery, ExpressionParam("/api/v1/query_range"))
+	assert.Equal(t, ParamMatch, ExpressionParam("/api/v1/series"))
+	assert.Equal(t, ParamMatch, ExpressionParam("/api/v1/label/job/values"))
+	assert.Empty(t, ExpressionParam("/api/v1/metadata"))
+}
+
+func TestRequestParams(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		contentType   string
+		body          string
+		expected      url.Values
+		expectedQuery string
+		expectedBody  string
+	}{
+		{
+			name:          "get",
+			method:        http.MethodGet,
+			url:           "/api/v1/query?query=up",
+			expected:      url.Values{"query": {"up"}},
+			expectedQuery: "query=down",
+		},
+		{
+			name:         "post form body",
+			method:       http.MethodPost,
+			url:          "/api/v1/query",
+			contentType:  FormContentType,
+			body:         "query=up",
+			expected:     url.Values{"query": {"up"}},
+			expectedBody: "query=down",
+		},
+		{
+			name:         "post form body and query string",
+			method:       http.MethodPost,
+			url:          "/api/v1/query_range?start=1&query=ignored&step=15",
+			contentType:  FormContentType + "; charset=utf-8",
+			body:         "query=up&end=2",
+			expected:     url.Values{"query": {"up", "ignored"}, "start": {"1"}, "end": {"2"}, "step": {"15"}},
+			expectedBody: "end=2&query=down&start=1&step=15",
+		},
+		{
+			name:          "post without body",
+			method:        http.MethodPost,
+			url:           "/api/v1/query?query=up",
+			contentType:   FormContentType,
+			expected:      url.Values{"query": {"up"}},
+			expectedQuery: "query=down",
+		},
+		{
+			name:          "post other body",
+			method:        http.MethodPost,
+			url:           "/api/v1/query?query=up",
+			contentType:   "application/json",
+			body:          `{"query":"ignored"}`,
+			expected:      url.Values{"query": {"up"}},
+			expectedQuery: "query=down",
+			expectedBody:  `{"query":"ignored"}`,
+		},
+		{
+			name:          "post body without content type",
+			method:        http.MethodPost,
+			url:           "/api/v1/query?query=up",
+			body:          "query=ignored",
+			expected:      url.Values{"query": {"up"}},
+			expectedQuery: "query=down",
+			expectedBody:  "query=ignored",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			params, err := RequestParams(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, params)
+
+			// The body can be read again, merged with the query string
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			if req.URL.RawQuery == "" {
+				reread, err := url.ParseQuery(string(body))
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, reread)
+			} else {
+				assert.Equal(t, tt.body, string(body))
+			}
+			req.Body = io.NopCloser(strings.NewReader(string(body)))
+
+			params.Set("query", "down")
+			SetRequestParams(req, params)
+			body, err = io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedQuery, req.URL.RawQuery)
+			assert.Equal(t, tt.expectedBody, string(body))
+			assert.Equal(t, int64(len(tt.expectedBody)), req.ContentLength)
+		})
+	}
+}
+
+func TestRequestParams_Invalid(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=%zz"))
+	req.Header.Set("Content-Type", FormContentType)
+	_, err := RequestParams(req)
+	assert.ErrorContains(t, err, "failed to parse request parameters")
+}
+
+func TestRequestParams_Multipart(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("--x\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	_, err := RequestParams(req)
+	assert.ErrorIs(t, err, errMultipartForm)
+}
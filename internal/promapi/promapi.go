@@ -0,0 +1,160 @@
+package promapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error types returned in the errorType field of Prometheus HTTP API errors
+const (
+	ErrorBadData      = "bad_data"
+	ErrorExecution    = "execution"
+	ErrorTimeout      = "timeout"
+	ErrorCanceled     = "canceled"
+	ErrorInternal     = "internal"
+	ErrorUnavailable  = "unavailable"
+	ErrorNotFound     = "not_found"
+	ErrorUnauthorized = "unauthorized"
+	ErrorForbidden    = "forbidden"
+)
+
+// StatusClientClosedRequest is the non-standard status of requests whose
+// caller disconnected, as Prometheus responds with for canceled queries
+const StatusClientClosedRequest = 499
+
+// The longest error message extracted from a non-Prometheus error response
+const maxErrorMessageLength = 512
+
+var (
+	htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlTagPattern   = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// Response is the envelope of every Prometheus HTTP API response
+type Response struct {
+	Status    string   `json:"status"`
+	Data      any      `json:"data,omitempty"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	Infos     []string `json:"infos,omitempty"`
+}
+
+// Writes a Prometheus-style JSON error response, so API clients such as
+// Grafana can surface the message to the user
+func WriteError(w http.ResponseWriter, statusCode int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(&Response{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+// Writes the error of reading request parameters, a 413 if the body exceeded
+// the maximum size or a 400 otherwise
+func WriteParamsError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		WriteError(w, http.StatusRequestEntityTooLarge, ErrorBadData, err)
+		return
+	}
+	WriteError(w, http.StatusBadRequest, ErrorBadData, err)
+}
+
+// Returns the errorType Prometheus uses for an HTTP status code
+func ErrorTypeForStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusForbidden:
+		return ErrorForbidden
+	case http.StatusNotFound:
+		return ErrorNotFound
+	case http.StatusUnprocessableEntity:
+		return ErrorExecution
+	case StatusClientClosedRequest:
+		return ErrorCanceled
+	case http.StatusGatewayTimeout:
+		return ErrorTimeout
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return ErrorUnavailable
+	}
+	if statusCode >= 500 {
+		return ErrorInternal
+	}
+	return ErrorBadData
+}
+
+// Returns whether the body is a Prometheus JSON error response
+func IsErrorResponse(body []byte) bool {
+	var resp Response
+	return json.Unmarshal(body, &resp) == nil && resp.Status == "error" && resp.ErrorType != ""
+}
+
+// Returns a one line message from the body of a non-Prometheus error
+// response, such as the JSON error of an Azure gateway or an HTML error page,
+// falling back to the status text if the body has no message
+func ErrorMessage(statusCode int, body []byte) string {
+	body = bytes.TrimSpace(body)
+	message := jsonErrorMessage(body)
+	if message == "" && bytes.HasPrefix(body, []byte("<")) {
+		if match := htmlTitlePattern.FindSubmatch(body); match != nil {
+			message = string(match[1])
+		} else {
+			message = htmlTagPattern.ReplaceAllString(string(body), " ")
+		}
+		message = html.UnescapeString(message)
+	}
+	if message == "" && utf8.Valid(body) && !json.Valid(body) {
+		message = string(body)
+	}
+
+	message = strings.Join(strings.Fields(message), " ")
+	if len(message) > maxErrorMessageLength {
+		message = strings.ToValidUTF8(message[:maxErrorMessageLength], "") + "..."
+	}
+	if message == "" {
+		return http.StatusText(statusCode)
+	}
+	return message
+}
+
+// Returns the message of a JSON error, in the forms {"error": "..."},
+// {"error": {"message": "..."}} as Azure responds with, or {"message": "..."}
+func jsonErrorMessage(body []byte) string {
+	var resp struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+		Message          string          `json:"message"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return ""
+	}
+
+	var message string
+	if json.Unmarshal(resp.Error, &message) == nil && message != "" {
+		if resp.ErrorDescription != "" {
+			return message + ": " + resp.ErrorDescription
+		}
+		return message
+	}
+	var nested struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(resp.Error, &nested) == nil && nested.Message != "" {
+		if nested.Code != "" {
+			return nested.Code + ": " + nested.Message
+		}
+		return nested.Message
+	}
+	return resp.Message
+}
@@ -0,0 +1,132 @@
+package promapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+
+	WriteError(w, http.StatusUnauthorized, ErrorUnauthorized, errors.New("authentication required"))
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"error","errorType":"unauthorized","error":"authentication required"}`, w.Body.String())
+}
+
+func TestWriteParamsError(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	WriteParamsError(w, fmt.Errorf("failed to read request body: %w", &http.MaxBytesError{Limit: 10}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"failed to read request body: http: request body too large"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	WriteParamsError(w, errors.New("failed to parse request parameters"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestErrorTypeForStatus(t *testing.T) {
+	t.Parallel()
+	tests := map[int]string{
+		http.StatusBadRequest:          ErrorBadData,
+		http.StatusMethodNotAllowed:    ErrorBadData,
+		http.StatusUnauthorized:        ErrorUnauthorized,
+		http.StatusForbidden:           ErrorForbidden,
+		http.StatusNotFound:            ErrorNotFound,
+		http.StatusUnprocessableEntity: ErrorExecution,
+		StatusClientClosedRequest:      ErrorCanceled,
+		http.StatusTooManyRequests:     ErrorUnavailable,
+		http.StatusInternalServerError: ErrorInternal,
+		http.StatusBadGateway:          ErrorUnavailable,
+		http.StatusServiceUnavailable:  ErrorUnavailable,
+		http.StatusGatewayTimeout:      ErrorTimeout,
+	}
+	for statusCode, expected := range tests {
+		assert.Equal(t, expected, ErrorTypeForStatus(statusCode), statusCode)
+	}
+}
+
+func TestIsErrorResponse(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsErrorResponse([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`)))
+	assert.False(t, IsErrorResponse([]byte(`{"status":"success","data":[]}`)))
+	assert.False(t, IsErrorResponse([]byte(`{"error":{"code":"Throttled","message":"slow down"}}`)))
+	assert.False(t, IsErrorResponse([]byte(`<html><body>Bad Gateway</body></html>`)))
+}
+
+func TestErrorMessage(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		expected   string
+	}{
+		{
+			name:       "azure json error",
+			statusCode: http.StatusTooManyRequests,
+			body:       `{"error":{"code":"TooManyRequests","message":"Request rate exceeded."}}`,
+			expected:   "TooManyRequests: Request rate exceeded.",
+		},
+		{
+			name:       "oauth json error",
+			statusCode: http.StatusUnauthorized,
+			body:       `{"error":"invalid_token","error_description":"The token expired"}`,
+			expected:   "invalid_token: The token expired",
+		},
+		{
+			name:       "json message",
+			statusCode: http.StatusForbidden,
+			body:       `{"message":"Forbidden"}`,
+			expected:   "Forbidden",
+		},
+		{
+			name:       "html title",
+			statusCode: http.StatusBadGateway,
+			body:       "<html><head><title>502 Bad Gateway</title></head><body><center><h1>502 Bad Gateway</h1></center></body></html>",
+			expected:   "502 Bad Gateway",
+		},
+		{
+			name:       "html without title",
+			statusCode: http.StatusServiceUnavailable,
+			body:       "<h1>Service\n Unavailable</h1><p>Try again &amp; again</p>",
+			expected:   "Service Unavailable Try again & again",
+		},
+		{
+			name:       "plain text",
+			statusCode: http.StatusBadRequest,
+			body:       "invalid query\n",
+			expected:   "invalid query",
+		},
+		{
+			name:       "empty body",
+			statusCode: http.StatusGatewayTimeout,
+			expected:   "Gateway Timeout",
+		},
+		{
+			name:       "json without message",
+			statusCode: http.StatusInternalServerError,
+			body:       `{"code":500}`,
+			expected:   "Internal Server Error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, ErrorMessage(tt.statusCode, []byte(tt.body)))
+		})
+	}
+
+	long := ErrorMessage(http.StatusBadGateway, []byte(strings.Repeat("a", 1000)))
+	assert.Len(t, long, maxErrorMessageLength+3)
+}
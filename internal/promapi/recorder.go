@@ -0,0 +1,43 @@
+package promapi
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+)
+
+// Recorder buffers the response of a handler, so it can be inspected, cached
+// or merged before anything is written to the caller
+type Recorder struct {
+	header http.Header
+	Status int
+	Body   bytes.Buffer
+}
+
+// Creates a recorder with a 200 status, as a handler which never calls
+// WriteHeader responds with
+func NewRecorder() *Recorder {
+	return &Recorder{header: make(http.Header), Status: http.StatusOK}
+}
+
+func (rec *Recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *Recorder) Write(data []byte) (int, error) {
+	return rec.Body.Write(data)
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	rec.Status = status
+}
+
+// Writes the buffered response to w. A recorder may be replayed to several
+// writers concurrently once its handler has returned
+func (rec *Recorder) Replay(w http.ResponseWriter) {
+	for k, v := range rec.header {
+		w.Header()[k] = slices.Clone(v)
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body.Bytes())
+}
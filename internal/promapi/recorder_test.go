@@ -0,0 +1,25 @@
+package promapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+	rec := NewRecorder()
+	assert.Equal(t, http.StatusOK, rec.Status)
+
+	rec.Header().Set("Content-Type", "application/json")
+	rec.WriteHeader(http.StatusTeapot)
+	rec.Write([]byte(`{"status":"success"}`))
+
+	w := httptest.NewRecorder()
+	rec.Replay(w)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"status":"success"}`, w.Body.String())
+}
@@ -0,0 +1,31 @@
+package promapi
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// The Prometheus API paths forwarded upstream. As with http.ServeMux, a path
+// ending in a slash matches every path beneath it
+var Routes = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/format_query",
+	"/api/v1/parse_query",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/label/",
+	"/api/v1/metadata",
+}
+
+// Reports whether the path is one of the Routes. Paths which are not clean,
+// such as those containing "..", never match
+func IsRoute(p string) bool {
+	if path.Clean(p) != p {
+		return false
+	}
+	return slices.ContainsFunc(Routes, func(route string) bool {
+		return p == route || strings.HasSuffix(route, "/") && strings.HasPrefix(p, route)
+	})
+}
@@ -0,0 +1,18 @@
+package promapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRoute(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsRoute("/api/v1/query"))
+	assert.True(t, IsRoute("/api/v1/label/job/values"))
+	assert.False(t, IsRoute("/api/v1/query/"))
+	assert.False(t, IsRoute("/api/v1/label/../admin/tsdb/delete_series"))
+	assert.False(t, IsRoute("/api/v1/admin/tsdb/delete_series"))
+	assert.False(t, IsRoute("/api/v1/status/config"))
+	assert.False(t, IsRoute("/federate"))
+}
@@ -0,0 +1,29 @@
+package promapi
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Parses a Prometheus API timestamp, either a Unix timestamp in seconds or an
+// RFC 3339 time
+func ParseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e9))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// Formats a time as a Unix timestamp in seconds, with millisecond precision
+func FormatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
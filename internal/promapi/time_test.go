@@ -0,0 +1,39 @@
+package promapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTime(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{input: "1700000000", expected: time.Unix(1700000000, 0)},
+		{input: "1700000000.5", expected: time.Unix(1700000000, 500000000)},
+		{input: "2026-01-01T00:00:00Z", expected: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "2026-01-01T01:00:00.25+01:00", expected: time.Date(2026, 1, 1, 0, 0, 0, 250000000, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseTime(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.True(t, tt.expected.Equal(result), tt.input)
+	}
+
+	for _, input := range []string{"", "now", "NaN", "Inf", "2026-01-01"} {
+		_, err := ParseTime(input)
+		assert.ErrorContains(t, err, "cannot parse", input)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "1700000000", FormatTime(time.Unix(1700000000, 0)))
+	assert.Equal(t, "1700000000.123", FormatTime(time.Unix(1700000000, 123456789)))
+}
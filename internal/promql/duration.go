@@ -0,0 +1,74 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration units of PromQL, in the order they must appear in a duration
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// Parses a PromQL duration such as 1h30m, or a number of seconds such as 90
+// or 1.5 as accepted by the step parameter of the Prometheus API
+func ParseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < 0 || seconds > math.MaxInt64/float64(time.Second) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	var total time.Duration
+	rest := s
+	next := 0
+	for rest != "" {
+		digits := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if digits <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:digits], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[digits:]
+
+		// Units may each appear once, in order
+		found := false
+		for i := next; i < len(durationUnits); i++ {
+			u := durationUnits[i]
+			if !strings.HasPrefix(rest, u.suffix) || (u.suffix == "m" && strings.HasPrefix(rest, "ms")) {
+				continue
+			}
+			if n > int64(math.MaxInt64/u.unit) {
+				return 0, fmt.Errorf("duration %q is too large", s)
+			}
+			total += time.Duration(n) * u.unit
+			rest = rest[len(u.suffix):]
+			next = i + 1
+			found = true
+			break
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return total, nil
+}
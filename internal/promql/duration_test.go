@@ -0,0 +1,37 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDuration(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		input    string
+		expected time.Duration
+	}{
+		{input: "5m", expected: 5 * time.Minute},
+		{input: "1h30m", expected: 90 * time.Minute},
+		{input: "1d12h", expected: 36 * time.Hour},
+		{input: "2w", expected: 14 * 24 * time.Hour},
+		{input: "1y", expected: 365 * 24 * time.Hour},
+		{input: "1m500ms", expected: time.Minute + 500*time.Millisecond},
+		{input: "90", expected: 90 * time.Second},
+		{input: "1.5", expected: 1500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseDuration(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, result, tt.input)
+	}
+
+	for _, input := range []string{"", "m", "5x", "30m1h", "1h1h", "1ms1s", "-5m", "NaN", "Inf", "-1"} {
+		_, err := ParseDuration(input)
+		assert.Error(t, err, input)
+	}
+}
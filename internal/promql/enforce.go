@@ -0,0 +1,86 @@
+package promql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matcher is a label matcher of a selector
+type Matcher struct {
+	Name string
+	// One of =, !=, =~ or !~
+	Type  string
+	Value string
+}
+
+// Returns a matcher restricting a label to one of the provided values
+func NewMatcher(name string, values ...string) Matcher {
+	if len(values) == 1 {
+		return Matcher{Name: name, Type: "=", Value: values[0]}
+	}
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = regexp.QuoteMeta(value)
+	}
+	return Matcher{Name: name, Type: "=~", Value: strings.Join(quoted, "|")}
+}
+
+// Returns the matcher in PromQL syntax
+func (m Matcher) String() string {
+	return m.Name + m.Type + strconv.Quote(m.Value)
+}
+
+// Returns the query with the matchers added to every vector selector, so the
+// query can only select series which satisfy them. Existing matchers are kept,
+// so a selector which already restricts the label further is unaffected, and
+// one which conflicts with the matchers selects nothing. Queries which cannot
+// be parsed are rejected rather than forwarded unrestricted
+func EnforceMatchers(query string, matchers ...Matcher) (string, error) {
+	strs := make([]string, len(matchers))
+	for i, m := range matchers {
+		strs[i] = m.String()
+	}
+	e := &enforcer{query: query, matchers: strings.Join(strs, ",")}
+	if err := walk(query, e); err != nil {
+		return "", err
+	}
+	return e.out.String() + query[e.copied:], nil
+}
+
+// Copies a query to out with the matchers inserted into each selector
+type enforcer struct {
+	query    string
+	matchers string
+
+	out    strings.Builder
+	copied int
+}
+
+// Copies the query up to offset and inserts text
+func (e *enforcer) insert(offset int, text string) {
+	e.out.WriteString(e.query[e.copied:offset])
+	e.out.WriteString(text)
+	e.copied = offset
+}
+
+func (e *enforcer) selector(sel selectorItems) {
+	if sel.braces == nil {
+		e.insert(sel.name.end, "{"+e.matchers+"}")
+		return
+	}
+
+	closing := sel.braces[len(sel.braces)-1]
+	switch last := sel.braces[len(sel.braces)-2]; last.typ {
+	case itemLeftBrace, itemComma:
+		e.insert(closing.pos, e.matchers)
+	default:
+		e.insert(closing.pos, ","+e.matchers)
+	}
+}
+
+func (e *enforcer) function(string) {}
+
+func (e *enforcer) labelList(string, []string) {}
+
+func (e *enforcer) rangeSelector([]item) {}
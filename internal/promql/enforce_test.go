@@ -0,0 +1,125 @@
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMatcher(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, `namespace="team-a"`, NewMatcher("namespace", "team-a").String())
+	assert.Equal(t, `namespace=~"team-a|team\\.b"`, NewMatcher("namespace", "team-a", "team.b").String())
+}
+
+func TestEnforceMatchers(t *testing.T) {
+	t.Parallel()
+	ns := NewMatcher("namespace", "team-a")
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "metric name", query: `up`, expected: `up{namespace="team-a"}`},
+		{name: "existing matchers", query: `up{job="api"}`, expected: `up{job="api",namespace="team-a"}`},
+		{name: "trailing comma", query: `up{job="api",}`, expected: `up{job="api",namespace="team-a"}`},
+		{name: "empty braces", query: `up{}`, expected: `up{namespace="team-a"}`},
+		{name: "braces only", query: `{__name__=~"up|scrape_.+"}`, expected: `{__name__=~"up|scrape_.+",namespace="team-a"}`},
+		{name: "quoted metric name", query: `{"http.requests"}`, expected: `{"http.requests",namespace="team-a"}`},
+		{name: "conflicting matcher is kept", query: `up{namespace="team-b"}`, expected: `up{namespace="team-b",namespace="team-a"}`},
+		{name: "braces containing special characters", query: `up{path="/a}{(b"}`, expected: `up{path="/a}{(b",namespace="team-a"}`},
+		{name: "space before braces", query: `up {job="api"}`, expected: `up {job="api",namespace="team-a"}`},
+		{name: "recording rule name", query: `job:http_requests:rate5m`, expected: `job:http_requests:rate5m{namespace="team-a"}`},
+		{
+			name:     "range and function",
+			query:    `rate(http_requests_total{code=~"5.."}[5m])`,
+			expected: `rate(http_requests_total{code=~"5..",namespace="team-a"}[5m])`,
+		},
+		{
+			name:     "subquery and offset",
+			query:    `max_over_time(rate(errors[1m])[1h:30s] offset 1d) @ start()`,
+			expected: `max_over_time(rate(errors{namespace="team-a"}[1m])[1h:30s] offset 1d) @ start()`,
+		},
+		{
+			name:     "aggregation with leading grouping",
+			query:    `sum by (job, le) (rate(bucket[5m]))`,
+			expected: `sum by (job, le) (rate(bucket{namespace="team-a"}[5m]))`,
+		},
+		{
+			name:     "aggregation with trailing grouping",
+			query:    `sum(rate(requests[5m])) without (instance) > bool 10`,
+			expected: `sum(rate(requests{namespace="team-a"}[5m])) without (instance) > bool 10`,
+		},
+		{
+			name:     "aggregation parameters",
+			query:    `topk(5, count_values("version", build_info))`,
+			expected: `topk(5, count_values("version", build_info{namespace="team-a"}))`,
+		},
+		{
+			name:     "vector matching",
+			query:    `a * on(instance) group_left(version) b and ignoring (job) c unless d`,
+			expected: `a{namespace="team-a"} * on(instance) group_left(version) b{namespace="team-a"} and ignoring (job) c{namespace="team-a"} unless d{namespace="team-a"}`,
+		},
+		{
+			name:     "keyword metric names",
+			query:    `sum + by{a="b"}`,
+			expected: `sum{namespace="team-a"} + by{a="b",namespace="team-a"}`,
+		},
+		{
+			name:     "numbers and strings",
+			query:    `label_replace(up, "dst", "$1", "src", "(.*)") * 1e-3 + Inf - 0x1F`,
+			expected: `label_replace(up{namespace="team-a"}, "dst", "$1", "src", "(.*)") * 1e-3 + Inf - 0x1F`,
+		},
+		{
+			name:     "comments",
+			query:    "up # not_a_metric\n+ down",
+			expected: "up{namespace=\"team-a\"} # not_a_metric\n+ down{namespace=\"team-a\"}",
+		},
+		{name: "no selectors", query: `vector(1) + time()`, expected: `vector(1) + time()`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			result, err := EnforceMatchers(tt.query, ns)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestEnforceMatchers_MultipleMatchers(t *testing.T) {
+	t.Parallel()
+	result, err := EnforceMatchers(`up{job="api"}`, NewMatcher("namespace", "team-a", "team-b"), NewMatcher("cluster", "prod"))
+	require.NoError(t, err)
+	assert.Equal(t, `up{job="api",namespace=~"team-a|team-b",cluster="prod"}`, result)
+}
+
+func TestEnforceMatchers_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "unterminated string", query: `up{job="api}`, expected: "unterminated string"},
+		{name: "unclosed braces", query: `up{job="api"`, expected: `unclosed "{"`},
+		{name: "unclosed range", query: `rate(up[5m)`, expected: `unexpected ")"`},
+		{name: "unclosed parenthesis", query: `sum(up`, expected: "unclosed left parenthesis"},
+		{name: "unexpected parenthesis", query: `up)`, expected: `unexpected ")"`},
+		{name: "unexpected brace", query: `up}`, expected: `unexpected "}"`},
+		{name: "nested braces", query: `up{job={}}`, expected: `unexpected "{"`},
+		{name: "unexpected identifier", query: `up down`, expected: `unexpected identifier "down"`},
+		{name: "unexpected character", query: `up; down`, expected: "unexpected character"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := EnforceMatchers(tt.query, NewMatcher("namespace", "team-a"))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type itemType int
+
+const (
+	itemIdentifier itemType = iota
+	itemNumber
+	itemString
+	itemOperator
+	itemLeftParen
+	itemRightParen
+	itemLeftBrace
+	itemRightBrace
+	itemLeftBracket
+	itemRightBracket
+	itemComma
+	itemEOF
+)
+
+// A lexical token of a PromQL expression, with its byte offsets in the input
+type item struct {
+	typ itemType
+	val string
+	pos int
+	end int
+}
+
+// Operators made of two characters, which are matched before single characters
+var twoCharOperators = []string{"==", "!=", ">=", "<=", "=~", "!~"}
+
+// Splits a PromQL expression into tokens. Only enough of the language is
+// understood to find selectors; whitespace and comments are dropped, and the
+// positions of the remaining tokens allow the input to be rewritten in place
+func lex(input string) ([]item, error) {
+	var items []item
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		start := pos
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '#':
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			end, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			items = append(items, item{typ: itemString, val: input[start:pos], pos: start, end: pos})
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			pos = lexNumber(input, pos)
+			items = append(items, item{typ: itemNumber, val: input[start:pos], pos: start, end: pos})
+			continue
+		case isIdentifierStart(c):
+			for pos < len(input) && isIdentifierChar(input[pos]) {
+				pos++
+			}
+			items = append(items, item{typ: itemIdentifier, val: input[start:pos], pos: start, end: pos})
+			continue
+		}
+
+		typ := itemOperator
+		switch c {
+		case '(':
+			typ = itemLeftParen
+		case ')':
+			typ = itemRightParen
+		case '{':
+			typ = itemLeftBrace
+		case '}':
+			typ = itemRightBrace
+		case '[':
+			typ = itemLeftBracket
+		case ']':
+			typ = itemRightBracket
+		case ',':
+			typ = itemComma
+		case '+', '-', '*', '/', '%', '^', '@', '=', '!', '<', '>':
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+		}
+
+		pos++
+		for _, op := range twoCharOperators {
+			if strings.HasPrefix(input[start:], op) {
+				pos = start + len(op)
+				break
+			}
+		}
+		items = append(items, item{typ: typ, val: input[start:pos], pos: start, end: pos})
+	}
+
+	items = append(items, item{typ: itemEOF, pos: len(input), end: len(input)})
+	return items, nil
+}
+
+// Returns the end offset of the quoted string starting at pos
+func lexString(input string, pos int) (int, error) {
+	quote := input[pos]
+	for i := pos + 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			// Raw strings have no escape sequences
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string starting at position %d", pos)
+}
+
+// Returns the end offset of the number or duration starting at pos, such as
+// 1.5, 0x1f, 1e-3 or 1h30m
+func lexNumber(input string, pos int) int {
+	hex := strings.HasPrefix(strings.ToLower(input[pos:]), "0x")
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case isIdentifierChar(c) && c != ':', c == '.':
+		case (c == '+' || c == '-') && !hex && (input[pos-1] == 'e' || input[pos-1] == 'E'):
+		default:
+			return pos
+		}
+		pos++
+	}
+	return pos
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
+
+// Returns the query with comments removed and its tokens separated by single
+// spaces, so queries differing only in formatting normalise to the same string
+func Normalize(query string) (string, error) {
+	items, err := lex(query)
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, 0, len(items)-1)
+	for _, it := range items[:len(items)-1] {
+		values = append(values, it.val)
+	}
+	return strings.Join(values, " "), nil
+}
+
+// Reports whether the query uses the @ start() or @ end() modifiers, which
+// are evaluated at the start or end of the whole range of a range query
+func UsesStartOrEnd(query string) (bool, error) {
+	items, err := lex(query)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i+2 < len(items); i++ {
+		at, name, paren := items[i], items[i+1], items[i+2]
+		if at.typ == itemOperator && at.val == "@" && name.typ == itemIdentifier &&
+			(name.val == "start" || name.val == "end") && paren.typ == itemLeftParen {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,81 @@
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLex(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{name: "selector", input: `up{job!~"a|b"}`, expected: []string{"up", "{", "job", "!~", `"a|b"`, "}"}},
+		{name: "escaped quote", input: `"a\"b" 'c'`, expected: []string{`"a\"b"`, `'c'`}},
+		{name: "raw string", input: "`a\\`", expected: []string{"`a\\`"}},
+		{name: "numbers", input: `1.5e+3 .5 0x1F 1h30m`, expected: []string{"1.5e+3", ".5", "0x1F", "1h30m"}},
+		{name: "subquery", input: `x[5m:1m]`, expected: []string{"x", "[", "5m", ":1m", "]"}},
+		{name: "comparison", input: `a>=b`, expected: []string{"a", ">=", "b"}},
+		{name: "comment", input: "a # b\nc", expected: []string{"a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			items, err := lex(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, itemEOF, items[len(items)-1].typ)
+
+			var values []string
+			for _, it := range items[:len(items)-1] {
+				assert.Equal(t, it.val, tt.input[it.pos:it.end])
+				values = append(values, it.val)
+			}
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	t.Parallel()
+	first, err := Normalize("sum by(job) (\n  rate(up{job=\"a b\"}[5m]) # comment\n)")
+	require.NoError(t, err)
+	second, err := Normalize(`sum by (job)(rate(up{job="a b"}[5m]))`)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, `sum by ( job ) ( rate ( up { job = "a b" } [ 5m ] ) )`, first)
+
+	_, err = Normalize(`up{job="a}`)
+	assert.Error(t, err)
+}
+
+func TestUsesStartOrEnd(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{query: `rate(x[5m])`},
+		{query: `rate(x[5m]) @ 1700000000`},
+		{query: `rate(x[5m]) @ start()`, expected: true},
+		{query: `sum(rate(x[5m] @end( )))`, expected: true},
+		{query: `max_over_time(x[1h:30s] offset 1d) @ start ()`, expected: true},
+		{query: `x{job="@ start()"} + start`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			t.Parallel()
+			uses, err := UsesStartOrEnd(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, uses)
+		})
+	}
+
+	_, err := UsesStartOrEnd(`x{job="unterminated}`)
+	assert.Error(t, err)
+}
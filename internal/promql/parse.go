@@ -0,0 +1,150 @@
+package promql
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selector is a vector selector of a query
+type Selector struct {
+	// The metric name, from before the braces or an equality matcher on
+	// __name__, empty if the selector matches any metric name
+	MetricName string
+	Matchers   []Matcher
+}
+
+// Query describes the selectors, functions and groupings used by a PromQL
+// expression, for policies which inspect queries without evaluating them
+type Query struct {
+	Selectors []Selector
+	// The functions and aggregation operators called, in order of use
+	Functions []string
+	// The labels of by and without clauses
+	Grouping []string
+	// The durations of range selectors and subqueries
+	Ranges []time.Duration
+}
+
+// Parses the parts of a query used by policies
+func Parse(query string) (*Query, error) {
+	p := &parser{query: &Query{}}
+	if err := walk(query, p); err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.query, nil
+}
+
+type parser struct {
+	query *Query
+	err   error
+}
+
+func (p *parser) selector(sel selectorItems) {
+	var selector Selector
+	if sel.name != nil {
+		selector.MetricName = sel.name.val
+	}
+
+	// Matchers are a label name or string, an operator and a string, while a
+	// lone string is a quoted metric name
+	var tokens []item
+	for _, it := range sel.braces {
+		switch it.typ {
+		case itemLeftBrace:
+		case itemComma, itemRightBrace:
+			if err := selector.addMatcher(tokens); err != nil {
+				p.setErr(err)
+			}
+			tokens = tokens[:0]
+		default:
+			tokens = append(tokens, it)
+		}
+	}
+	p.query.Selectors = append(p.query.Selectors, selector)
+}
+
+func (p *parser) function(name string) {
+	p.query.Functions = append(p.query.Functions, name)
+}
+
+func (p *parser) labelList(keyword string, labels []string) {
+	if keyword == "by" || keyword == "without" {
+		for _, label := range labels {
+			if !slices.Contains(p.query.Grouping, label) {
+				p.query.Grouping = append(p.query.Grouping, label)
+			}
+		}
+	}
+}
+
+func (p *parser) rangeSelector(brackets []item) {
+	// Subqueries are followed by a colon and optional resolution
+	if len(brackets) < 3 || brackets[1].typ != itemNumber {
+		p.setErr(fmt.Errorf("invalid range at position %d", brackets[0].pos))
+		return
+	}
+	duration, err := ParseDuration(brackets[1].val)
+	if err != nil {
+		p.setErr(fmt.Errorf("invalid range at position %d: %w", brackets[1].pos, err))
+		return
+	}
+	p.query.Ranges = append(p.query.Ranges, duration)
+}
+
+// Records the first error found while parsing
+func (p *parser) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Adds the matcher made of the tokens between two commas of a selector
+func (s *Selector) addMatcher(tokens []item) error {
+	switch {
+	case len(tokens) == 0:
+		return nil
+	case len(tokens) == 1 && tokens[0].typ == itemString:
+		s.MetricName = unquote(tokens[0].val)
+		return nil
+	case len(tokens) != 3 || tokens[1].typ != itemOperator || tokens[2].typ != itemString:
+		return fmt.Errorf("invalid label matcher at position %d", tokens[0].pos)
+	}
+
+	m := Matcher{Name: unquote(tokens[0].val), Type: tokens[1].val, Value: unquote(tokens[2].val)}
+	switch m.Type {
+	case "=", "!=", "=~", "!~":
+	default:
+		return fmt.Errorf("invalid label matcher operator %q at position %d", m.Type, tokens[1].pos)
+	}
+	if m.Name == "__name__" && m.Type == "=" {
+		s.MetricName = m.Value
+	}
+	s.Matchers = append(s.Matchers, m)
+	return nil
+}
+
+// Returns the value of a quoted string, or the input if it is not quoted
+func unquote(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	switch s[0] {
+	case '"', '`':
+		if value, err := strconv.Unquote(s); err == nil {
+			return value
+		}
+	case '\'':
+		// Go only supports single quotes around a single character
+		inner := strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`)
+		if value, err := strconv.Unquote(`"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`); err == nil {
+			return value
+		}
+	}
+	return s
+}
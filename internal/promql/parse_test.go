@@ -0,0 +1,79 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		query    string
+		expected *Query
+	}{
+		{
+			name:  "selectors",
+			query: `up{job="api", instance!~'db-.*'} / {__name__="scrape_duration_seconds"} + {"http.requests"}`,
+			expected: &Query{Selectors: []Selector{
+				{MetricName: "up", Matchers: []Matcher{{Name: "job", Type: "=", Value: "api"}, {Name: "instance", Type: "!~", Value: "db-.*"}}},
+				{MetricName: "scrape_duration_seconds", Matchers: []Matcher{{Name: "__name__", Type: "=", Value: "scrape_duration_seconds"}}},
+				{MetricName: "http.requests"},
+			}},
+		},
+		{
+			name:  "functions and grouping",
+			query: `count by (__name__) ({__name__=~".+"}) > on(job) group_left sum without(instance) (rate(x[5m]))`,
+			expected: &Query{
+				Selectors: []Selector{
+					{Matchers: []Matcher{{Name: "__name__", Type: "=~", Value: ".+"}}},
+					{MetricName: "x"},
+				},
+				Functions: []string{"count", "sum", "rate"},
+				Grouping:  []string{"__name__", "instance"},
+				Ranges:    []time.Duration{5 * time.Minute},
+			},
+		},
+		{
+			name:  "ranges and subqueries",
+			query: `max_over_time(rate(x[1h])[7d:5m]) offset 1d`,
+			expected: &Query{
+				Selectors: []Selector{{MetricName: "x"}},
+				Functions: []string{"max_over_time", "rate"},
+				Ranges:    []time.Duration{time.Hour, 7 * 24 * time.Hour},
+			},
+		},
+		{
+			name:     "trailing grouping",
+			query:    `topk(5, y) by (job)`,
+			expected: &Query{Selectors: []Selector{{MetricName: "y"}}, Functions: []string{"topk"}, Grouping: []string{"job"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			query, err := Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	t.Parallel()
+	_, err := Parse(`up{job}`)
+	assert.ErrorContains(t, err, "invalid label matcher")
+
+	_, err = Parse(`up{job+"api"}`)
+	assert.ErrorContains(t, err, `invalid label matcher operator "+"`)
+
+	_, err = Parse(`rate(up[5x])`)
+	assert.ErrorContains(t, err, "invalid range")
+
+	_, err = Parse(`sum(up`)
+	assert.ErrorContains(t, err, "unclosed left parenthesis")
+}
@@ -0,0 +1,239 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregation operators, which may be followed by a by or without clause
+// before their parameters
+var aggregators = map[string]bool{
+	"sum": true, "min": true, "max": true, "avg": true, "group": true,
+	"stddev": true, "stdvar": true, "count": true, "count_values": true,
+	"bottomk": true, "topk": true, "quantile": true, "limitk": true,
+	"limit_ratio": true,
+}
+
+// Keywords which may follow a complete operand
+var infixKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "atan2": true, "offset": true,
+	"by": true, "without": true,
+}
+
+// Keywords followed by a parenthesised list of label names
+var labelListKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true,
+}
+
+// A vector selector found in a query
+type selectorItems struct {
+	// The metric name preceding the braces, if any
+	name *item
+	// The braces and the label matchers between them, if any
+	braces []item
+}
+
+// Receives the parts of a query found by a walker
+type visitor interface {
+	selector(sel selectorItems)
+	function(name string)
+	labelList(keyword string, labels []string)
+	// Called with the brackets of a range or subquery and their contents
+	rangeSelector(brackets []item)
+}
+
+// Walks the tokens of a query, reporting its selectors, function calls and
+// label lists to a visitor
+type walker struct {
+	items   []item
+	visitor visitor
+	pos     int
+}
+
+// Walks the query, returning an error if it cannot be parsed
+func walk(query string, v visitor) error {
+	items, err := lex(query)
+	if err != nil {
+		return err
+	}
+	return (&walker{items: items, visitor: v}).walk()
+}
+
+func (w *walker) peek() item {
+	return w.items[w.pos+1]
+}
+
+func (w *walker) walk() error {
+	depth := 0
+	// Whether the next token begins an operand, rather than following one
+	expectOperand := true
+	var prev item
+
+	for w.items[w.pos].typ != itemEOF {
+		it := w.items[w.pos]
+		switch it.typ {
+		case itemLeftParen:
+			depth++
+			expectOperand = true
+		case itemRightParen:
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unexpected %q at position %d", it.val, it.pos)
+			}
+			expectOperand = false
+		case itemComma, itemOperator:
+			expectOperand = true
+		case itemNumber, itemString:
+			expectOperand = false
+		case itemLeftBracket:
+			// Ranges and subqueries contain only durations
+			open := w.pos
+			if err := w.skipTo(itemRightBracket); err != nil {
+				return err
+			}
+			w.visitor.rangeSelector(w.items[open : w.pos+1])
+			expectOperand = false
+		case itemLeftBrace:
+			if err := w.selector(nil); err != nil {
+				return err
+			}
+			expectOperand = false
+		case itemRightBrace, itemRightBracket:
+			return fmt.Errorf("unexpected %q at position %d", it.val, it.pos)
+		case itemIdentifier:
+			var err error
+			expectOperand, err = w.identifier(it, prev, expectOperand)
+			if err != nil {
+				return err
+			}
+		}
+		prev = w.items[w.pos]
+		w.pos++
+	}
+
+	if depth > 0 {
+		return fmt.Errorf("unclosed left parenthesis")
+	}
+	return nil
+}
+
+// Handles an identifier, which is a metric name, function, keyword or number,
+// returning whether an operand is expected next
+func (w *walker) identifier(it, prev item, expectOperand bool) (bool, error) {
+	keyword := strings.ToLower(it.val)
+	next := w.peek()
+
+	switch {
+	// Keywords are valid metric names, so anything followed by braces selects
+	case next.typ == itemLeftBrace:
+		w.pos++
+		return false, w.selector(&it)
+
+	case !expectOperand:
+		if !infixKeywords[keyword] {
+			return false, fmt.Errorf("unexpected identifier %q at position %d", it.val, it.pos)
+		}
+		if labelListKeywords[keyword] {
+			// A trailing by or without clause completes the aggregation
+			return false, w.labelList(keyword)
+		}
+		return true, nil
+
+	case next.typ == itemLeftParen && !labelListKeywords[keyword]:
+		// Function calls and aggregations; the parenthesis is handled next
+		w.visitor.function(it.val)
+		return true, nil
+
+	case aggregators[keyword] && next.typ == itemIdentifier &&
+		(strings.EqualFold(next.val, "by") || strings.EqualFold(next.val, "without")):
+		w.visitor.function(it.val)
+		w.pos++
+		return true, w.labelList(strings.ToLower(next.val))
+
+	case (keyword == "on" || keyword == "ignoring") && isBinaryOperator(prev):
+		return true, w.labelList(keyword)
+
+	case (keyword == "group_left" || keyword == "group_right") && prev.typ == itemRightParen:
+		return true, w.labelList(keyword)
+
+	case keyword == "bool" && isComparison(prev):
+		return true, nil
+
+	case keyword == "inf" || keyword == "nan":
+		return false, nil
+	}
+
+	w.visitor.selector(selectorItems{name: &it})
+	return false, nil
+}
+
+// Reports the optional label list following the keyword at the current
+// position
+func (w *walker) labelList(keyword string) error {
+	if w.peek().typ != itemLeftParen {
+		return nil
+	}
+	w.pos++
+	open := w.pos
+	if err := w.skipTo(itemRightParen); err != nil {
+		return err
+	}
+
+	var labels []string
+	for _, it := range w.items[open+1 : w.pos] {
+		if it.typ == itemIdentifier || it.typ == itemString {
+			labels = append(labels, unquote(it.val))
+		}
+	}
+	w.visitor.labelList(keyword, labels)
+	return nil
+}
+
+// Reports the selector whose opening brace is at the current position
+func (w *walker) selector(name *item) error {
+	open := w.pos
+	if err := w.skipTo(itemRightBrace); err != nil {
+		return err
+	}
+	w.visitor.selector(selectorItems{name: name, braces: w.items[open : w.pos+1]})
+	return nil
+}
+
+// Advances to the closing token matching the opening token at the current
+// position, which may only contain label names, strings and commas
+func (w *walker) skipTo(closing itemType) error {
+	open := w.items[w.pos]
+	for {
+		w.pos++
+		it := w.items[w.pos]
+		switch it.typ {
+		case closing:
+			return nil
+		case itemEOF:
+			return fmt.Errorf("unclosed %q at position %d", open.val, open.pos)
+		case itemLeftParen, itemRightParen, itemLeftBrace, itemRightBrace, itemLeftBracket, itemRightBracket:
+			return fmt.Errorf("unexpected %q at position %d", it.val, it.pos)
+		}
+	}
+}
+
+// Reports whether the token is a binary operator, after which vector matching
+// keywords may appear
+func isBinaryOperator(it item) bool {
+	if it.typ == itemOperator {
+		return it.val != "@" && it.val != "=~" && it.val != "!~"
+	}
+	keyword := strings.ToLower(it.val)
+	return it.typ == itemIdentifier && (keyword == "and" || keyword == "or" || keyword == "unless" || keyword == "atan2")
+}
+
+// Reports whether the token is a comparison operator, which may be followed by
+// the bool modifier
+func isComparison(it item) bool {
+	switch it.val {
+	case "==", "!=", ">", "<", ">=", "<=":
+		return it.typ == itemOperator
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+// Implements an endpoint returning the hit and miss counts and size of each
+// named cache as JSON
+func CacheStatsHandler(appLogger *logger.Logger, url string, caches map[string]cache.Cache) {
+	http.Handle(url, cacheStatsHandler(appLogger, caches))
+}
+
+func cacheStatsHandler(appLogger *logger.Logger, caches map[string]cache.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := appLogger.WithRequestFields(r)
+		l.Debug("processing cache stats request")
+
+		if !allowGet(l, w, r) {
+			return
+		}
+
+		stats := make(map[string]cache.Stats, len(caches))
+		for name, c := range caches {
+			stats[name] = c.Stats()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			l.Error("failed to encode cache stats response", "error", err)
+		}
+		l.Debug("request completed", "status_code", http.StatusOK)
+	})
+}
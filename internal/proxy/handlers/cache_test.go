@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStatsHandler(t *testing.T) {
+	t.Parallel()
+	results := cache.NewMemory(100)
+	results.Set("a", []byte("1"), 0)
+	results.Get("a")
+	results.Get("b")
+	handler := cacheStatsHandler(testutil.CreateTestLogger(t), map[string]cache.Cache{
+		"results":  results,
+		"metadata": cache.NewMemory(100),
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, testutil.CreateHTTPRequest(t, http.MethodGet, "/-/cache", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"results": {"hits": 1, "misses": 1, "entries": 1, "bytes": 2},
+		"metadata": {"hits": 0, "misses": 0, "entries": 0, "bytes": 0}
+	}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, testutil.CreateHTTPRequest(t, http.MethodPost, "/-/cache", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, http.MethodGet, recorder.Header().Get("Allow"))
+	assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"method not allowed"}`, recorder.Body.String())
+}
@@ -1,17 +1,21 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
 )
 
+var errNotFound = errors.New("not found")
+
 // Implements a catch all endpoint to log calls to unimplemented paths
 func NotFoundRequestHandler(appLogger *logger.Logger) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		l := appLogger.WithRequestFields(r)
 		l.Info("processing unimplemented path request")
-		http.NotFound(w, r)
+		promapi.WriteError(w, http.StatusNotFound, promapi.ErrorNotFound, errNotFound)
 		l.Info("request completed", "status_code", http.StatusNotFound)
 	})
 }
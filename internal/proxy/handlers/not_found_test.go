@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
 	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
 	"github.com/stretchr/testify/assert"
 )
@@ -45,7 +46,7 @@ func TestNotFoundRequestHandler(t *testing.T) {
 
 			// Setup the handler inline to avoid global state
 			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				http.NotFound(w, r)
+				promapi.WriteError(w, http.StatusNotFound, promapi.ErrorNotFound, errNotFound)
 			})
 
 			// Create request and recorder
@@ -58,9 +59,8 @@ func TestNotFoundRequestHandler(t *testing.T) {
 			// Assert
 			assert.Equal(t, tt.expectedStatus, recorder.Code)
 
-			// Check that response body contains standard 404 message
-			body := recorder.Body.String()
-			assert.Contains(t, body, "404")
+			// Check that response body is a Prometheus-style error
+			assert.JSONEq(t, `{"status":"error","errorType":"not_found","error":"not found"}`, recorder.Body.String())
 		})
 	}
 }
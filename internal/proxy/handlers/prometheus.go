@@ -1,20 +1,40 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
 	"github.com/s-humphreys/prometheus-proxy/internal/config"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 )
 
+// The most of a request body included in logs
+const maxLoggedBodyBytes = 1024
+
+// The most of an upstream error response read to check whether it is a
+// Prometheus error
+const maxUpstreamErrorBytes = 1 << 20
+
 // Creates an upstream URL for the Prometheus server based on the request,
-// including the path and query parameters
+// including the path and, for GET requests, the query parameters. POST
+// requests carry all of their parameters in the body
 func constructPrometheusURL(logger *logger.Logger, prometheusUrl string, r *http.Request) string {
 	upstreamUrl := prometheusUrl + r.URL.Path
-	if r.Method == http.MethodGet && r.URL.RawQuery != "" {
+	// The query string of a POST request is forwarded in its form body, which
+	// other bodies cannot carry
+	if r.URL.RawQuery != "" && (r.Method == http.MethodGet || !promapi.IsFormRequest(r)) {
 		upstreamUrl = fmt.Sprintf("%s?%s", upstreamUrl, r.URL.RawQuery)
 	}
 	logger.Debug("constructed upstream prometheus URL", "prometheus_url", upstreamUrl)
@@ -36,91 +56,300 @@ func redactedHeaders(header http.Header) http.Header {
 	return filteredHeader
 }
 
+// Returns whether the Prometheus API accepts POST requests for the path. The
+// label values endpoint only accepts GET requests
+func postSupported(path string) bool {
+	switch path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/labels", "/api/v1/format_query", "/api/v1/parse_query":
+		return true
+	}
+	return false
+}
+
+// Returns a copy of a GET request as a POST request without a body, which is
+// forwarded with its query string as the form body
+func getAsPost(r *http.Request) *http.Request {
+	post := r.Clone(r.Context())
+	post.Method = http.MethodPost
+	post.Body = http.NoBody
+	post.ContentLength = 0
+	post.Header.Set("Content-Type", promapi.FormContentType)
+	return post
+}
+
+// Returns the body of a POST request to stream upstream, its length or -1 if
+// unknown, and a prefix of at most maxLoggedBodyBytes for logging. The query
+// string is forwarded in a form body, merged with it as Prometheus would merge
+// them. Only forms with both are read into memory, unless a middleware has
+// already read the body to inspect its parameters. Other bodies are forwarded
+// untouched
+func upstreamBody(l *logger.Logger, r *http.Request) (io.Reader, int64, string, error) {
+	form := promapi.IsFormRequest(r)
+	// Only forms with a query string are buffered to merge the parameters
+	if form && r.URL.RawQuery != "" {
+		if _, err := promapi.RequestParams(r); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	body := bufio.NewReaderSize(r.Body, maxLoggedBodyBytes+1)
+	prefix, err := body.Peek(maxLoggedBodyBytes + 1)
+	if err != nil && err != io.EOF {
+		return nil, 0, "", fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if form && len(prefix) == 0 {
+		l.Debug("got request with empty body, using URL query as body", "query", r.URL.RawQuery)
+		query := []byte(r.URL.RawQuery)
+		return bytes.NewReader(query), int64(len(query)), truncate(r.URL.RawQuery), nil
+	}
+
+	length := r.ContentLength
+	if length <= 0 {
+		length = -1
+	}
+	return body, length, truncate(string(prefix)), nil
+}
+
+// Truncates a request body for logging, marking that it was truncated
+func truncate(body string) string {
+	if len(body) <= maxLoggedBodyBytes {
+		return body
+	}
+	return strings.ToValidUTF8(body[:maxLoggedBodyBytes], "") + "...(truncated)"
+}
+
+// Limits the size of request bodies, which are read by the middlewares
+// before being forwarded
+func limitBody(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			promapi.WriteError(w, http.StatusRequestEntityTooLarge, promapi.ErrorBadData, &http.MaxBytesError{Limit: maxBytes})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the status of a failed upstream call, distinguishing callers which
+// disconnected, requests which timed out and bodies which were too large from
+// an unreachable upstream
+func upstreamErrorStatus(r *http.Request, err error) int {
+	var netErr net.Error
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		return promapi.StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 // Handles a request which requires authentication. Invokes the implemented clients
 // required headers, and forwards the request to the upstream Prometheus server, before
 // returning the response to the original client
 func PrometheusRequestHandler(logger *logger.Logger, conf *config.Config, pattern string) {
-	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+	defaultHTTPClient := conf.HTTPClient
+	if defaultHTTPClient == nil {
+		defaultHTTPClient = http.DefaultClient
+	}
+	headerPolicy := conf.Headers
+	if headerPolicy == nil {
+		headerPolicy = &headerpolicy.Policy{}
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
-		l := logger.WithRequestFields(r)
+		ctx := r.Context()
+		var fields []any
+		if identity, ok := inbound.IdentityFromContext(ctx); ok {
+			fields = append(fields, "caller", identity.Name, "auth_method", identity.Method)
+		}
+
+		// Requests routed to a named upstream use its URL, credentials and
+		// TLS server name
+		prometheusUrl, client, httpClient := conf.PrometheusUrl, conf.Client, defaultHTTPClient
+		if u, ok := upstream.FromContext(ctx); ok {
+			prometheusUrl, client = u.URL, u.Client
+			if u.HTTPClient != nil {
+				httpClient = u.HTTPClient
+			}
+			fields = append(fields, "upstream", u.Name)
+		}
+		l := logger.WithRequestFields(r, fields...)
 		l.Info("processing request")
 
-		ctx := r.Context()
-		promUrl := constructPrometheusURL(l, conf.PrometheusUrl, r)
+		if conf.MaxGetQueryLength > 0 && r.Method == http.MethodGet && len(r.URL.RawQuery) > conf.MaxGetQueryLength && postSupported(r.URL.Path) {
+			l.Debug("converting long GET request to POST", "query_length", len(r.URL.RawQuery))
+			r = getAsPost(r)
+		}
+		promUrl := constructPrometheusURL(l, prometheusUrl, r)
 
-		// Copy body if the request method is POST & store for logging/forwarding
+		// POST bodies are streamed upstream, keeping only a prefix for logging
 		var bodyForUpstream io.Reader
-		var requestBodyBytes []byte
-
+		var bodyLength int64
+		var bodyPrefix string
 		if r.Method == http.MethodPost {
-			var errReadBody error
-			requestBodyBytes, errReadBody = io.ReadAll(r.Body)
-			if errReadBody != nil {
-				l.Error("failed to read request body for logging", "error", errReadBody)
-				http.Error(w, "failed to read request body: "+errReadBody.Error(), http.StatusInternalServerError)
+			var err error
+			bodyForUpstream, bodyLength, bodyPrefix, err = upstreamBody(l, r)
+			if err != nil {
+				l.Error("failed to read request body", "error", err)
+				promapi.WriteParamsError(w, err)
 				return
 			}
 
-			if len(requestBodyBytes) == 0 && r.URL.RawQuery != "" {
-				l.Debug("got request with empty body and URL query parameters, using URL query as body.", "query", r.URL.RawQuery)
-				requestBodyBytes = []byte(r.URL.RawQuery)
+			// Signers hash the body, so it is buffered to be read twice
+			if auth.SignsRequests(client) {
+				body, err := io.ReadAll(bodyForUpstream)
+				if err != nil {
+					l.Error("failed to read request body", "error", err)
+					promapi.WriteParamsError(w, fmt.Errorf("failed to read request body: %w", err))
+					return
+				}
+				bodyForUpstream, bodyLength = bytes.NewReader(body), int64(len(body))
 			}
-
-			l.Debug("copying request body for POST method")
-			bodyForUpstream = bytes.NewBuffer(requestBodyBytes)
 		}
 
 		req, err := http.NewRequestWithContext(ctx, r.Method, promUrl, bodyForUpstream)
 		if err != nil {
 			l.Error("failed to create upstream request", "error", err)
-			http.Error(w, "failed to create upstream request: "+err.Error(), http.StatusInternalServerError)
+			promapi.WriteError(w, http.StatusInternalServerError, promapi.ErrorInternal, fmt.Errorf("failed to create upstream request: %w", err))
 			return
 		}
+		if bodyForUpstream != nil {
+			req.ContentLength = bodyLength
+		}
 
-		if r.Method == http.MethodPost && bodyForUpstream != nil {
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// Only caller headers allowed by the policy are forwarded
+		headerPolicy.ForwardRequest(req.Header, r.Header)
+		if contentType := r.Header.Get("Content-Type"); r.Method == http.MethodPost && contentType != "" {
+			req.Header.Set("Content-Type", contentType)
 		}
 
 		// Add required auth client headers to request
-		headers, err := conf.Client.GetHeaders(ctx)
+		headers, err := client.GetHeaders(ctx)
 		if err != nil {
 			l.Error("failed to create client headers", "error", err)
-			http.Error(w, "failed to create client headers: "+err.Error(), http.StatusInternalServerError)
+			promapi.WriteError(w, http.StatusInternalServerError, promapi.ErrorInternal, fmt.Errorf("failed to create client headers: %w", err))
 			return
 		}
+		// Auth headers replace any caller header of the same name
+		for _, h := range headers {
+			req.Header.Del(h.Key)
+		}
 		for _, h := range headers {
 			req.Header.Add(h.Key, h.Value)
 		}
 
+		// Clients such as AWS SigV4 authenticate the complete request
+		if signer, ok := client.(auth.RequestSigner); ok {
+			if err := signer.SignRequest(req); err != nil {
+				l.Error("failed to sign upstream request", "error", err)
+				promapi.WriteError(w, http.StatusInternalServerError, promapi.ErrorInternal, fmt.Errorf("failed to sign upstream request: %w", err))
+				return
+			}
+		}
+
 		l.Info("forwarding request to upstream prometheus",
 			"prometheus_url", promUrl,
 			"headers", redactedHeaders(req.Header),
-			"body", string(requestBodyBytes),
+			"body", bodyPrefix,
 		)
 
 		// Make the request to the upstream Prometheus server
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
 			l.Error("failed to call upstream", "error", err)
-			http.Error(w, "failed to call upstream: "+err.Error(), http.StatusBadGateway)
+			statusCode := upstreamErrorStatus(r, err)
+			promapi.WriteError(w, statusCode, promapi.ErrorTypeForStatus(statusCode), fmt.Errorf("failed to call upstream: %w", err))
 			return
 		}
 		defer resp.Body.Close()
 
-		// Return response to the original client
-		for k, v := range resp.Header {
-			for _, vv := range v {
-				w.Header().Add(k, vv)
+		// Errors from gateways in front of Prometheus, such as Azure's, are
+		// translated so clients can display them
+		var respBody io.Reader = resp.Body
+		if resp.StatusCode >= http.StatusBadRequest {
+			prefix, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBytes))
+			if err == nil && !promapi.IsErrorResponse(prefix) {
+				message := promapi.ErrorMessage(resp.StatusCode, prefix)
+				l.Warn("translated non-prometheus upstream error", "status_code", resp.StatusCode, "error", message)
+				promapi.WriteError(w, resp.StatusCode, promapi.ErrorTypeForStatus(resp.StatusCode), fmt.Errorf("upstream returned status %d: %s", resp.StatusCode, message))
+				return
 			}
+			respBody = io.MultiReader(bytes.NewReader(prefix), resp.Body)
 		}
+
+		// Return response to the original client
+		headerpolicy.ForwardResponse(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
 
-		_, err = io.Copy(w, resp.Body)
+		_, err = io.Copy(w, respBody)
 		if err != nil {
 			l.Error("failed to copy response body", "error", err)
 		}
 
 		l.Info("request completed", "status_code", resp.StatusCode)
 	})
+
+	// Identical requests in flight at once share one upstream request
+	if conf.Deduplicator != nil {
+		handler = conf.Deduplicator.Middleware(logger, handler)
+	}
+
+	// Cached steps are served without forwarding
+	if conf.ResultsCache != nil {
+		handler = conf.ResultsCache.Middleware(logger, handler)
+	}
+
+	// Cached label, series and metadata responses are served without forwarding
+	if conf.MetadataCache != nil {
+		handler = conf.MetadataCache.Middleware(logger, handler)
+	}
+
+	// Requests which forward different headers never share responses
+	cached := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cached.ServeHTTP(w, r.WithContext(headerpolicy.WithPolicy(r.Context(), headerPolicy)))
+	})
+
+	// Each sub-range of a split query is forwarded separately
+	if conf.Splitter != nil {
+		handler = conf.Splitter.Middleware(logger, handler)
+	}
+
+	// Queries are restricted to the caller's label values before forwarding
+	if conf.Tenancy != nil {
+		handler = conf.Tenancy.Middleware(logger, handler)
+	}
+
+	if conf.Limits.IsSet() {
+		handler = conf.Limits.Middleware(logger, handler)
+	}
+
+	// Policies apply to the query as written by the caller
+	if conf.Policy != nil {
+		handler = conf.Policy.Middleware(logger, handler)
+	}
+
+	// The upstream is selected for the authenticated caller, removing any
+	// upstream path prefix before the request is inspected
+	if conf.Upstreams != nil {
+		handler = conf.Upstreams.Middleware(logger, handler)
+	}
+
+	// Callers must authenticate before any upstream credentials are attached
+	if len(conf.Inbound) > 0 {
+		handler = inbound.Middleware(logger, conf.Inbound, handler)
+	}
+
+	if conf.MaxRequestBodyBytes > 0 {
+		handler = limitBody(conf.MaxRequestBodyBytes, handler)
+	}
+	http.Handle(pattern, handler)
 }
@@ -1,11 +1,25 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/config"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
 	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConstructPrometheusURL(t *testing.T) {
@@ -18,6 +32,7 @@ func TestConstructPrometheusURL(t *testing.T) {
 		prometheusUrl string
 		requestURL    string
 		method        string
+		contentType   string
 		expected      string
 	}{
 		{
@@ -34,6 +49,22 @@ func TestConstructPrometheusURL(t *testing.T) {
 			method:        "POST",
 			expected:      "http://prometheus:9090/api/v1/query",
 		},
+		{
+			name:          "POST form with query parameters",
+			prometheusUrl: promUrl,
+			requestURL:    "/api/v1/query?query=up",
+			method:        "POST",
+			contentType:   "application/x-www-form-urlencoded",
+			expected:      "http://prometheus:9090/api/v1/query",
+		},
+		{
+			name:          "POST other body with query parameters",
+			prometheusUrl: promUrl,
+			requestURL:    "/api/v1/query?query=up",
+			method:        "POST",
+			contentType:   "application/json",
+			expected:      "http://prometheus:9090/api/v1/query?query=up",
+		},
 		{
 			name:          "GET without query parameters",
 			prometheusUrl: promUrl,
@@ -47,6 +78,7 @@ func TestConstructPrometheusURL(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			req := testutil.CreateHTTPRequest(t, tt.method, tt.requestURL, nil)
+			req.Header.Set("Content-Type", tt.contentType)
 			result := constructPrometheusURL(logger, tt.prometheusUrl, req)
 			assert.Equal(t, tt.expected, result)
 		})
@@ -103,3 +135,494 @@ func TestRedactedHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusRequestHandler_Errors(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("query") {
+		case "gateway":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html><head><title>502 Bad Gateway</title></head></html>"))
+		case "throttled":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"code":"TooManyRequests","message":"Request rate exceeded."}}`))
+		case "slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			promapi.WriteError(w, http.StatusBadRequest, promapi.ErrorBadData, errors.New("parse error"))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name          string
+		prometheusUrl string
+		query         string
+		client        auth.Client
+		httpClient    *http.Client
+		expectedCode  int
+		expectedBody  string
+	}{
+		{
+			name:         "non-prometheus html error",
+			query:        "gateway",
+			expectedCode: http.StatusBadGateway,
+			expectedBody: `{"status":"error","errorType":"unavailable","error":"upstream returned status 502: 502 Bad Gateway"}`,
+		},
+		{
+			name:         "non-prometheus json error",
+			query:        "throttled",
+			expectedCode: http.StatusTooManyRequests,
+			expectedBody: `{"status":"error","errorType":"unavailable","error":"upstream returned status 429: TooManyRequests: Request rate exceeded."}`,
+		},
+		{
+			name:         "prometheus error",
+			query:        "up[",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+		},
+		{
+			name:          "unreachable upstream",
+			prometheusUrl: closed.URL,
+			query:         "up",
+			expectedCode:  http.StatusBadGateway,
+		},
+		{
+			name:         "upstream timeout",
+			query:        "slow",
+			httpClient:   &http.Client{Timeout: 10 * time.Millisecond},
+			expectedCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:         "upstream credentials failure",
+			query:        "up",
+			client:       &failingClient{},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: `{"status":"error","errorType":"internal","error":"failed to create client headers: token unavailable"}`,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			conf := &config.Config{
+				PrometheusUrl: upstream.URL,
+				Client:        &auth.HeadersClient{},
+				HTTPClient:    tt.httpClient,
+			}
+			if tt.prometheusUrl != "" {
+				conf.PrometheusUrl = tt.prometheusUrl
+			}
+			if tt.client != nil {
+				conf.Client = tt.client
+			}
+
+			// Each case registers its own pattern on the default mux
+			pattern := fmt.Sprintf("/test/errors/%d", i)
+			PrometheusRequestHandler(testutil.CreateTestLogger(t), conf, pattern)
+
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, pattern+"?query="+tt.query, http.NoBody)
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+				return
+			}
+			var resp promapi.Response
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, promapi.ErrorTypeForStatus(tt.expectedCode), resp.ErrorType)
+		})
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil).WithContext(ctx)
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query", nil)
+
+	assert.Equal(t, promapi.StatusClientClosedRequest, upstreamErrorStatus(canceled, context.Canceled))
+	assert.Equal(t, http.StatusGatewayTimeout, upstreamErrorStatus(req, context.DeadlineExceeded))
+	assert.Equal(t, http.StatusBadGateway, upstreamErrorStatus(req, errors.New("connection refused")))
+}
+
+func TestPrometheusRequestHandler_Headers(t *testing.T) {
+	t.Parallel()
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	conf := &config.Config{
+		PrometheusUrl: upstream.URL,
+		Client:        &auth.HeadersClient{Headers: map[string]string{"X-Scope-OrgID": "tenant-1"}},
+		Headers:       &headerpolicy.Policy{Allow: []string{"X-Scope-OrgID", "X-Custom"}},
+	}
+	PrometheusRequestHandler(testutil.CreateTestLogger(t), conf, "/test/headers")
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/test/headers?match[]=up", http.NoBody)
+	req.Header.Set("User-Agent", "Grafana/11.0.0")
+	req.Header.Set("X-Custom", "1")
+	req.Header.Set("X-Scope-OrgID", "tenant-2")
+	req.Header.Set("Authorization", "Bearer caller-token")
+	req.Header.Set("Cookie", "grafana_session=abc")
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Grafana/11.0.0", upstreamHeader.Get("User-Agent"))
+	assert.Equal(t, "1", upstreamHeader.Get("X-Custom"))
+	// Callers cannot override or smuggle upstream credentials
+	assert.Equal(t, []string{"tenant-1"}, upstreamHeader.Values("X-Scope-OrgID"))
+	assert.Empty(t, upstreamHeader.Get("Authorization"))
+	assert.Empty(t, upstreamHeader.Get("Cookie"))
+	// Hop-by-hop response headers are not returned to the caller
+	assert.Empty(t, w.Header().Get("X-Hop"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
+
+func TestPrometheusRequestHandler_Body(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"content_type":%q,"query":%q,"body":%q}`, r.Header.Get("Content-Type"), r.URL.RawQuery, body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	conf := &config.Config{
+		PrometheusUrl:       upstream.URL,
+		Client:              &auth.HeadersClient{},
+		MaxRequestBodyBytes: 2048,
+	}
+	PrometheusRequestHandler(testutil.CreateTestLogger(t), conf, "/test/body")
+
+	tests := []struct {
+		name         string
+		target       string
+		contentType  string
+		body         io.Reader
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "form body",
+			target:       "/test/body",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         strings.NewReader("query=up"),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"application/x-www-form-urlencoded","query":"","body":"query=up"}`,
+		},
+		{
+			name:         "query string as body",
+			target:       "/test/body?query=up",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         http.NoBody,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"application/x-www-form-urlencoded","query":"","body":"query=up"}`,
+		},
+		{
+			name:         "form body merged with query string",
+			target:       "/test/body?start=1&query=ignored",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         strings.NewReader("query=up"),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"application/x-www-form-urlencoded","query":"","body":"query=up&query=ignored&start=1"}`,
+		},
+		{
+			name:         "other body forwarded untouched",
+			target:       "/test/body?query=up",
+			contentType:  "application/json",
+			body:         strings.NewReader(`{"query":"ignored"}`),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"application/json","query":"query=up","body":"{\"query\":\"ignored\"}"}`,
+		},
+		{
+			name:         "body without content type forwarded untouched",
+			target:       "/test/body?query=up",
+			body:         strings.NewReader("query=ignored"),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"","query":"query=up","body":"query=ignored"}`,
+		},
+		{
+			name:         "body larger than the logged prefix",
+			target:       "/test/body",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         strings.NewReader("query=" + strings.Repeat("a", 1500)),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"content_type":"application/x-www-form-urlencoded","query":"","body":"query=` + strings.Repeat("a", 1500) + `"}`,
+		},
+		{
+			name:         "body too large",
+			target:       "/test/body",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         strings.NewReader("query=" + strings.Repeat("a", 2048)),
+			expectedCode: http.StatusRequestEntityTooLarge,
+			expectedBody: `{"status":"error","errorType":"bad_data","error":"http: request body too large"}`,
+		},
+		{
+			name:         "chunked body too large",
+			target:       "/test/body",
+			contentType:  "application/x-www-form-urlencoded",
+			body:         io.MultiReader(strings.NewReader("query="), strings.NewReader(strings.Repeat("a", 2048))),
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodPost, tt.target, tt.body)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrometheusRequestHandler_StreamsBody(t *testing.T) {
+	t.Parallel()
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := make([]byte, 1500)
+		_, err := io.ReadFull(r.Body, prefix)
+		close(received)
+		rest, _ := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"length":%d}`, len(prefix)+len(rest))
+	}))
+	t.Cleanup(upstream.Close)
+
+	conf := &config.Config{
+		PrometheusUrl:       upstream.URL,
+		Client:              &auth.HeadersClient{},
+		MaxRequestBodyBytes: 1 << 20,
+	}
+	PrometheusRequestHandler(testutil.CreateTestLogger(t), conf, "/test/stream")
+
+	// The end of the body is only sent once the upstream has received its
+	// start, which it never would if the body were read in full first
+	body, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("query=" + strings.Repeat("a", 2000)))
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("upstream did not receive the body before it was complete")
+		}
+		writer.Write([]byte(strings.Repeat("a", 2000)))
+		writer.Close()
+	}()
+
+	req := testutil.CreateHTTPRequest(t, http.MethodPost, "/test/stream", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"length":4006}`, w.Body.String())
+}
+
+func TestPrometheusRequestHandler_SignedBody(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"signed":%t,"body":%q}`, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	logger := testutil.CreateTestLogger(t)
+	credentials := testutil.WriteFile(t, t.TempDir(), "credentials", []byte("[default]\naws_access_key_id = id\naws_secret_access_key = secret\n"))
+	client := &auth.AWSClient{Region: "eu-west-1", CredentialsFile: credentials}
+	require.NoError(t, client.InitClient(logger))
+
+	conf := &config.Config{
+		PrometheusUrl:       upstream.URL,
+		Client:              client,
+		MaxRequestBodyBytes: 4096,
+	}
+	PrometheusRequestHandler(logger, conf, "/test/signed")
+
+	body := "query=" + strings.Repeat("a", 1500)
+	req := testutil.CreateHTTPRequest(t, http.MethodPost, "/test/signed", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"signed":true,"body":%q}`, body), w.Body.String())
+}
+
+func TestPrometheusRequestHandler_GetAsPost(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"method":%q,"query":%q,"body":%q}`, r.Method, r.URL.RawQuery, body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	conf := &config.Config{
+		PrometheusUrl:     upstream.URL,
+		Client:            &auth.HeadersClient{},
+		MaxGetQueryLength: 20,
+	}
+	PrometheusRequestHandler(testutil.CreateTestLogger(t), conf, "/api/v1/")
+
+	tests := []struct {
+		name         string
+		target       string
+		expectedBody string
+	}{
+		{
+			name:         "short query",
+			target:       "/api/v1/query?query=up",
+			expectedBody: `{"method":"GET","query":"query=up","body":""}`,
+		},
+		{
+			name:         "long query",
+			target:       "/api/v1/query_range?query=sum(rate(x[5m]))&start=1&end=2&step=1",
+			expectedBody: `{"method":"POST","query":"","body":"query=sum(rate(x[5m]))&start=1&end=2&step=1"}`,
+		},
+		{
+			name:         "long series match",
+			target:       "/api/v1/series?match[]=node_load1&match[]=up",
+			expectedBody: `{"method":"POST","query":"","body":"match[]=node_load1&match[]=up"}`,
+		},
+		{
+			name:         "label values only accept get",
+			target:       "/api/v1/label/job/values?match[]=node_load1&match[]=up",
+			expectedBody: `{"method":"GET","query":"match[]=node_load1&match[]=up","body":""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, tt.target, http.NoBody)
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestPrometheusRequestHandler_Upstreams(t *testing.T) {
+	t.Parallel()
+	newServer := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"upstream":%q,"path":%q,"authorization":%q}`, name, r.URL.Path, r.Header.Get("Authorization"))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	defaultServer := newServer("default")
+	regionalServer := newServer("regional")
+
+	logger := testutil.CreateTestLogger(t)
+	file := testutil.WriteFile(t, t.TempDir(), "upstreams.yaml", []byte(fmt.Sprintf(`
+header: X-Upstream
+upstreams:
+  - name: regional
+    url: %s
+    auth:
+      providers: [bearer]
+      bearer:
+        token: regional-token
+`, regionalServer.URL)))
+	router := &upstream.Router{File: file}
+	require.NoError(t, router.Init(logger))
+
+	conf := &config.Config{
+		PrometheusUrl: defaultServer.URL,
+		Client:        &auth.BearerClient{Token: "default-token"},
+		Upstreams:     router,
+	}
+	PrometheusRequestHandler(logger, conf, "/test/upstreams")
+	PrometheusRequestHandler(logger, conf, upstream.PathPrefix)
+
+	tests := []struct {
+		name         string
+		target       string
+		header       string
+		expectedBody string
+	}{
+		{
+			name:         "default upstream",
+			target:       "/test/upstreams",
+			expectedBody: `{"upstream":"default","path":"/test/upstreams","authorization":"Bearer default-token"}`,
+		},
+		{
+			name:         "header",
+			target:       "/test/upstreams",
+			header:       "regional",
+			expectedBody: `{"upstream":"regional","path":"/test/upstreams","authorization":"Bearer regional-token"}`,
+		},
+		{
+			name:         "path prefix",
+			target:       "/upstream/regional/api/v1/query?query=up",
+			expectedBody: `{"upstream":"regional","path":"/api/v1/query","authorization":"Bearer regional-token"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, tt.target, http.NoBody)
+			if tt.header != "" {
+				req.Header.Set("X-Upstream", tt.header)
+			}
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "query=up", truncate("query=up"))
+	exact := strings.Repeat("a", maxLoggedBodyBytes)
+	assert.Equal(t, exact, truncate(exact))
+	assert.Equal(t, exact+"...(truncated)", truncate(exact+"a"))
+}
+
+// An auth client which fails to provide headers
+type failingClient struct {
+	auth.HeadersClient
+}
+
+func (f *failingClient) GetHeaders(_ context.Context) ([]auth.ClientHeader, error) {
+	return nil, errors.New("token unavailable")
+}
@@ -9,9 +9,10 @@ import (
 	"time"
 
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
 )
 
-var errForbiddenMethod = errors.New("forbidden request method")
+var errMethodNotAllowed = errors.New("method not allowed")
 
 type mockStatusResponse struct {
 	Status string      `json:"status"`
@@ -41,6 +42,18 @@ type runtimeInfoData struct {
 	StorageRetention    string `json:"storageRetention"`
 }
 
+// Writes a Prometheus-style 405 error unless the request is a GET request,
+// returning whether it is
+func allowGet(l *logger.Logger, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	l.Warn("invalid request method")
+	w.Header().Set("Allow", http.MethodGet)
+	promapi.WriteError(w, http.StatusMethodNotAllowed, promapi.ErrorBadData, errMethodNotAllowed)
+	return false
+}
+
 func (r *runtimeInfoData) update() {
 	r.LastConfigTime = time.Now().UTC().Format(time.RFC3339Nano)
 	r.GoroutineCount = runtime.NumGoroutine()
@@ -103,9 +116,7 @@ func MockStatusConfigHandler(logger *logger.Logger) {
 		l := logger.WithRequestFields(r)
 		l.Info("processing request")
 
-		if r.Method != http.MethodGet {
-			l.Error("invalid request method")
-			http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+		if !allowGet(l, w, r) {
 			return
 		}
 
@@ -127,9 +138,7 @@ func MockStatusRuntimeInfoHandler(logger *logger.Logger, runtimeInfo *runtimeInf
 		l := logger.WithRequestFields(r)
 		l.Info("processing request")
 
-		if r.Method != http.MethodGet {
-			l.Error("invalid request method")
-			http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+		if !allowGet(l, w, r) {
 			return
 		}
 
@@ -151,9 +160,7 @@ func MockStatusBuildInfoHandler(logger *logger.Logger, buildInfo *buildInfoData)
 		l := logger.WithRequestFields(r)
 		l.Info("processing request")
 
-		if r.Method != http.MethodGet {
-			l.Error("invalid request method")
-			http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+		if !allowGet(l, w, r) {
 			return
 		}
 
@@ -68,9 +68,9 @@ func TestMockStatusConfigHandler(t *testing.T) {
 			expectedError:  false,
 		},
 		{
-			name:           "POST forbidden",
+			name:           "POST not allowed",
 			method:         "POST",
-			expectedStatus: http.StatusForbidden,
+			expectedStatus: http.StatusMethodNotAllowed,
 			expectedError:  true,
 		},
 	}
@@ -82,8 +82,7 @@ func TestMockStatusConfigHandler(t *testing.T) {
 
 			// Setup the handler inline to avoid global state
 			mux.HandleFunc("/api/v1/status/config", func(w http.ResponseWriter, r *http.Request) {
-				if r.Method != http.MethodGet {
-					http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+				if !allowGet(testutil.CreateTestLogger(t), w, r) {
 					return
 				}
 
@@ -110,7 +109,10 @@ func TestMockStatusConfigHandler(t *testing.T) {
 				require.NoError(t, err)
 				assert.Equal(t, "success", response.Status)
 				assert.NotNil(t, response.Data)
+				return
 			}
+			assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"method not allowed"}`, recorder.Body.String())
+			assert.Equal(t, http.MethodGet, recorder.Header().Get("Allow"))
 		})
 	}
 }
@@ -124,8 +126,7 @@ func TestMockStatusBuildInfoHandler(t *testing.T) {
 
 	// Setup the handler inline
 	mux.HandleFunc("/api/v1/status/buildinfo", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+		if !allowGet(testutil.CreateTestLogger(t), w, r) {
 			return
 		}
 
@@ -168,8 +169,7 @@ func TestMockStatusRuntimeInfoHandler(t *testing.T) {
 
 	// Setup the handler inline
 	mux.HandleFunc("/api/v1/status/runtimeinfo", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, errForbiddenMethod.Error(), http.StatusForbidden)
+		if !allowGet(testutil.CreateTestLogger(t), w, r) {
 			return
 		}
 
@@ -4,12 +4,27 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
 	"github.com/s-humphreys/prometheus-proxy/internal/config"
 	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
 	"github.com/s-humphreys/prometheus-proxy/internal/proxy/handlers"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
 )
 
+// Returns the host of an upstream URL, which its certificate is verified
+// against unless a TLS server name is set
+func hostname(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
 // Run starts the HTTP server and listens for incoming requests
 func Run(c *config.Config) {
 	l, err := logger.New(c.LogLevel)
@@ -17,11 +32,58 @@ func Run(c *config.Config) {
 		log.Fatalf("failed to create logger: %v", err)
 	}
 
+	// Expiring tokens are refreshed in the background, off the request path
+	c.Client = auth.ManageTokens(c.Client)
+
 	err = c.Client.InitClient(l)
 	if err != nil {
 		log.Fatalf("failed to initialize authentication client: %v", err)
 	}
 
+	if c.HTTPClient == nil {
+		c.HTTPClient, err = c.UpstreamTLS.WithDefaultServerName(hostname(c.PrometheusUrl)).NewHTTPClient(l)
+		if err != nil {
+			log.Fatalf("failed to create upstream http client: %v", err)
+		}
+	}
+
+	if err := c.Inbound.Init(l); err != nil {
+		log.Fatalf("failed to initialize inbound authentication: %v", err)
+	}
+
+	if c.Policy != nil {
+		if err := c.Policy.Init(l); err != nil {
+			log.Fatalf("failed to initialize query policy: %v", err)
+		}
+	}
+
+	if c.Tenancy != nil {
+		if err := c.Tenancy.Init(l); err != nil {
+			log.Fatalf("failed to initialize label enforcement: %v", err)
+		}
+	}
+
+	if c.Upstreams != nil {
+		if err := c.Upstreams.Init(l); err != nil {
+			log.Fatalf("failed to initialize upstreams: %v", err)
+		}
+	}
+
+	caches := make(map[string]cache.Cache)
+	if c.ResultsCache != nil {
+		caches["results"] = c.ResultsCache.Cache
+	}
+	if c.MetadataCache != nil {
+		caches["metadata"] = c.MetadataCache.Cache
+	}
+	for name, ch := range caches {
+		if initialiser, ok := ch.(cache.Initialiser); ok {
+			if err := initialiser.Init(l); err != nil {
+				log.Fatalf("failed to initialize %s cache: %v", name, err)
+			}
+		}
+	}
+
 	runtimeInfo := handlers.NewRuntimeInfoData()
 	buildInfo := handlers.NewBuildInfoData()
 
@@ -29,22 +91,33 @@ func Run(c *config.Config) {
 	handlers.HealthRequestHandler(l, "/healthz", false)
 	handlers.HealthRequestHandler(l, "/-/healthy", true)
 	handlers.HealthRequestHandler(l, "/-/ready", true)
+	if len(caches) > 0 {
+		handlers.CacheStatsHandler(l, "/-/cache", caches)
+	}
 	handlers.MockStatusConfigHandler(l)
 	handlers.MockStatusRuntimeInfoHandler(l, runtimeInfo)
 	handlers.MockStatusBuildInfoHandler(l, buildInfo)
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/query")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/query_range")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/format_query")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/parse_query")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/series")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/labels")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/label/")
-	handlers.PrometheusRequestHandler(l, c, "/api/v1/metadata")
+	for _, route := range promapi.Routes {
+		handlers.PrometheusRequestHandler(l, c, route)
+	}
+	if c.Upstreams != nil {
+		handlers.PrometheusRequestHandler(l, c, upstream.PathPrefix)
+	}
 
 	// Catch-all
 	handlers.NotFoundRequestHandler(l)
 
 	addr := fmt.Sprintf(":%d", c.Port)
+	if c.ServerTLS.IsSet() {
+		tlsConfig, err := c.ServerTLS.NewServerTLSConfig(l)
+		if err != nil {
+			log.Fatalf("failed to create server tls config: %v", err)
+		}
+		server := &http.Server{Addr: addr, TLSConfig: tlsConfig}
+		l.Info("starting prometheus proxy", "listening", addr, "port", c.Port, "tls", true)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+
 	l.Info("starting prometheus proxy", "listening", addr, "port", c.Port)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
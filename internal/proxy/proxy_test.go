@@ -183,6 +183,13 @@ func TestRunErrorHandling(t *testing.T) {
 	})
 }
 
+func TestHostname(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "10.0.0.1", hostname("https://10.0.0.1:9090/prometheus"))
+	assert.Equal(t, "prometheus.internal", hostname("http://prometheus.internal"))
+	assert.Empty(t, hostname("://invalid"))
+}
+
 // Benchmark tests
 
 func BenchmarkMockClientOperations(b *testing.B) {
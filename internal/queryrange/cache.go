@@ -0,0 +1,279 @@
+package queryrange
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+	"github.com/s-humphreys/prometheus-proxy/internal/upstream"
+)
+
+// ResultsCache caches the results of range queries as extents of consecutive
+// steps, so a repeated query only fetches the steps missing from the cache,
+// in the manner of the Cortex and Thanos query frontends
+type ResultsCache struct {
+	Cache cache.Cache
+	// Results for the most recent period are never cached, as samples may
+	// still be arriving for it
+	MaxFreshness time.Duration
+
+	now func() time.Time
+}
+
+// A cached range of steps, from Start to End inclusive in milliseconds, with
+// the samples of the query at those steps
+type extent struct {
+	Start    int64     `json:"start"`
+	End      int64     `json:"end"`
+	Response *Response `json:"response"`
+}
+
+// Middleware serves query_range requests from the cache where possible,
+// passing requests for the missing steps to the next handler. Only queries
+// whose start is a multiple of their step are cached, so cached steps line up
+// between requests, as they do for Grafana dashboards
+func (c *ResultsCache) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params, err := promapi.RequestParams(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		tr, step, ok := cacheableRange(params)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := resultsCacheKey(r, params)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l := logger.WithRequestFields(r)
+		extents := c.load(l, key)
+
+		pieces, fetched, failed, err := c.collect(r, params, tr, step, extents, next)
+		if err != nil {
+			l.Warn("failed to use cached query results", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if failed != nil {
+			failed.Replay(w)
+			return
+		}
+		merged := mergeResponses(pieces)
+		l.Debug("served range query from results cache", "cached_extents", len(extents), "fetched_ranges", fetched)
+
+		if fetched > 0 && len(merged.Warnings) == 0 {
+			if err := c.store(key, extents, merged, tr, step); err != nil {
+				l.Warn("failed to cache query results", "error", err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(merged)
+	})
+}
+
+// Returns the cached pieces and fetched responses covering the time range in
+// order, the number of ranges fetched, and the first unsuccessful upstream
+// response
+func (c *ResultsCache) collect(r *http.Request, params url.Values, tr timeRange, step int64, extents []extent, next http.Handler) ([]*Response, int, *promapi.Recorder, error) {
+	var pieces []*Response
+	fetched := 0
+	fetch := func(missing timeRange) (*promapi.Recorder, error) {
+		fetched++
+		w := serveSubRange(r.Context(), r, params, missing, next)
+		if w.Status != http.StatusOK {
+			return w, nil
+		}
+		resp, err := decodeResponse(w.Body.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, resp)
+		return nil, nil
+	}
+
+	cursor := tr.start
+	for _, e := range extents {
+		if e.End < cursor || e.Start > tr.end {
+			continue
+		}
+		if e.Start > cursor {
+			if failed, err := fetch(timeRange{start: cursor, end: e.Start - step}); failed != nil || err != nil {
+				return nil, 0, failed, err
+			}
+		}
+		piece, err := e.Response.slice(cursor, tr.end)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		pieces = append(pieces, piece)
+		cursor = e.End + step
+	}
+	if cursor <= tr.end {
+		if failed, err := fetch(timeRange{start: cursor, end: tr.end}); failed != nil || err != nil {
+			return nil, 0, failed, err
+		}
+	}
+	return pieces, fetched, nil, nil
+}
+
+// Returns the cached extents for the key, sorted by start
+func (c *ResultsCache) load(logger *logger.Logger, key string) []extent {
+	data, ok := c.Cache.Get(key)
+	if !ok {
+		return nil
+	}
+	var extents []extent
+	if err := json.Unmarshal(data, &extents); err != nil {
+		logger.Warn("failed to decode cached query results", "error", err)
+		return nil
+	}
+	return extents
+}
+
+// Caches the steps of the response older than the freshness window, merging
+// them with the existing extents
+func (c *ResultsCache) store(key string, extents []extent, resp *Response, tr timeRange, step int64) error {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	cutoff := now().Add(-c.MaxFreshness).UnixMilli()
+
+	end := min(tr.end, tr.start+floorDiv(cutoff-tr.start, step)*step)
+	if end < tr.start {
+		return nil
+	}
+	cacheable, err := resp.slice(tr.start, end)
+	if err != nil {
+		return err
+	}
+
+	extents, err = insertExtent(extents, extent{Start: tr.start, End: end, Response: cacheable}, step)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(extents)
+	if err != nil {
+		return err
+	}
+	c.Cache.Set(key, data, 0)
+	return nil
+}
+
+// Adds an extent to the extents, merging it with any it overlaps or adjoins
+func insertExtent(extents []extent, added extent, step int64) ([]extent, error) {
+	var result []extent
+	for _, e := range extents {
+		if e.End+step < added.Start || e.Start > added.End+step {
+			result = append(result, e)
+			continue
+		}
+
+		var parts []*Response
+		if e.Start < added.Start {
+			before, err := e.Response.slice(e.Start, added.Start-step)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, before)
+		}
+		parts = append(parts, added.Response)
+		if e.End > added.End {
+			after, err := e.Response.slice(added.End+step, e.End)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, after)
+		}
+		added = extent{Start: min(e.Start, added.Start), End: max(e.End, added.End), Response: mergeResponses(parts)}
+	}
+
+	result = append(result, added)
+	slices.SortFunc(result, func(a, b extent) int { return cmp.Compare(a.Start, b.Start) })
+	return result, nil
+}
+
+// Returns the time range and step in milliseconds of a range query, with its
+// end moved back to its last step, or false if it cannot be cached
+func cacheableRange(params url.Values) (timeRange, int64, bool) {
+	start, err := promapi.ParseTime(params.Get("start"))
+	if err != nil {
+		return timeRange{}, 0, false
+	}
+	end, err := promapi.ParseTime(params.Get("end"))
+	if err != nil {
+		return timeRange{}, 0, false
+	}
+	duration, err := promql.ParseDuration(params.Get("step"))
+	step := duration.Milliseconds()
+	if err != nil || step <= 0 || end.Before(start) || start.UnixMilli()%step != 0 {
+		return timeRange{}, 0, false
+	}
+	// Every step depends on the start or end of the whole range, which is not
+	// part of the cache key
+	if uses, err := promql.UsesStartOrEnd(params.Get(promapi.ParamQuery)); err != nil || uses {
+		return timeRange{}, 0, false
+	}
+
+	tr := timeRange{start: start.UnixMilli(), end: end.UnixMilli()}
+	tr.end = tr.start + (tr.end-tr.start)/step*step
+	return tr, step, true
+}
+
+// Returns the cache key of a range query, from the caller, the normalised
+// query and every parameter other than the time range
+func resultsCacheKey(r *http.Request, params url.Values) (string, error) {
+	keyParams := maps.Clone(params)
+	keyParams.Del("start")
+	keyParams.Del("end")
+
+	query, err := promql.Normalize(params.Get(promapi.ParamQuery))
+	if err != nil {
+		return "", err
+	}
+	keyParams.Set(promapi.ParamQuery, query)
+
+	hash := sha256.New()
+	if identity, ok := inbound.IdentityFromContext(r.Context()); ok {
+		hash.Write([]byte(identity.Name))
+	}
+	// The upstream prefix is removed from the path, so routed requests are
+	// told apart by their upstream
+	if u, ok := upstream.FromContext(r.Context()); ok {
+		hash.Write([]byte{0})
+		hash.Write([]byte(u.Name))
+	}
+	// Headers such as X-Scope-OrgID select a tenant without inbound auth
+	if key := headerpolicy.RequestKey(r); key != "" {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.Path))
+	hash.Write([]byte{0})
+	hash.Write([]byte(keyParams.Encode()))
+	return "query_range:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
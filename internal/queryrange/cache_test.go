@@ -0,0 +1,209 @@
+package queryrange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/cache"
+	"github.com/s-humphreys/prometheus-proxy/internal/headerpolicy"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Records the start and end of each range fetched through the cache
+type rangeRecorder struct {
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (rr *rangeRecorder) record(r *http.Request) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.ranges = append(rr.ranges, r.URL.Query().Get("start")+"-"+r.URL.Query().Get("end"))
+}
+
+func (rr *rangeRecorder) take() []string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	ranges := rr.ranges
+	rr.ranges = nil
+	return ranges
+}
+
+// Returns a handler answering range queries with a sample equal to the
+// timestamp at every step, recording the ranges requested
+func newRecordingUpstream(t *testing.T, recorder *rangeRecorder) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		params, err := promapi.RequestParams(r)
+		require.NoError(t, err)
+		if params.Get("query") == "fail" {
+			promapi.WriteError(w, http.StatusServiceUnavailable, promapi.ErrorUnavailable, fmt.Errorf("upstream unavailable"))
+			return
+		}
+
+		start, _ := promapi.ParseTime(params.Get("start"))
+		end, _ := promapi.ParseTime(params.Get("end"))
+		step, _ := time.ParseDuration(params.Get("step") + "s")
+
+		series := &Series{Metric: map[string]string{"job": "a"}}
+		for ts := start; !ts.After(end); ts = ts.Add(step) {
+			series.Values = append(series.Values, json.RawMessage(fmt.Sprintf(`[%d,"%d"]`, ts.Unix(), ts.Unix())))
+		}
+		json.NewEncoder(w).Encode(&Response{Status: "success", Data: Matrix{ResultType: "matrix", Result: []*Series{series}}})
+	})
+}
+
+// Returns the values of the single series of a range query response
+func responseValues(t *testing.T, body []byte) []string {
+	t.Helper()
+	var resp Response
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.Len(t, resp.Data.Result, 1)
+	var values []string
+	for _, value := range resp.Data.Result[0].Values {
+		values = append(values, string(value))
+	}
+	return values
+}
+
+func expectedValues(start, end, step int) []string {
+	var values []string
+	for ts := start; ts <= end; ts += step {
+		values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts, ts))
+	}
+	return values
+}
+
+func TestResultsCacheMiddleware(t *testing.T) {
+	t.Parallel()
+	recorder := &rangeRecorder{}
+	now := time.Unix(10000, 0)
+	resultsCache := &ResultsCache{Cache: cache.NewMemory(1 << 20), MaxFreshness: 10 * time.Minute}
+	resultsCache.now = func() time.Time { return now }
+	handler := resultsCache.Middleware(testutil.CreateTestLogger(t), newRecordingUpstream(t, recorder))
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, testutil.CreateHTTPRequest(t, http.MethodGet, url, nil))
+		return w
+	}
+
+	// The first request is fetched in full and cached up to the freshness window
+	w := serve("/api/v1/query_range?query=up&start=6000&end=9960&step=60")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expectedValues(6000, 9960, 60), responseValues(t, w.Body.Bytes()))
+	assert.Equal(t, []string{"6000-9960"}, recorder.take())
+
+	// A refresh only fetches the steps after the cached extent
+	now = now.Add(time.Minute)
+	w = serve("/api/v1/query_range?query=up&start=6060&end=10020&step=60")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expectedValues(6060, 10020, 60), responseValues(t, w.Body.Bytes()))
+	assert.Equal(t, []string{"9420-10020"}, recorder.take())
+
+	// Earlier steps are fetched and merged with the cached extent, and the
+	// end is moved back to the last step
+	w = serve("/api/v1/query_range?query=%20up&start=3000&end=7030&step=60")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expectedValues(3000, 7020, 60), responseValues(t, w.Body.Bytes()))
+	assert.Equal(t, []string{"3000-5940"}, recorder.take())
+
+	w = serve("/api/v1/query_range?query=up&start=3000&end=9000&step=60")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expectedValues(3000, 9000, 60), responseValues(t, w.Body.Bytes()))
+	assert.Empty(t, recorder.take())
+
+	// Different steps, queries and unaligned starts are not served from the cache
+	serve("/api/v1/query_range?query=up&start=3000&end=9000&step=120")
+	serve("/api/v1/query_range?query=down&start=3000&end=9000&step=60")
+	serve("/api/v1/query_range?query=up&start=3030&end=9000&step=60")
+	assert.Equal(t, []string{"3000-9000", "3000-9000", "3030-9000"}, recorder.take())
+
+	// Queries evaluated at the end of the range are never cached, as a later
+	// end changes every step
+	serve("/api/v1/query_range?query=rate(up[5m])%20@%20end()&start=3000&end=9000&step=60")
+	serve("/api/v1/query_range?query=rate(up[5m])%20@%20end()&start=3000&end=9600&step=60")
+	serve("/api/v1/query_range?query=up%20@%20start()&start=3000&end=9000&step=60")
+	serve("/api/v1/query_range?query=up%20@%20start()&start=3000&end=9000&step=60")
+	assert.Equal(t, []string{"3000-9000", "3000-9600", "3000-9000", "3000-9000"}, recorder.take())
+}
+
+func TestResultsCacheMiddleware_Callers(t *testing.T) {
+	t.Parallel()
+	recorder := &rangeRecorder{}
+	resultsCache := &ResultsCache{Cache: cache.NewMemory(1 << 20)}
+	handler := resultsCache.Middleware(testutil.CreateTestLogger(t), newRecordingUpstream(t, recorder))
+
+	for _, caller := range []string{"team-a", "team-b", "team-a"} {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query_range?query=up&start=0&end=600&step=60", nil)
+		req = req.WithContext(inbound.WithIdentity(req.Context(), &inbound.Identity{Name: caller}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, []string{"0-600", "0-600"}, recorder.take())
+}
+
+func TestResultsCacheMiddleware_ForwardedHeaders(t *testing.T) {
+	t.Parallel()
+	recorder := &rangeRecorder{}
+	resultsCache := &ResultsCache{Cache: cache.NewMemory(1 << 20)}
+	handler := resultsCache.Middleware(testutil.CreateTestLogger(t), newRecordingUpstream(t, recorder))
+	policy := &headerpolicy.Policy{Allow: []string{"X-Scope-OrgID"}}
+
+	for _, orgID := range []string{"tenant-1", "tenant-2", "tenant-1"} {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query_range?query=up&start=0&end=600&step=60", nil)
+		req.Header.Set("X-Scope-OrgID", orgID)
+		req = req.WithContext(headerpolicy.WithPolicy(req.Context(), policy))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, []string{"0-600", "0-600"}, recorder.take())
+}
+
+func TestResultsCacheMiddleware_UpstreamError(t *testing.T) {
+	t.Parallel()
+	recorder := &rangeRecorder{}
+	resultsCache := &ResultsCache{Cache: cache.NewMemory(1 << 20)}
+	handler := resultsCache.Middleware(testutil.CreateTestLogger(t), newRecordingUpstream(t, recorder))
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query_range?query=fail&start=0&end=600&step=60", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	}
+	// Errors are not cached
+	assert.Len(t, recorder.take(), 2)
+}
+
+func TestInsertExtent(t *testing.T) {
+	t.Parallel()
+	response := func(timestamps ...int) *Response {
+		series := &Series{Metric: map[string]string{}}
+		for _, ts := range timestamps {
+			series.Values = append(series.Values, json.RawMessage(fmt.Sprintf(`[%d,"1"]`, ts)))
+		}
+		return &Response{Data: Matrix{ResultType: "matrix", Result: []*Series{series}}}
+	}
+
+	extents := []extent{
+		{Start: 0, End: 1000, Response: response(0, 1)},
+		{Start: 5000, End: 6000, Response: response(5, 6)},
+		{Start: 9000, End: 9000, Response: response(9)},
+	}
+	extents, err := insertExtent(extents, extent{Start: 2000, End: 5000, Response: response(2, 3, 4, 5)}, 1000)
+	require.NoError(t, err)
+
+	require.Len(t, extents, 2)
+	assert.Equal(t, int64(0), extents[0].Start)
+	assert.Equal(t, int64(6000), extents[0].End)
+	assert.Len(t, extents[0].Response.Data.Result[0].Values, 7)
+	assert.Equal(t, int64(9000), extents[1].Start)
+}
@@ -0,0 +1,149 @@
+package queryrange
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errNotMatrix = errors.New("upstream returned a non-matrix result for a range query")
+
+// Series is one series of a range query result. Samples are kept encoded, as
+// they are only reordered by timestamp and never inspected
+type Series struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []json.RawMessage `json:"values,omitempty"`
+	Histograms []json.RawMessage `json:"histograms,omitempty"`
+}
+
+// Returns a key identifying the series by its labels
+func (s *Series) key() string {
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(s.Metric)) {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(s.Metric[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Matrix is the data of a successful range query response
+type Matrix struct {
+	ResultType string    `json:"resultType"`
+	Result     []*Series `json:"result"`
+}
+
+// Response is a successful range query response
+type Response struct {
+	Status   string   `json:"status"`
+	Data     Matrix   `json:"data"`
+	Warnings []string `json:"warnings,omitempty"`
+	Infos    []string `json:"infos,omitempty"`
+}
+
+// Decodes a successful range query response
+func decodeResponse(body []byte) (*Response, error) {
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	if resp.Data.ResultType != "matrix" {
+		return nil, errNotMatrix
+	}
+	return &resp, nil
+}
+
+// Merges responses covering consecutive, non-overlapping time ranges into one,
+// in the order provided. Series are sorted by their labels, as Prometheus
+// returns them
+func mergeResponses(responses []*Response) *Response {
+	merged := &Response{Status: "success", Data: Matrix{ResultType: "matrix", Result: []*Series{}}}
+	series := make(map[string]*Series)
+
+	for _, resp := range responses {
+		for _, s := range resp.Data.Result {
+			key := s.key()
+			existing, ok := series[key]
+			if !ok {
+				existing = &Series{Metric: s.Metric}
+				series[key] = existing
+				merged.Data.Result = append(merged.Data.Result, existing)
+			}
+			existing.Values = append(existing.Values, s.Values...)
+			existing.Histograms = append(existing.Histograms, s.Histograms...)
+		}
+		merged.Warnings = appendUnique(merged.Warnings, resp.Warnings...)
+		merged.Infos = appendUnique(merged.Infos, resp.Infos...)
+	}
+
+	slices.SortFunc(merged.Data.Result, func(a, b *Series) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	return merged
+}
+
+// Returns a copy of the response containing only the samples with timestamps
+// between from and to inclusive, in milliseconds
+func (r *Response) slice(from, to int64) (*Response, error) {
+	sliced := &Response{Status: r.Status, Data: Matrix{ResultType: r.Data.ResultType, Result: []*Series{}}, Warnings: r.Warnings, Infos: r.Infos}
+	for _, s := range r.Data.Result {
+		values, err := sliceSamples(s.Values, from, to)
+		if err != nil {
+			return nil, err
+		}
+		histograms, err := sliceSamples(s.Histograms, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 || len(histograms) > 0 {
+			sliced.Data.Result = append(sliced.Data.Result, &Series{Metric: s.Metric, Values: values, Histograms: histograms})
+		}
+	}
+	return sliced, nil
+}
+
+// Returns the samples with timestamps between from and to inclusive
+func sliceSamples(samples []json.RawMessage, from, to int64) ([]json.RawMessage, error) {
+	var sliced []json.RawMessage
+	for _, sample := range samples {
+		ts, err := sampleTime(sample)
+		if err != nil {
+			return nil, err
+		}
+		if ts >= from && ts <= to {
+			sliced = append(sliced, sample)
+		}
+	}
+	return sliced, nil
+}
+
+// Returns the timestamp in milliseconds of an encoded [timestamp, value] pair
+func sampleTime(sample json.RawMessage) (int64, error) {
+	trimmed := bytes.TrimSpace(sample)
+	comma := bytes.IndexByte(trimmed, ',')
+	if len(trimmed) == 0 || trimmed[0] != '[' || comma < 0 {
+		return 0, fmt.Errorf("invalid sample %s", sample)
+	}
+	seconds, err := strconv.ParseFloat(string(bytes.TrimSpace(trimmed[1:comma])), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample %s", sample)
+	}
+	return int64(math.Round(seconds * 1000)), nil
+}
+
+// Appends the values missing from the slice
+func appendUnique(values []string, add ...string) []string {
+	for _, value := range add {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
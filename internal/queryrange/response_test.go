@@ -0,0 +1,62 @@
+package queryrange
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	t.Parallel()
+	resp, err := decodeResponse([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"]]}]}}`))
+	require.NoError(t, err)
+	require.Len(t, resp.Data.Result, 1)
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`[1,"1"]`)}, resp.Data.Result[0].Values)
+
+	_, err = decodeResponse([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	assert.Equal(t, errNotMatrix, err)
+
+	_, err = decodeResponse([]byte(`<html>`))
+	assert.ErrorContains(t, err, "failed to decode upstream response")
+}
+
+func TestMergeResponses(t *testing.T) {
+	t.Parallel()
+	var first, second Response
+	require.NoError(t, json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"job":"b"},"values":[[1,"1"]]},
+		{"metric":{"job":"a"},"histograms":[[1,{"count":"1"}]]}
+	]},"warnings":["w1"]}`), &first))
+	require.NoError(t, json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"job":"a"},"histograms":[[2,{"count":"2"}]]},
+		{"metric":{"job":"c"},"values":[[2,"3"]]}
+	]},"warnings":["w1","w2"],"infos":["i1"]}`), &second))
+
+	merged, err := json.Marshal(mergeResponses([]*Response{&first, &second}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"job":"a"},"histograms":[[1,{"count":"1"}],[2,{"count":"2"}]]},
+		{"metric":{"job":"b"},"values":[[1,"1"]]},
+		{"metric":{"job":"c"},"values":[[2,"3"]]}
+	]},"warnings":["w1","w2"],"infos":["i1"]}`, string(merged))
+
+	empty, err := json.Marshal(mergeResponses(nil))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[]}}`, string(empty))
+}
+
+func TestSampleTime(t *testing.T) {
+	t.Parallel()
+	ts, err := sampleTime(json.RawMessage(`[1700000000.123,"1"]`))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000123), ts)
+
+	ts, err = sampleTime(json.RawMessage(` [ 1700000000 , {"count":"1"}]`))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000000), ts)
+
+	_, err = sampleTime(json.RawMessage(`{"ts":1}`))
+	assert.ErrorContains(t, err, "invalid sample")
+}
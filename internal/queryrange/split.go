@@ -0,0 +1,184 @@
+package queryrange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultMaxParallel = 4
+
+var errSubRangeFailed = errors.New("sub-range query failed")
+
+// Splitter splits long range queries into sub-ranges which are executed
+// concurrently and merged into one response, so no single upstream query
+// exceeds the upstream's range or time limits
+type Splitter struct {
+	// The sub-range length, sub-ranges are aligned to multiples of it since
+	// the Unix epoch, e.g. 24h splits at midnight UTC
+	Interval time.Duration
+	// The most sub-ranges of a request executed at once, 4 if unset
+	MaxParallel int
+}
+
+// A sub-range of a range query, with step-aligned start and end in
+// milliseconds
+type timeRange struct {
+	start int64
+	end   int64
+}
+
+// Middleware splits query_range requests spanning more than one interval
+// before passing each sub-range to the next handler
+func (s *Splitter) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" || s.Interval <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params, err := promapi.RequestParams(r)
+		if err != nil {
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		ranges, ok := splitParams(params, s.Interval)
+		if !ok || len(ranges) < 2 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l := logger.WithRequestFields(r)
+		l.Debug("splitting range query", "interval", s.Interval, "sub_ranges", len(ranges))
+
+		responses, failed, err := s.execute(r, params, ranges, next)
+		if err != nil {
+			l.Error("failed to execute split range query", "error", err)
+			promapi.WriteError(w, http.StatusBadGateway, promapi.ErrorExecution, err)
+			return
+		}
+		if failed != nil {
+			// Errors from upstream are returned as they are
+			failed.Replay(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mergeResponses(responses))
+	})
+}
+
+// Executes the sub-ranges with bounded parallelism, returning their decoded
+// responses in order, or the first unsuccessful upstream response
+func (s *Splitter) execute(r *http.Request, params url.Values, ranges []timeRange, next http.Handler) ([]*Response, *promapi.Recorder, error) {
+	maxParallel := s.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultMaxParallel
+	}
+
+	group, ctx := errgroup.WithContext(r.Context())
+	group.SetLimit(maxParallel)
+
+	responses := make([]*Response, len(ranges))
+	// The first failure cancels the remaining sub-ranges, whose failures
+	// are then only a consequence of it
+	var failed *promapi.Recorder
+	var failedOnce sync.Once
+	for i, tr := range ranges {
+		group.Go(func() error {
+			w := serveSubRange(ctx, r, params, tr, next)
+			if w.Status != http.StatusOK {
+				failedOnce.Do(func() { failed = w })
+				return errSubRangeFailed
+			}
+			resp, err := decodeResponse(w.Body.Bytes())
+			if err != nil {
+				return err
+			}
+			responses[i] = resp
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		if errors.Is(err, errSubRangeFailed) {
+			return nil, failed, nil
+		}
+		return nil, nil, err
+	}
+	return responses, nil, nil
+}
+
+// Passes a copy of the request restricted to the time range to the handler,
+// returning its buffered response
+func serveSubRange(ctx context.Context, r *http.Request, params url.Values, tr timeRange, next http.Handler) *promapi.Recorder {
+	subParams := maps.Clone(params)
+	subParams.Set("start", promapi.FormatTime(time.UnixMilli(tr.start)))
+	subParams.Set("end", promapi.FormatTime(time.UnixMilli(tr.end)))
+
+	subRequest := r.Clone(ctx)
+	promapi.SetRequestParams(subRequest, subParams)
+
+	w := promapi.NewRecorder()
+	next.ServeHTTP(w, subRequest)
+	return w
+}
+
+// Returns the step-aligned sub-ranges of a range query's parameters, or false
+// if they are incomplete or invalid and left for the upstream to reject, or
+// the query cannot be split
+func splitParams(params url.Values, interval time.Duration) ([]timeRange, bool) {
+	start, err := promapi.ParseTime(params.Get("start"))
+	if err != nil {
+		return nil, false
+	}
+	end, err := promapi.ParseTime(params.Get("end"))
+	if err != nil {
+		return nil, false
+	}
+	step, err := promql.ParseDuration(params.Get("step"))
+	if err != nil || step < time.Millisecond || end.Before(start) {
+		return nil, false
+	}
+	// Each sub-range would evaluate @ start() and @ end() at its own bounds
+	if uses, err := promql.UsesStartOrEnd(params.Get(promapi.ParamQuery)); err != nil || uses {
+		return nil, false
+	}
+	return splitRange(start.UnixMilli(), end.UnixMilli(), step.Milliseconds(), interval.Milliseconds()), true
+}
+
+// Splits the points start, start+step, ... up to end at multiples of the
+// interval. Every sub-range starts and ends on a point of the original query,
+// so the sub-ranges evaluate exactly the original points between them
+func splitRange(start, end, step, interval int64) []timeRange {
+	var ranges []timeRange
+	for s := start; s <= end; {
+		boundary := (floorDiv(s, interval) + 1) * interval
+		e := s + (boundary-1-s)/step*step
+		if e > end {
+			e = s + (end-s)/step*step
+		}
+		ranges = append(ranges, timeRange{start: s, end: e})
+		s = e + step
+	}
+	return ranges
+}
+
+// Divides rounding towards negative infinity, for times before the epoch
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
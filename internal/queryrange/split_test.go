@@ -0,0 +1,187 @@
+package queryrange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	hour = int64(time.Hour / time.Millisecond)
+	day  = 24 * hour
+)
+
+func TestSplitRange(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		start    int64
+		end      int64
+		step     int64
+		interval int64
+		expected []timeRange
+	}{
+		{
+			name: "within one interval", start: 1 * hour, end: 5 * hour, step: hour, interval: day,
+			expected: []timeRange{{1 * hour, 5 * hour}},
+		},
+		{
+			name: "aligned to intervals", start: 0, end: 2 * day, step: 6 * hour, interval: day,
+			expected: []timeRange{{0, 18 * hour}, {day, day + 18*hour}, {2 * day, 2 * day}},
+		},
+		{
+			name: "unaligned start", start: 20 * hour, end: day + 7*hour, step: 5 * hour, interval: day,
+			expected: []timeRange{{20 * hour, 20 * hour}, {25 * hour, 30 * hour}},
+		},
+		{
+			name: "end between points", start: 0, end: day + 90*60*1000, step: hour, interval: day,
+			expected: []timeRange{{0, 23 * hour}, {day, day + hour}},
+		},
+		{
+			name: "step longer than interval", start: 0, end: 4 * day, step: 2 * day, interval: day,
+			expected: []timeRange{{0, 0}, {2 * day, 2 * day}, {4 * day, 4 * day}},
+		},
+		{
+			name: "before the epoch", start: -day, end: day, step: 12 * hour, interval: day,
+			expected: []timeRange{{-day, -12 * hour}, {0, 12 * hour}, {day, day}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, splitRange(tt.start, tt.end, tt.step, tt.interval))
+		})
+	}
+}
+
+// Returns a handler answering range queries with one series per job, with a
+// sample at every step, and counting the requests received
+func newFakeUpstream(t *testing.T, requests *atomic.Int32) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		params, err := promapi.RequestParams(r)
+		require.NoError(t, err)
+		if params.Get("query") == "fail" {
+			promapi.WriteError(w, http.StatusUnprocessableEntity, promapi.ErrorExecution, fmt.Errorf("query failed"))
+			return
+		}
+
+		start, _ := promapi.ParseTime(params.Get("start"))
+		end, _ := promapi.ParseTime(params.Get("end"))
+		step := time.Hour
+
+		resp := &Response{Status: "success", Data: Matrix{ResultType: "matrix"}, Warnings: []string{"partial"}}
+		for _, job := range []string{"b", "a"} {
+			series := &Series{Metric: map[string]string{"job": job}}
+			for ts := start; !ts.After(end); ts = ts.Add(step) {
+				series.Values = append(series.Values, json.RawMessage(fmt.Sprintf(`[%d,"1"]`, ts.Unix())))
+			}
+			resp.Data.Result = append(resp.Data.Result, series)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func TestSplitterMiddleware(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	splitter := &Splitter{Interval: 24 * time.Hour, MaxParallel: 2}
+	handler := splitter.Middleware(testutil.CreateTestLogger(t), newFakeUpstream(t, &requests))
+
+	req := testutil.CreateHTTPRequest(t, http.MethodPost, "/api/v1/query_range",
+		strings.NewReader("query=up&start=0&end=259200&step=3600"))
+	req.Header.Set("Content-Type", promapi.FormContentType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, int32(4), requests.Load())
+
+	var resp Response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, []string{"partial"}, resp.Warnings)
+	require.Len(t, resp.Data.Result, 2)
+	assert.Equal(t, map[string]string{"job": "a"}, resp.Data.Result[0].Metric)
+
+	// Every point of the original range is returned once and in order
+	for _, series := range resp.Data.Result {
+		require.Len(t, series.Values, 73)
+		for i, value := range series.Values {
+			assert.JSONEq(t, fmt.Sprintf(`[%d,"1"]`, i*3600), string(value))
+		}
+	}
+}
+
+func TestSplitterMiddleware_Passthrough(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	splitter := &Splitter{Interval: 24 * time.Hour}
+	handler := splitter.Middleware(testutil.CreateTestLogger(t), newFakeUpstream(t, &requests))
+
+	for _, url := range []string{
+		"/api/v1/query_range?query=up&start=0&end=3600&step=60",
+		"/api/v1/query_range?query=up&start=0&end=invalid&step=60",
+		"/api/v1/query?query=up&time=259200",
+		// The modifiers are evaluated at the bounds of the whole range
+		"/api/v1/query_range?query=rate(up[5m])%20@%20end()&start=0&end=259200&step=3600",
+		"/api/v1/query_range?query=up%20@%20start()&start=0&end=259200&step=3600",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, testutil.CreateHTTPRequest(t, http.MethodGet, url, nil))
+	}
+	assert.Equal(t, int32(5), requests.Load())
+}
+
+func TestSplitterMiddleware_UpstreamError(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	splitter := &Splitter{Interval: 24 * time.Hour}
+	handler := splitter.Middleware(testutil.CreateTestLogger(t), newFakeUpstream(t, &requests))
+
+	req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query_range?query=fail&start=0&end=259200&step=3600", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"execution","error":"query failed"}`, w.Body.String())
+}
+
+func TestSplitterMiddleware_MaxParallel(t *testing.T) {
+	t.Parallel()
+	var inFlight, maxInFlight atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	})
+
+	splitter := &Splitter{Interval: time.Hour, MaxParallel: 3}
+	handler := splitter.Middleware(testutil.CreateTestLogger(t), next)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query_range?query=up&start=0&end=86400&step=60", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[]}}`, w.Body.String())
+	assert.Equal(t, int32(3), maxInFlight.Load())
+}
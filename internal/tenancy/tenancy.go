@@ -0,0 +1,213 @@
+package tenancy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/promql"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errNoTenantSource = errors.New("either a tenant header or tenants file is required")
+	errNoLabelValues  = errors.New("caller is not permitted to query any label values")
+)
+
+// Tenants maps callers to the label values they may query. A caller may query
+// the values of its user and of every group it belongs to
+type Tenants struct {
+	Users  map[string][]string `yaml:"users"`
+	Groups map[string][]string `yaml:"groups"`
+}
+
+// Returns the label values permitted for the caller, deduplicated and in
+// the order they appear in the file
+func (t *Tenants) values(identity *inbound.Identity) []string {
+	values := slices.Clone(t.Users[identity.Name])
+	for _, group := range identity.Groups {
+		values = append(values, t.Groups[group]...)
+	}
+	return dedupe(values)
+}
+
+// Enforcer restricts each caller to the series carrying its values of a
+// label, in the manner of prom-label-proxy. A matcher for the label is added
+// to every selector of the query and match[] parameters of the Prometheus API
+type Enforcer struct {
+	// The label enforced on every selector, e.g. "namespace"
+	Label string
+	// A request header carrying the caller's comma separated label values,
+	// which must only be set by a trusted component such as an ingress
+	Header string
+	// A YAML file mapping authenticated callers to label values, re-read
+	// whenever it changes
+	TenantsFile string
+
+	file   *filewatch.File
+	logger *logger.Logger
+
+	mu      sync.Mutex
+	tenants *Tenants
+}
+
+// Performs the initial read of the tenants file
+func (e *Enforcer) Init(logger *logger.Logger) error {
+	e.logger = logger
+	if e.Header != "" {
+		return nil
+	}
+	if e.TenantsFile == "" {
+		return errNoTenantSource
+	}
+	e.file = filewatch.New(e.TenantsFile)
+	_, err := e.load()
+	return err
+}
+
+// Middleware rewrites the queries and series matchers of requests to the
+// Prometheus API before passing them to the next handler. Callers without
+// label values are rejected, as are queries which cannot be parsed
+func (e *Enforcer) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := logger.WithRequestFields(r)
+
+		values, err := e.values(r)
+		if err != nil {
+			l.Error("failed to determine caller label values", "error", err)
+			promapi.WriteError(w, http.StatusInternalServerError, promapi.ErrorInternal, err)
+			return
+		}
+		if len(values) == 0 {
+			l.Warn("rejected request from caller without label values", "label", e.Label)
+			promapi.WriteError(w, http.StatusForbidden, promapi.ErrorForbidden, errNoLabelValues)
+			return
+		}
+
+		if err := enforceRequest(r, promql.NewMatcher(e.Label, values...)); err != nil {
+			l.Warn("rejected request which could not be restricted", "error", err)
+			promapi.WriteParamsError(w, err)
+			return
+		}
+		l.Debug("enforced label values", "label", e.Label, "values", values)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the label values the caller may query
+func (e *Enforcer) values(r *http.Request) ([]string, error) {
+	if e.Header != "" {
+		var values []string
+		for _, header := range r.Header.Values(e.Header) {
+			for value := range strings.SplitSeq(header, ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+		}
+		return dedupe(values), nil
+	}
+
+	identity, ok := inbound.IdentityFromContext(r.Context())
+	if !ok {
+		return nil, nil
+	}
+	tenants, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	return tenants.values(identity), nil
+}
+
+// Returns the tenants, re-reading the file if it has changed
+func (e *Enforcer) load() (*Tenants, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data, changed, err := e.file.Read()
+	if err != nil {
+		if e.tenants == nil {
+			return nil, fmt.Errorf("failed to read tenants file: %w", err)
+		}
+		e.logger.Warn("failed to re-read tenants file, using last known tenants", "path", e.file.Path, "error", err)
+		return e.tenants, nil
+	}
+	if e.tenants != nil && !changed {
+		return e.tenants, nil
+	}
+
+	tenants := &Tenants{}
+	if err := yaml.Unmarshal(data, tenants); err != nil {
+		if e.tenants == nil {
+			return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+		}
+		e.logger.Warn("failed to parse tenants file, using last known tenants", "path", e.file.Path, "error", err)
+		return e.tenants, nil
+	}
+
+	e.logger.Info("loaded tenants file", "path", e.file.Path, "users", len(tenants.Users), "groups", len(tenants.Groups))
+	e.tenants = tenants
+	return tenants, nil
+}
+
+// Adds the matcher to the PromQL parameters of a Prometheus API request
+func enforceRequest(r *http.Request, matcher promql.Matcher) error {
+	params, err := promapi.RequestParams(r)
+	if err != nil {
+		return err
+	}
+	if err := enforceParams(r.URL.Path, params, matcher); err != nil {
+		return err
+	}
+	promapi.SetRequestParams(r, params)
+	return nil
+}
+
+// Rewrites the parameters holding PromQL for the API endpoint. Endpoints which
+// do not select series, such as metadata, are left unchanged
+func enforceParams(path string, params url.Values, matcher promql.Matcher) error {
+	switch key := promapi.ExpressionParam(path); key {
+	case promapi.ParamQuery:
+		return enforceParam(params, key, matcher)
+	case promapi.ParamMatch:
+		// Without match[], every series would be considered
+		if len(params[key]) == 0 {
+			params.Set(key, "{"+matcher.String()+"}")
+			return nil
+		}
+		return enforceParam(params, key, matcher)
+	}
+	return nil
+}
+
+// Adds the matcher to every value of a parameter
+func enforceParam(params url.Values, key string, matcher promql.Matcher) error {
+	for i, query := range params[key] {
+		enforced, err := promql.EnforceMatchers(query, matcher)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %s: %w", key, err)
+		}
+		params[key][i] = enforced
+	}
+	return nil
+}
+
+// Returns the values without duplicates or empty strings, keeping their order
+func dedupe(values []string) []string {
+	var unique []string
+	for _, value := range values {
+		if value != "" && !slices.Contains(unique, value) {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
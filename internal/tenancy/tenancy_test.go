@@ -0,0 +1,209 @@
+package tenancy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a handler recording the forwarded query string and body
+func newRecordingHandler(t *testing.T, query, body *string) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		*query = r.URL.RawQuery
+		*body = string(data)
+	})
+}
+
+func TestEnforcer_Header(t *testing.T) {
+	t.Parallel()
+	e := &Enforcer{Label: "namespace", Header: "X-Namespaces"}
+	require.NoError(t, e.Init(testutil.CreateTestLogger(t)))
+
+	var query, body string
+	handler := e.Middleware(testutil.CreateTestLogger(t), newRecordingHandler(t, &query, &body))
+
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		body          string
+		header        string
+		expectedCode  int
+		expectedQuery url.Values
+		expectedBody  url.Values
+	}{
+		{
+			name:          "instant query",
+			method:        http.MethodGet,
+			url:           "/api/v1/query?query=sum(up)&time=1",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"query": {`sum(up{namespace="team-a"})`}, "time": {"1"}},
+		},
+		{
+			name:          "multiple namespaces",
+			method:        http.MethodGet,
+			url:           "/api/v1/query_range?query=up",
+			header:        "team-a, team-b,team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"query": {`up{namespace=~"team-a|team-b"}`}},
+		},
+		{
+			name:         "form body",
+			method:       http.MethodPost,
+			url:          "/api/v1/query",
+			body:         "query=rate(errors[5m])",
+			header:       "team-a",
+			expectedCode: http.StatusOK,
+			expectedBody: url.Values{"query": {`rate(errors{namespace="team-a"}[5m])`}},
+		},
+		{
+			name:          "post with query string",
+			method:        http.MethodPost,
+			url:           "/api/v1/query?query=up",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"query": {`up{namespace="team-a"}`}},
+		},
+		{
+			name:          "series matchers",
+			method:        http.MethodGet,
+			url:           "/api/v1/series?match[]=up&match[]={job=\"api\"}",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"match[]": {`up{namespace="team-a"}`, `{job="api",namespace="team-a"}`}},
+		},
+		{
+			name:          "label values without matchers",
+			method:        http.MethodGet,
+			url:           "/api/v1/label/job/values",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"match[]": {`{namespace="team-a"}`}},
+		},
+		{
+			name:          "labels without matchers",
+			method:        http.MethodPost,
+			url:           "/api/v1/labels",
+			body:          "start=1",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedBody:  url.Values{"match[]": {`{namespace="team-a"}`}, "start": {"1"}},
+			expectedQuery: url.Values{},
+		},
+		{
+			name:          "metadata is unchanged",
+			method:        http.MethodGet,
+			url:           "/api/v1/metadata?metric=up",
+			header:        "team-a",
+			expectedCode:  http.StatusOK,
+			expectedQuery: url.Values{"metric": {"up"}},
+		},
+		{
+			name:         "missing header",
+			method:       http.MethodGet,
+			url:          "/api/v1/query?query=up",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "invalid query",
+			method:       http.MethodGet,
+			url:          "/api/v1/query?query=sum(up",
+			header:       "team-a",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, body = "", ""
+			req := testutil.CreateHTTPRequest(t, tt.method, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", promapi.FormContentType)
+			if tt.header != "" {
+				req.Header.Set("X-Namespaces", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			require.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			if tt.expectedCode != http.StatusOK {
+				assert.Contains(t, w.Body.String(), `"status":"error"`)
+				return
+			}
+			if tt.expectedQuery != nil {
+				assert.Equal(t, tt.expectedQuery.Encode(), query)
+			}
+			if tt.expectedBody != nil {
+				assert.Equal(t, tt.expectedBody.Encode(), body)
+			}
+		})
+	}
+}
+
+func TestEnforcer_TenantsFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testutil.WriteFile(t, dir, "tenants.yaml", []byte(`
+users:
+  grafana: [team-a]
+groups:
+  observability: [team-b, team-a]
+`))
+
+	e := &Enforcer{Label: "namespace", TenantsFile: path}
+	require.NoError(t, e.Init(testutil.CreateTestLogger(t)))
+
+	var query, body string
+	handler := e.Middleware(testutil.CreateTestLogger(t), newRecordingHandler(t, &query, &body))
+
+	serve := func(identity *inbound.Identity) int {
+		req := testutil.CreateHTTPRequest(t, http.MethodGet, "/api/v1/query?query=up", http.NoBody)
+		if identity != nil {
+			req = req.WithContext(inbound.WithIdentity(req.Context(), identity))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(&inbound.Identity{Name: "grafana", Groups: []string{"observability"}}))
+	assert.Equal(t, url.Values{"query": {`up{namespace=~"team-a|team-b"}`}}.Encode(), query)
+
+	assert.Equal(t, http.StatusOK, serve(&inbound.Identity{Name: "kiali", Groups: []string{"observability"}}))
+	assert.Equal(t, url.Values{"query": {`up{namespace=~"team-b|team-a"}`}}.Encode(), query)
+
+	assert.Equal(t, http.StatusForbidden, serve(&inbound.Identity{Name: "kiali"}))
+	assert.Equal(t, http.StatusForbidden, serve(nil))
+
+	// Tenants are reloaded when the file changes
+	testutil.WriteFile(t, dir, "tenants.yaml", []byte("users:\n  kiali: [team-c]\n"))
+	assert.Equal(t, http.StatusOK, serve(&inbound.Identity{Name: "kiali"}))
+	assert.Equal(t, url.Values{"query": {`up{namespace="team-c"}`}}.Encode(), query)
+}
+
+func TestEnforcer_Init(t *testing.T) {
+	t.Parallel()
+	logger := testutil.CreateTestLogger(t)
+
+	assert.Equal(t, errNoTenantSource, (&Enforcer{Label: "namespace"}).Init(logger))
+
+	err := (&Enforcer{Label: "namespace", TenantsFile: "/missing/tenants.yaml"}).Init(logger)
+	assert.ErrorContains(t, err, "failed to read tenants file")
+
+	path := testutil.WriteFile(t, t.TempDir(), "tenants.yaml", []byte("users: [grafana]"))
+	err = (&Enforcer{Label: "namespace", TenantsFile: path}).Init(logger)
+	assert.ErrorContains(t, err, "failed to parse tenants file")
+}
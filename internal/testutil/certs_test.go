@@ -0,0 +1,48 @@
+package testutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTestCA(t *testing.T) {
+	t.Parallel()
+	ca := CreateTestCA(t, "test-ca")
+
+	assert.True(t, ca.Cert.IsCA)
+	assert.Equal(t, "test-ca", ca.Cert.Subject.CommonName)
+	assert.NotEmpty(t, ca.CertPEM)
+}
+
+func TestIssueCertificate(t *testing.T) {
+	t.Parallel()
+	ca := CreateTestCA(t, "test-ca")
+	certPEM, keyPEM := ca.IssueCertificate(t, "client")
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	assert.Equal(t, "client", pair.Leaf.Subject.CommonName)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	_, err = pair.Leaf.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		DNSName:   "localhost",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	assert.NoError(t, err)
+}
+
+func TestWriteFile(t *testing.T) {
+	t.Parallel()
+	path := WriteFile(t, t.TempDir(), "file", []byte("content"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
@@ -0,0 +1,306 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/filewatch"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+)
+
+var (
+	errCertKeyMismatch = errors.New("tls cert file and key file must be set together")
+	errNoCACerts       = errors.New("no certificates found in tls ca file")
+	errServerCertUnset = errors.New("tls cert file and key file must be set to serve tls")
+	errServerNameUnset = errors.New("tls server name must be set to verify the upstream certificate")
+
+	// Supported values for Config.MinVersion
+	TLSVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+)
+
+// Config describes the TLS settings for connections to an upstream server, or
+// for the proxy's own listener. Certificate and CA files are re-read whenever
+// they change on disk, so certificates rotated by e.g. cert-manager are picked
+// up without a restart
+type Config struct {
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	ServerName         string
+	MinVersion         string
+	InsecureSkipVerify bool
+}
+
+// Returns true if any TLS settings have been provided
+func (c *Config) IsSet() bool {
+	return c != nil && (c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" ||
+		c.ServerName != "" || c.MinVersion != "" || c.InsecureSkipVerify)
+}
+
+// Returns a copy of the configuration which verifies the upstream certificate
+// against host, unless a server name is set explicitly
+func (c *Config) WithDefaultServerName(host string) *Config {
+	if !c.IsSet() || c.ServerName != "" {
+		return c
+	}
+	conf := *c
+	conf.ServerName = host
+	return &conf
+}
+
+// Returns a copy of the configuration which verifies the upstream certificate
+// against host, even if a server name is set explicitly
+func (c *Config) WithServerName(host string) *Config {
+	if !c.IsSet() {
+		return c
+	}
+	conf := *c
+	conf.ServerName = host
+	return &conf
+}
+
+// Validates the configuration without reading any files
+func (c *Config) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errCertKeyMismatch
+	}
+	if _, ok := TLSVersions[c.MinVersion]; c.MinVersion != "" && !ok {
+		return fmt.Errorf("invalid tls min version %q", c.MinVersion)
+	}
+	return nil
+}
+
+// NewTLSConfig creates a client tls.Config from the configuration, performing
+// an initial load of all certificate files so misconfiguration fails fast
+func (c *Config) NewTLSConfig(logger *logger.Logger) (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.MinVersion != "" {
+		tlsConfig.MinVersion = TLSVersions[c.MinVersion]
+	}
+	if c.InsecureSkipVerify {
+		logger.Warn("upstream tls certificate verification is disabled")
+	}
+
+	if c.CertFile != "" {
+		certs := &certificateLoader{
+			certFile: filewatch.New(c.CertFile),
+			keyFile:  filewatch.New(c.KeyFile),
+			logger:   logger,
+		}
+		if _, err := certs.load(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.load()
+		}
+	}
+
+	if c.CAFile != "" && !c.InsecureSkipVerify {
+		roots := &caLoader{file: filewatch.New(c.CAFile), logger: logger}
+		if _, err := roots.load(); err != nil {
+			return nil, err
+		}
+		// Standard verification is replaced with verification against the
+		// current CA pool, since tls.Config.RootCAs cannot be swapped at runtime
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			pool, err := roots.load()
+			if err != nil {
+				return err
+			}
+			return verifyPeer(cs, pool, c.ServerName)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewHTTPClient creates an HTTP client for an upstream server, using the
+// configuration if any TLS settings have been provided
+func (c *Config) NewHTTPClient(logger *logger.Logger) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.IsSet() {
+		tlsClientConfig, err := c.NewTLSConfig(logger)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsClientConfig
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// NewServerTLSConfig creates a server tls.Config which serves the certificate
+// from CertFile and KeyFile. If CAFile is set, client certificates signed by
+// it are verified when presented, but not required
+func (c *Config) NewServerTLSConfig(logger *logger.Logger) (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.CertFile == "" {
+		return nil, errServerCertUnset
+	}
+
+	certs := &certificateLoader{
+		certFile: filewatch.New(c.CertFile),
+		keyFile:  filewatch.New(c.KeyFile),
+		logger:   logger,
+	}
+	if _, err := certs.load(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.load()
+		},
+	}
+	if c.MinVersion != "" {
+		tlsConfig.MinVersion = TLSVersions[c.MinVersion]
+	}
+
+	if c.CAFile != "" {
+		roots := &caLoader{file: filewatch.New(c.CAFile), logger: logger}
+		if _, err := roots.load(); err != nil {
+			return nil, err
+		}
+		// tls.Config.ClientCAs cannot be swapped at runtime, so each handshake
+		// uses a copy of the config with the current CA pool
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pool, err := roots.load()
+			if err != nil {
+				return nil, err
+			}
+			conf := tlsConfig.Clone()
+			conf.GetConfigForClient = nil
+			conf.ClientCAs = pool
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+			return conf, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Verifies the server certificate chain and hostname against the provided
+// roots. The server name is required, as the connection state holds no name
+// for IP addresses, which are never sent as SNI
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("upstream did not present a certificate")
+	}
+	if serverName == "" {
+		return errServerNameUnset
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+	return err
+}
+
+// Loads a certificate pair, reloading it when either file changes.
+// The last valid pair is kept if a reload fails, e.g. mid-rotation
+type certificateLoader struct {
+	certFile *filewatch.File
+	keyFile  *filewatch.File
+	logger   *logger.Logger
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (cl *certificateLoader) load() (*tls.Certificate, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	certPEM, certChanged, certErr := cl.certFile.Read()
+	keyPEM, keyChanged, keyErr := cl.keyFile.Read()
+	if err := errors.Join(certErr, keyErr); err != nil {
+		if cl.cert == nil {
+			return nil, fmt.Errorf("failed to read tls certificate: %w", err)
+		}
+		cl.logger.Warn("failed to re-read tls certificate, using last known certificate", "error", err)
+		return cl.cert, nil
+	}
+	if cl.cert != nil && !certChanged && !keyChanged {
+		return cl.cert, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		if cl.cert == nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		cl.logger.Warn("failed to reload tls certificate, using last known certificate", "error", err)
+		return cl.cert, nil
+	}
+
+	cl.logger.Info("loaded tls certificate", "path", cl.certFile.Path, "subject", cert.Leaf.Subject.String(), "expires", cert.Leaf.NotAfter)
+	cl.cert = &cert
+	return cl.cert, nil
+}
+
+// Loads a CA bundle, reloading it when the file changes. The last valid
+// pool is kept if a reload fails
+type caLoader struct {
+	file   *filewatch.File
+	logger *logger.Logger
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+}
+
+func (cl *caLoader) load() (*x509.CertPool, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	data, changed, err := cl.file.Read()
+	if err != nil {
+		if cl.pool == nil {
+			return nil, fmt.Errorf("failed to read tls ca file: %w", err)
+		}
+		cl.logger.Warn("failed to re-read tls ca file, using last known ca", "error", err)
+		return cl.pool, nil
+	}
+	if cl.pool != nil && !changed {
+		return cl.pool, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		if cl.pool == nil {
+			return nil, errNoCACerts
+		}
+		cl.logger.Warn("failed to reload tls ca file, using last known ca", "error", errNoCACerts)
+		return cl.pool, nil
+	}
+
+	cl.logger.Info("loaded tls ca file", "path", cl.file.Path)
+	cl.pool = pool
+	return pool, nil
+}
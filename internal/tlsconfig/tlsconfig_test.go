@@ -0,0 +1,341 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a TLS server which requires client certificates issued by clientCA,
+// responding with the common name of the presented client certificate
+func newMTLSServer(t *testing.T, serverCA, clientCA *testutil.TestCA) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := serverCA.IssueCertificate(t, "server")
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.Cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sends a request on a new connection and returns the response body
+func get(t *testing.T, tlsConfig *tls.Config, url string) (string, error) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 256)
+	n, _ := resp.Body.Read(buf)
+	return string(buf[:n]), nil
+}
+
+func TestNewTLSConfig_MutualTLS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCA := testutil.CreateTestCA(t, "server-ca")
+	clientCA := testutil.CreateTestCA(t, "client-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	certPEM, keyPEM := clientCA.IssueCertificate(t, "client-1")
+	conf := &Config{
+		CertFile:   testutil.WriteFile(t, dir, "tls.crt", certPEM),
+		KeyFile:    testutil.WriteFile(t, dir, "tls.key", keyPEM),
+		CAFile:     testutil.WriteFile(t, dir, "ca.crt", serverCA.CertPEM),
+		ServerName: "127.0.0.1",
+	}
+	tlsConfig, err := conf.NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+
+	body, err := get(t, tlsConfig, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "client-1", body)
+
+	// Rotated certificates are presented on new connections
+	certPEM, keyPEM = clientCA.IssueCertificate(t, "client-2")
+	testutil.WriteFile(t, dir, "tls.crt", certPEM)
+	testutil.WriteFile(t, dir, "tls.key", keyPEM)
+
+	body, err = get(t, tlsConfig, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "client-2", body)
+}
+
+func TestNewTLSConfig_CAReload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCA := testutil.CreateTestCA(t, "server-ca")
+	clientCA := testutil.CreateTestCA(t, "client-ca")
+	otherCA := testutil.CreateTestCA(t, "other-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	certPEM, keyPEM := clientCA.IssueCertificate(t, "client")
+	conf := &Config{
+		CertFile:   testutil.WriteFile(t, dir, "tls.crt", certPEM),
+		KeyFile:    testutil.WriteFile(t, dir, "tls.key", keyPEM),
+		CAFile:     testutil.WriteFile(t, dir, "ca.crt", otherCA.CertPEM),
+		ServerName: "127.0.0.1",
+	}
+	tlsConfig, err := conf.NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+
+	_, err = get(t, tlsConfig, server.URL)
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+
+	testutil.WriteFile(t, dir, "ca.crt", serverCA.CertPEM)
+	_, err = get(t, tlsConfig, server.URL)
+	assert.NoError(t, err)
+}
+
+func TestNewTLSConfig_VerifiesServerName(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCA := testutil.CreateTestCA(t, "server-ca")
+	clientCA := testutil.CreateTestCA(t, "client-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	certPEM, keyPEM := clientCA.IssueCertificate(t, "client")
+	conf := &Config{
+		CertFile: testutil.WriteFile(t, dir, "tls.crt", certPEM),
+		KeyFile:  testutil.WriteFile(t, dir, "tls.key", keyPEM),
+		CAFile:   testutil.WriteFile(t, dir, "ca.crt", serverCA.CertPEM),
+	}
+
+	// IP addresses are not sent as SNI, so no name is known to verify
+	tlsConfig, err := conf.NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+	_, err = get(t, tlsConfig, server.URL)
+	assert.ErrorContains(t, err, errServerNameUnset.Error())
+
+	tlsConfig, err = conf.WithDefaultServerName("prometheus.internal").NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+	_, err = get(t, tlsConfig, server.URL)
+	assert.ErrorContains(t, err, "certificate is valid for localhost, not prometheus.internal")
+
+	tlsConfig, err = conf.WithDefaultServerName("127.0.0.1").NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+	_, err = get(t, tlsConfig, server.URL)
+	assert.NoError(t, err)
+}
+
+func TestConfigWithDefaultServerName(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, (*Config)(nil).WithDefaultServerName("prometheus.internal"))
+	assert.Equal(t, &Config{}, (&Config{}).WithDefaultServerName("prometheus.internal"))
+	assert.Equal(t, "prometheus.internal", (&Config{CAFile: "ca.crt"}).WithDefaultServerName("prometheus.internal").ServerName)
+	assert.Equal(t, "override", (&Config{ServerName: "override"}).WithDefaultServerName("prometheus.internal").ServerName)
+}
+
+func TestConfigWithServerName(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, (*Config)(nil).WithServerName("prometheus.internal"))
+	assert.Equal(t, &Config{}, (&Config{}).WithServerName("prometheus.internal"))
+	assert.Equal(t, "prometheus.internal", (&Config{ServerName: "override"}).WithServerName("prometheus.internal").ServerName)
+}
+
+func TestConfigNewHTTPClient(t *testing.T) {
+	t.Parallel()
+	l := testutil.CreateTestLogger(t)
+
+	t.Run("without_tls", func(t *testing.T) {
+		t.Parallel()
+		client, err := (*Config)(nil).NewHTTPClient(l)
+		require.NoError(t, err)
+
+		transport, ok := client.Transport.(*http.Transport)
+		require.True(t, ok)
+		if transport.TLSClientConfig != nil {
+			assert.Empty(t, transport.TLSClientConfig.ServerName)
+			assert.Nil(t, transport.TLSClientConfig.GetClientCertificate)
+		}
+	})
+
+	t.Run("with_tls", func(t *testing.T) {
+		t.Parallel()
+		client, err := (&Config{ServerName: "prometheus.internal"}).NewHTTPClient(l)
+		require.NoError(t, err)
+
+		transport, ok := client.Transport.(*http.Transport)
+		require.True(t, ok)
+		assert.Equal(t, "prometheus.internal", transport.TLSClientConfig.ServerName)
+	})
+
+	t.Run("invalid_tls", func(t *testing.T) {
+		t.Parallel()
+		_, err := (&Config{CertFile: "tls.crt"}).NewHTTPClient(l)
+		assert.Error(t, err)
+	})
+}
+
+func TestNewTLSConfig_KeepsLastValidCertificate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := testutil.CreateTestCA(t, "ca")
+
+	certPEM, keyPEM := ca.IssueCertificate(t, "client")
+	conf := &Config{
+		CertFile: testutil.WriteFile(t, dir, "tls.crt", certPEM),
+		KeyFile:  testutil.WriteFile(t, dir, "tls.key", keyPEM),
+	}
+	tlsConfig, err := conf.NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+
+	first, err := tlsConfig.GetClientCertificate(nil)
+	require.NoError(t, err)
+
+	// A partially written rotation must not break new connections
+	testutil.WriteFile(t, dir, "tls.crt", []byte("invalid"))
+	second, err := tlsConfig.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+}
+
+func TestNewTLSConfig_Options(t *testing.T) {
+	t.Parallel()
+	conf := &Config{
+		ServerName:         "prometheus.internal",
+		MinVersion:         "TLS13",
+		InsecureSkipVerify: true,
+	}
+	tlsConfig, err := conf.NewTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+
+	assert.Equal(t, "prometheus.internal", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.GetClientCertificate)
+	assert.Nil(t, tlsConfig.VerifyConnection)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		conf        *Config
+		expectedErr string
+	}{
+		{
+			name: "empty config",
+			conf: &Config{},
+		},
+		{
+			name:        "cert without key",
+			conf:        &Config{CertFile: "tls.crt"},
+			expectedErr: errCertKeyMismatch.Error(),
+		},
+		{
+			name:        "invalid min version",
+			conf:        &Config{MinVersion: "SSL3"},
+			expectedErr: `invalid tls min version "SSL3"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.conf.Validate()
+			if tt.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expectedErr)
+		})
+	}
+}
+
+func TestNewTLSConfig_InvalidFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	_, err := (&Config{CAFile: testutil.WriteFile(t, dir, "ca.crt", []byte("invalid"))}).NewTLSConfig(testutil.CreateTestLogger(t))
+	assert.Equal(t, errNoCACerts, err)
+
+	_, err = (&Config{CertFile: dir + "/missing.crt", KeyFile: dir + "/missing.key"}).NewTLSConfig(testutil.CreateTestLogger(t))
+	assert.ErrorContains(t, err, "failed to read tls certificate")
+}
+
+func TestConfigIsSet(t *testing.T) {
+	t.Parallel()
+	var nilConf *Config
+	assert.False(t, nilConf.IsSet())
+	assert.False(t, (&Config{}).IsSet())
+	assert.True(t, (&Config{CAFile: "ca.crt"}).IsSet())
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCA := testutil.CreateTestCA(t, "server-ca")
+	clientCA := testutil.CreateTestCA(t, "client-ca")
+
+	certPEM, keyPEM := serverCA.IssueCertificate(t, "proxy")
+	conf := &Config{
+		CertFile: testutil.WriteFile(t, dir, "tls.crt", certPEM),
+		KeyFile:  testutil.WriteFile(t, dir, "tls.key", keyPEM),
+		CAFile:   testutil.WriteFile(t, dir, "client-ca.crt", clientCA.CertPEM),
+	}
+	serverTLS, err := conf.NewServerTLSConfig(testutil.CreateTestLogger(t))
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) == 0 {
+			w.Write([]byte("anonymous"))
+			return
+		}
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.Cert)
+
+	// Client certificates are optional
+	body, err := get(t, &tls.Config{RootCAs: roots}, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	clientCert, clientKey := clientCA.IssueCertificate(t, "grafana")
+	cert, err := tls.X509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	body, err = get(t, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "grafana", body)
+
+	// Certificates from other CAs are rejected during the handshake
+	otherCert, otherKey := serverCA.IssueCertificate(t, "intruder")
+	cert, err = tls.X509KeyPair(otherCert, otherKey)
+	require.NoError(t, err)
+	_, err = get(t, &tls.Config{
+		RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		},
+	}, server.URL)
+	assert.Error(t, err)
+
+	_, err = (&Config{}).NewServerTLSConfig(testutil.CreateTestLogger(t))
+	assert.Equal(t, errServerCertUnset, err)
+}
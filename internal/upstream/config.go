@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"gopkg.in/yaml.v3"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Config lists the named upstreams and how requests are routed to them
+type Config struct {
+	// A request header naming the upstream to route the request to
+	Header    string            `yaml:"header"`
+	Upstreams []*UpstreamConfig `yaml:"upstreams"`
+}
+
+// UpstreamConfig describes a named Prometheus backend and its credentials
+type UpstreamConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Callers and groups whose requests are routed to the upstream when no
+	// upstream is named in the path or header
+	Callers []string `yaml:"callers"`
+	Groups  []string `yaml:"groups"`
+	// Only the callers and groups may use the upstream, however it is selected
+	Restricted bool `yaml:"restricted"`
+	// The credentials of the upstream, with the same providers and settings
+	// as the command line flags
+	Auth auth.Config `yaml:"auth"`
+}
+
+// Parses an upstreams file, validating the upstreams and their credentials
+func Parse(data []byte) (*Config, error) {
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams defined")
+	}
+	names := make(map[string]bool)
+	for i, u := range config.Upstreams {
+		if !namePattern.MatchString(u.Name) {
+			return nil, fmt.Errorf("invalid name %q of upstream %d, must only contain letters, digits, _ and -", u.Name, i+1)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("duplicate upstream %q", u.Name)
+		}
+		names[u.Name] = true
+
+		if err := u.validate(); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", u.Name, err)
+		}
+	}
+	return config, nil
+}
+
+func (u *UpstreamConfig) validate() error {
+	parsed, err := url.Parse(u.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid url %q", u.URL)
+	}
+	if u.Restricted && len(u.Callers) == 0 && len(u.Groups) == 0 {
+		return fmt.Errorf("restricted upstreams must list callers or groups")
+	}
+	return validateAuth(&u.Auth)
+}
+
+// Validates the auth config, defaulting to the azure provider and merging
+// several providers as the command line flags do
+func validateAuth(a *auth.Config) error {
+	if len(a.Providers) == 0 {
+		a.Providers = []string{"azure"}
+	}
+	if a.ChainMode == "" {
+		a.ChainMode = auth.ChainMerge
+	}
+	// Settings are named by their path in the file
+	return a.Validate(func(path string) string { return path })
+}
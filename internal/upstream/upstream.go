@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/logger"
+	"github.com/s-humphreys/prometheus-proxy/internal/promapi"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+)
+
+// Requests under the prefix name their upstream in the path, as in
+// /upstream/<name>/api/v1/query
+const PathPrefix = "/upstream/"
+
+var (
+	errNotFound          = errors.New("not found")
+	errUpstreamForbidden = errors.New("caller is not allowed to use the upstream")
+)
+
+// Upstream is a named Prometheus backend with its own credentials
+type Upstream struct {
+	Name   string
+	URL    string
+	Client auth.Client
+	// Verifies the upstream certificate against the host of URL
+	HTTPClient *http.Client
+
+	config *UpstreamConfig
+}
+
+// Reports whether the upstream is selected for the caller by default
+func (u *Upstream) selects(identity *inbound.Identity) bool {
+	if identity == nil {
+		return false
+	}
+	return slices.Contains(u.config.Callers, identity.Name) ||
+		slices.ContainsFunc(identity.Groups, func(group string) bool { return slices.Contains(u.config.Groups, group) })
+}
+
+// Reports whether the caller may use the upstream
+func (u *Upstream) allows(identity *inbound.Identity) bool {
+	return !u.config.Restricted || u.selects(identity)
+}
+
+// Router routes requests to named upstreams from a config file. Requests
+// which select no upstream are forwarded to the default Prometheus URL
+type Router struct {
+	File string
+	// The TLS settings of every upstream, whose certificates are verified
+	// against their own host
+	TLS *tlsconfig.Config
+
+	header    string
+	upstreams []*Upstream
+}
+
+// Reads the upstreams file and initialises the client of every upstream. The
+// file is only read once, as the clients hold credentials and tokens
+func (r *Router) Init(l *logger.Logger) error {
+	data, err := os.ReadFile(r.File)
+	if err != nil {
+		return err
+	}
+	config, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("invalid upstreams file %s: %w", r.File, err)
+	}
+
+	r.header = config.Header
+	r.upstreams = nil
+	for _, u := range config.Upstreams {
+		// Expiring tokens are refreshed in the background, off the request path
+		client := auth.ManageTokens(auth.NewClient(&u.Auth))
+		if err := client.InitClient(&logger.Logger{Logger: l.With("upstream", u.Name)}); err != nil {
+			return fmt.Errorf("failed to initialize authentication client of upstream %q: %w", u.Name, err)
+		}
+		parsed, err := url.Parse(u.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url of upstream %q: %w", u.Name, err)
+		}
+		httpClient, err := r.TLS.WithServerName(parsed.Hostname()).NewHTTPClient(l)
+		if err != nil {
+			return fmt.Errorf("failed to create http client of upstream %q: %w", u.Name, err)
+		}
+		r.upstreams = append(r.upstreams, &Upstream{
+			Name:       u.Name,
+			URL:        strings.TrimSuffix(u.URL, "/"),
+			Client:     client,
+			HTTPClient: httpClient,
+			config:     u,
+		})
+	}
+	l.Info("loaded upstreams", "file", r.File, "upstreams", len(r.upstreams))
+	return nil
+}
+
+// Returns the upstream with the name, if any
+func (r *Router) lookup(name string) (*Upstream, bool) {
+	for _, u := range r.upstreams {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// Middleware selects the upstream of each request, from the path prefix, the
+// routing header or the caller, in that order, and stores it in the request
+// context. The path prefix is removed before the request is passed on
+func (r *Router) Middleware(logger *logger.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, _ := inbound.IdentityFromContext(req.Context())
+
+		var selected *Upstream
+		if rest, ok := strings.CutPrefix(req.URL.Path, PathPrefix); ok {
+			name, path, _ := strings.Cut(rest, "/")
+			u, ok := r.lookup(name)
+			if !ok {
+				logger.WithRequestFields(req).Warn("rejected request for unknown upstream", "upstream", name)
+				promapi.WriteError(w, http.StatusNotFound, promapi.ErrorNotFound, fmt.Errorf("unknown upstream %q", name))
+				return
+			}
+			// Only the routes served without a prefix are proxied
+			path = "/" + path
+			if !promapi.IsRoute(path) {
+				promapi.WriteError(w, http.StatusNotFound, promapi.ErrorNotFound, errNotFound)
+				return
+			}
+			selected = u
+
+			req = req.Clone(req.Context())
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		} else if name := req.Header.Get(r.header); r.header != "" && name != "" {
+			u, ok := r.lookup(name)
+			if !ok {
+				logger.WithRequestFields(req).Warn("rejected request for unknown upstream", "upstream", name)
+				promapi.WriteError(w, http.StatusBadRequest, promapi.ErrorBadData, fmt.Errorf("unknown upstream %q in header %s", name, r.header))
+				return
+			}
+			selected = u
+		} else {
+			for _, u := range r.upstreams {
+				if u.selects(identity) {
+					selected = u
+					break
+				}
+			}
+		}
+
+		if selected == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !selected.allows(identity) {
+			logger.WithRequestFields(req).Warn("rejected request for restricted upstream", "upstream", selected.Name)
+			promapi.WriteError(w, http.StatusForbidden, promapi.ErrorForbidden, errUpstreamForbidden)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(WithUpstream(req.Context(), selected)))
+	})
+}
+
+type upstreamKey struct{}
+
+// Returns a copy of the context carrying the selected upstream
+func WithUpstream(ctx context.Context, upstream *Upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, upstream)
+}
+
+// Returns the upstream selected for the request, if any
+func FromContext(ctx context.Context) (*Upstream, bool) {
+	upstream, ok := ctx.Value(upstreamKey{}).(*Upstream)
+	return upstream, ok
+}
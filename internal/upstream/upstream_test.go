@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/s-humphreys/prometheus-proxy/internal/auth"
+	"github.com/s-humphreys/prometheus-proxy/internal/inbound"
+	"github.com/s-humphreys/prometheus-proxy/internal/testutil"
+	"github.com/s-humphreys/prometheus-proxy/internal/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUpstreams = `
+header: X-Upstream
+upstreams:
+  - name: prod
+    url: https://prod.example.com/
+    groups: [sre]
+    restricted: true
+    auth:
+      providers: [bearer]
+      bearer:
+        token: prod-token
+  - name: staging
+    url: https://staging.example.com
+    callers: [ci]
+    auth:
+      providers: [bearer]
+      bearer:
+        token: staging-token
+      static_headers:
+        X-Scope-OrgID: staging
+`
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	config, err := Parse([]byte(testUpstreams))
+	require.NoError(t, err)
+	assert.Equal(t, "X-Upstream", config.Header)
+	require.Len(t, config.Upstreams, 2)
+	assert.Equal(t, auth.ChainMerge, config.Upstreams[0].Auth.ChainMode)
+	assert.IsType(t, &auth.BearerClient{}, auth.NewClient(&config.Upstreams[0].Auth))
+	assert.IsType(t, &auth.ChainClient{}, auth.NewClient(&config.Upstreams[1].Auth))
+
+	azure, err := Parse([]byte("upstreams:\n  - name: eu\n    url: https://eu.example.com\n    auth:\n      azure:\n        imds: true\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"azure"}, azure.Upstreams[0].Auth.Providers)
+	assert.IsType(t, &auth.AzureClient{}, auth.NewClient(&azure.Upstreams[0].Auth))
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{name: "no upstreams", config: "header: X-Upstream\n", expected: "no upstreams defined"},
+		{name: "invalid name", config: "upstreams:\n  - name: a/b\n    url: https://example.com\n", expected: `invalid name "a/b"`},
+		{name: "duplicate name", config: "upstreams:\n  - name: a\n    url: https://example.com\n    auth: {providers: [gcp]}\n  - name: a\n    url: https://example.com\n", expected: `duplicate upstream "a"`},
+		{name: "invalid url", config: "upstreams:\n  - name: a\n    url: example.com\n", expected: `invalid url "example.com"`},
+		{name: "restricted without callers", config: "upstreams:\n  - name: a\n    url: https://example.com\n    restricted: true\n", expected: "must list callers or groups"},
+		{name: "missing credentials", config: "upstreams:\n  - name: a\n    url: https://example.com\n    auth: {providers: [bearer]}\n", expected: `one of "bearer.token" or "bearer.token_file" must be set`},
+		{name: "invalid provider", config: "upstreams:\n  - name: a\n    url: https://example.com\n    auth: {providers: [kerberos]}\n", expected: `invalid auth provider "kerberos"`},
+		{name: "invalid chain mode", config: "upstreams:\n  - name: a\n    url: https://example.com\n    auth: {providers: [gcp], chain_mode: any}\n", expected: `invalid auth chain mode "any"`},
+		{name: "aws in fallback chain", config: "upstreams:\n  - name: a\n    url: https://example.com\n    auth: {providers: [aws, gcp], chain_mode: fallback}\n", expected: `cannot be combined with "chain_mode" fallback`},
+		{name: "unknown field", config: "upstreams:\n  - name: a\n    uri: https://example.com\n", expected: "field uri not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := Parse([]byte(tt.config))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestRouter_Middleware(t *testing.T) {
+	t.Parallel()
+	logger := testutil.CreateTestLogger(t)
+	router := &Router{File: testutil.WriteFile(t, t.TempDir(), "upstreams.yaml", []byte(testUpstreams))}
+	require.NoError(t, router.Init(logger))
+
+	handler := router.Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "default"
+		if u, ok := FromContext(r.Context()); ok {
+			name = u.Name
+		}
+		w.Write([]byte(name + " " + r.URL.Path))
+	}))
+
+	tests := []struct {
+		name           string
+		path           string
+		header         string
+		identity       *inbound.Identity
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "default", path: "/api/v1/query", expectedStatus: http.StatusOK, expectedBody: "default /api/v1/query"},
+		{name: "path prefix", path: "/upstream/staging/api/v1/query", expectedStatus: http.StatusOK, expectedBody: "staging /api/v1/query"},
+		{name: "path prefix takes precedence", path: "/upstream/staging/api/v1/labels", header: "prod", identity: &inbound.Identity{Name: "alice", Groups: []string{"sre"}}, expectedStatus: http.StatusOK, expectedBody: "staging /api/v1/labels"},
+		{name: "unknown path upstream", path: "/upstream/dev/api/v1/query", expectedStatus: http.StatusNotFound, expectedBody: `unknown upstream \"dev\"`},
+		{name: "path outside api", path: "/upstream/staging/-/reload", expectedStatus: http.StatusNotFound, expectedBody: "not found"},
+		{name: "admin api", path: "/upstream/staging/api/v1/admin/tsdb/delete_series", expectedStatus: http.StatusNotFound, expectedBody: "not found"},
+		{name: "status api", path: "/upstream/staging/api/v1/status/config", expectedStatus: http.StatusNotFound, expectedBody: "not found"},
+		{name: "label values", path: "/upstream/staging/api/v1/label/job/values", expectedStatus: http.StatusOK, expectedBody: "staging /api/v1/label/job/values"},
+		{name: "header", path: "/api/v1/query", header: "staging", expectedStatus: http.StatusOK, expectedBody: "staging /api/v1/query"},
+		{name: "unknown header upstream", path: "/api/v1/query", header: "dev", expectedStatus: http.StatusBadRequest, expectedBody: `unknown upstream \"dev\" in header X-Upstream`},
+		{name: "caller", path: "/api/v1/series", identity: &inbound.Identity{Name: "ci"}, expectedStatus: http.StatusOK, expectedBody: "staging /api/v1/series"},
+		{name: "group", path: "/api/v1/series", identity: &inbound.Identity{Name: "alice", Groups: []string{"sre"}}, expectedStatus: http.StatusOK, expectedBody: "prod /api/v1/series"},
+		{name: "restricted", path: "/upstream/prod/api/v1/query", identity: &inbound.Identity{Name: "ci"}, expectedStatus: http.StatusForbidden, expectedBody: "caller is not allowed to use the upstream"},
+		{name: "restricted without identity", path: "/api/v1/query", header: "prod", expectedStatus: http.StatusForbidden, expectedBody: "caller is not allowed to use the upstream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := testutil.CreateHTTPRequest(t, http.MethodGet, tt.path, http.NoBody)
+			if tt.header != "" {
+				req.Header.Set("X-Upstream", tt.header)
+			}
+			if tt.identity != nil {
+				req = req.WithContext(inbound.WithIdentity(req.Context(), tt.identity))
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
+
+func TestRouter_Init(t *testing.T) {
+	t.Parallel()
+	logger := testutil.CreateTestLogger(t)
+	router := &Router{File: testutil.WriteFile(t, t.TempDir(), "upstreams.yaml", []byte(testUpstreams))}
+	require.NoError(t, router.Init(logger))
+
+	prod, ok := router.lookup("prod")
+	require.True(t, ok)
+	assert.Equal(t, "https://prod.example.com", prod.URL)
+	headers, err := prod.Client.GetHeaders(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []auth.ClientHeader{{Key: "Authorization", Value: "Bearer prod-token"}}, headers)
+
+	err = (&Router{File: filepath.Join(t.TempDir(), "missing.yaml")}).Init(logger)
+	assert.Error(t, err)
+
+	invalid := testutil.WriteFile(t, t.TempDir(), "upstreams.yaml", []byte("upstreams: []\n"))
+	err = (&Router{File: invalid}).Init(logger)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no upstreams defined")
+}
+
+func TestRouter_InitVerifiesEachUpstreamHost(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := testutil.CreateTestCA(t, "upstream-ca")
+
+	// Each upstream presents a certificate valid only for its own host
+	newServer := func(host string) *httptest.Server {
+		certPEM, keyPEM := ca.IssueCertificateFor(t, host, host)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(host))
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	byName := "https://localhost:" + newServer("localhost").URL[len("https://127.0.0.1:"):]
+	byIP := newServer("127.0.0.1").URL
+
+	file := testutil.WriteFile(t, dir, "upstreams.yaml", []byte(`
+upstreams:
+  - name: by-name
+    url: `+byName+`
+    auth: {providers: [bearer], bearer: {token: a}}
+  - name: by-ip
+    url: `+byIP+`
+    auth: {providers: [bearer], bearer: {token: b}}
+`))
+	// The server name set for the default upstream does not apply
+	router := &Router{File: file, TLS: &tlsconfig.Config{
+		CAFile:     testutil.WriteFile(t, dir, "ca.crt", ca.CertPEM),
+		ServerName: "prometheus.internal",
+	}}
+	require.NoError(t, router.Init(testutil.CreateTestLogger(t)))
+
+	get := func(u *Upstream, url string) (string, error) {
+		resp, err := u.HTTPClient.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	named, _ := router.lookup("by-name")
+	ip, _ := router.lookup("by-ip")
+	body, err := get(named, byName)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", body)
+	body, err = get(ip, byIP)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", body)
+
+	// A certificate is only accepted for the upstream it was issued for
+	_, err = get(named, byIP)
+	assert.ErrorContains(t, err, "wanted to match localhost")
+	_, err = get(ip, byName)
+	assert.ErrorContains(t, err, "cannot validate certificate for 127.0.0.1")
+}